@@ -133,8 +133,38 @@ func promptForServerAddress() string {
 
 func main() {
 	serverAddr := flag.String("server", "", "Server address in format host:port")
+	peerPort := flag.Int("peer-port", 0, "Port for direct transfers from other peers (0 picks a free port)")
+	trustedUsers := flag.String("auto-accept-from", "", "Comma-separated user IDs or usernames whose transfers are accepted without asking")
+	autoAcceptSize := flag.Int64("auto-accept-max-size", 0, "Accept transfers up to this many bytes without asking (0 disables)")
+	checksum := flag.String("checksum", helper.DefaultChecksumAlgorithm, "Checksum algorithm for outgoing transfers ("+strings.Join(helper.ChecksumAlgorithms(), ", ")+"; md5 is legacy only)")
+	caFile := flag.String("ca", "", "Trust only servers whose TLS certificate is signed by this CA (PEM)")
+	fingerprint := flag.String("fingerprint", "", "Trust only a server TLS certificate with this SHA-256 fingerprint")
+	knownServers := flag.String("known-servers", connection.DefaultKnownServersFile(), "File remembering server fingerprints trusted on first use")
+	extractMaxSize := flag.Int64("extract-max-size", connection.DefaultFolderLimits.MaxBytes, "Refuse received folders larger than this many bytes")
+	extractMaxFiles := flag.Int("extract-max-files", connection.DefaultFolderLimits.MaxEntries, "Refuse received folders with more than this many files and folders")
+	sessions := flag.String("sessions", connection.DefaultSessionsFile(), "File keeping session tokens so restarts skip the password (empty disables)")
+	syncInterval := flag.Duration("sync-interval", connection.DefaultSyncInterval, "How often folders synced with /sync are checked for changes")
 	flag.Parse()
 
+	if *trustedUsers != "" || *autoAcceptSize > 0 {
+		connection.SetAutoAcceptPolicy(strings.Split(*trustedUsers, ","), *autoAcceptSize)
+	}
+
+	if err := connection.SetChecksumAlgorithm(*checksum); err != nil {
+		fmt.Println(utils.ErrorColor("❌"), err)
+		os.Exit(1)
+	}
+
+	connection.SetSessionsFile(*sessions)
+	connection.SetFolderLimits(*extractMaxSize, *extractMaxFiles)
+	connection.SetSyncInterval(*syncInterval)
+
+	err := connection.ConfigureTLS(connection.TLSOptions{CAFile: *caFile, Fingerprint: *fingerprint, KnownServersFile: *knownServers})
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error configuring TLS:"), err)
+		os.Exit(1)
+	}
+
 	utils.PrintBanner()
 
 	// If server address not provided via command line, ask user
@@ -167,7 +197,7 @@ func main() {
 	defer connection.Close(conn)
 
 	fmt.Println(utils.InfoColor("Please login to continue:"))
-	err = connection.UserInput("Username", conn)
+	err = connection.Login(conn)
 	if err != nil {
 		if err.Error() == "reconnect" {
 			goto startChat
@@ -177,16 +207,6 @@ func main() {
 		}
 	}
 
-	err = connection.UserInput("Store File Path", conn)
-	if err != nil {
-		if err.Error() == "reconnect" {
-			goto startChat
-		} else {
-			fmt.Println(utils.ErrorColor("❌ Error setting file path:"), err)
-			return
-		}
-	}
-
 startChat:
 	fmt.Println(utils.HeaderColor("\n✨ Welcome to DrizLink - P2P File Sharing! ✨"))
 	fmt.Println(utils.InfoColor("------------------------------------------------"))
@@ -194,6 +214,17 @@ startChat:
 	fmt.Println(utils.InfoColor("Type /help to see available commands"))
 	fmt.Println(utils.InfoColor("------------------------------------------------"))
 
+	// Transfers are end-to-end encrypted with keys only this session knows
+	if err := connection.AnnounceEncryptionKey(conn); err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error setting up end-to-end encryption:"), err)
+		return
+	}
+
+	// Other peers send to us directly; without a listener everything is relayed
+	if err := connection.StartPeerListener(conn, *peerPort); err != nil {
+		fmt.Println(utils.WarningColor("⚠️  Direct transfers unavailable, using server relay:"), err)
+	}
+
 	go connection.ReadLoop(conn)
 	connection.WriteLoop(conn)
 }
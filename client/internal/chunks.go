@@ -0,0 +1,244 @@
+package connection
+
+import (
+	"drizlink/helper"
+	"drizlink/protocol"
+	"drizlink/utils"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// ChunkRetryLimit bounds how many times the same transfer resends bad chunks
+const ChunkRetryLimit = 5
+
+// sendChunks streams src from offset to size as sealed, hashed chunks, then
+// resends any chunks the receiver reports as corrupt by reading them again from
+// file. The payload checksum is computed on the way and sent, sealed as well, as
+// a trailer in MsgChunksDone.
+func sendChunks(dataConn io.ReadWriter, src io.Reader, file io.ReaderAt, offset, size int64, algorithm string, sealer *helper.PayloadCipher) (string, error) {
+	if offset%protocol.ChunkSize != 0 && offset != size {
+		return "", fmt.Errorf("resume offset %d is not on a chunk boundary", offset)
+	}
+
+	// The checksum covers the whole payload, so only the part the receiver
+	// already has is read an extra time
+	sum, err := helper.NewStreamChecksum(algorithm)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(sum, io.NewSectionReader(file, 0, offset)); err != nil {
+		return "", err
+	}
+	src = sum.Reader(src)
+
+	buf := make([]byte, protocol.ChunkSize)
+	for index := offset / protocol.ChunkSize; index < protocol.ChunkCount(size); index++ {
+		chunk := buf[:protocol.ChunkLength(index, size)]
+		if _, err := io.ReadFull(src, chunk); err != nil {
+			return "", err
+		}
+		if err := protocol.WriteChunk(dataConn, index, sealer.Seal(helper.ChunkPurpose(0), index, chunk)); err != nil {
+			return "", err
+		}
+	}
+
+	// The relay must not learn the checksum either, it would identify known files
+	checksum := sum.Sum()
+	trailer := protocol.Message{
+		Type: protocol.MsgChunksDone,
+		Transfer: &protocol.TransferInfo{
+			Checksum:          hex.EncodeToString(sealer.Seal(helper.SealTrailer, 0, []byte(checksum))),
+			ChecksumAlgorithm: sum.Algorithm(),
+		},
+	}
+	for round := 0; ; round++ {
+		if err := protocol.WriteMessage(dataConn, trailer); err != nil {
+			return "", err
+		}
+		reply, err := protocol.ReadMessage(dataConn)
+		if err != nil {
+			return "", fmt.Errorf("waiting for chunk verification: %v", err)
+		}
+		if reply.Type != protocol.MsgChunkRetry {
+			return "", fmt.Errorf("expected chunk verification, got %s", reply.Type)
+		}
+		if len(reply.Chunks) == 0 {
+			return checksum, nil
+		}
+		if round == ChunkRetryLimit {
+			return "", fmt.Errorf("%d chunks still corrupt after %d retries", len(reply.Chunks), ChunkRetryLimit)
+		}
+
+		fmt.Printf("%s Resending %d corrupted chunk(s)\n", utils.WarningColor("🔁"), len(reply.Chunks))
+		for _, index := range reply.Chunks {
+			if index < 0 || index >= protocol.ChunkCount(size) {
+				return "", fmt.Errorf("receiver asked for unknown chunk %d", index)
+			}
+			chunk := buf[:protocol.ChunkLength(index, size)]
+			if _, err := file.ReadAt(chunk, index*protocol.ChunkSize); err != nil {
+				return "", err
+			}
+			if err := protocol.WriteChunk(dataConn, index, sealer.Seal(helper.ChunkPurpose(round+1), index, chunk)); err != nil {
+				return "", err
+			}
+		}
+	}
+}
+
+// receiveChunks reads sealed, hashed chunks from offset to size. Chunks
+// arriving in order go through dst; corrupt or unauthentic ones are asked for
+// again once the sender is done and patched into the partial file in place. It
+// returns the sender's checksum trailer together with the checksum of what was
+// actually received.
+func receiveChunks(dataConn io.ReadWriter, dst io.Writer, partial *journalWriter, offset, size int64, progress io.Writer, algorithm string, opener *helper.PayloadCipher) (string, string, error) {
+	next := offset / protocol.ChunkSize
+	bad := make(map[int64]bool)
+
+	// Hash inline while the bytes are written; only what was received in an
+	// earlier attempt is read back from disk
+	sum, err := helper.NewStreamChecksum(algorithm)
+	if err != nil {
+		return "", "", err
+	}
+	if _, err := io.Copy(sum, io.NewSectionReader(partial.file, 0, offset)); err != nil {
+		return "", "", err
+	}
+	patched := false
+	trailer := ""
+	// round counts the resend requests so far, which chunk nonces depend on
+	round := 0
+
+	for {
+		frame, err := protocol.ReadFrame(dataConn)
+		if err != nil {
+			return "", "", err
+		}
+
+		switch frame.Type {
+		case protocol.ChunkFrame:
+			chunk, err := protocol.ParseChunk(frame)
+			if err != nil {
+				return "", "", err
+			}
+			if chunk.Index < 0 || chunk.Index >= protocol.ChunkCount(size) {
+				return "", "", fmt.Errorf("unexpected chunk %d", chunk.Index)
+			}
+			length := protocol.ChunkLength(chunk.Index, size)
+			if chunk.Valid {
+				// A chunk that fails authentication is treated like a corrupt one
+				plaintext, err := opener.Open(helper.ChunkPurpose(round), chunk.Index, chunk.Data)
+				chunk.Data, chunk.Valid = plaintext, err == nil && int64(len(plaintext)) == length
+			}
+			if !chunk.Valid {
+				// Keeps the file sequential until the retransmit replaces it
+				chunk.Data = make([]byte, length)
+			}
+
+			if chunk.Index == next {
+				// First pass: keep the file sequential even when the chunk is
+				// bad, it is overwritten once the retransmit arrives
+				if err := writeFull(dst, chunk.Data); err != nil {
+					return "", "", err
+				}
+				sum.Write(chunk.Data)
+				progress.Write(chunk.Data)
+				next++
+				if !chunk.Valid {
+					bad[chunk.Index] = true
+				}
+			} else if bad[chunk.Index] && chunk.Valid {
+				if _, err := partial.file.WriteAt(chunk.Data, chunk.Index*protocol.ChunkSize); err != nil {
+					return "", "", err
+				}
+				delete(bad, chunk.Index)
+				patched = true
+			} else if !bad[chunk.Index] {
+				return "", "", fmt.Errorf("unexpected chunk %d", chunk.Index)
+			}
+
+			// Never confirm bytes beyond the first chunk that still needs resending
+			partial.holdAt(firstBadOffset(bad))
+		case protocol.ControlFrame:
+			var msg protocol.Message
+			msg, err = protocol.DecodeMessage(frame.Payload)
+			if err != nil {
+				return "", "", err
+			}
+			if msg.Type != protocol.MsgChunksDone {
+				continue
+			}
+			if next < protocol.ChunkCount(size) {
+				return "", "", fmt.Errorf("sender finished after %d of %d chunks", next, protocol.ChunkCount(size))
+			}
+			if msg.Transfer != nil && msg.Transfer.Checksum != "" {
+				sealed, err := hex.DecodeString(msg.Transfer.Checksum)
+				if err != nil {
+					return "", "", fmt.Errorf("malformed checksum trailer: %v", err)
+				}
+				opened, err := opener.Open(helper.SealTrailer, 0, sealed)
+				if err != nil {
+					return "", "", fmt.Errorf("checksum trailer: %v", err)
+				}
+				trailer = string(opened)
+			}
+
+			retry := make([]int64, 0, len(bad))
+			for index := range bad {
+				retry = append(retry, index)
+			}
+			sort.Slice(retry, func(i, j int) bool { return retry[i] < retry[j] })
+			if len(retry) > 0 {
+				fmt.Printf("%s %d chunk(s) failed verification, asking for them again\n", utils.WarningColor("⚠️"), len(retry))
+			}
+			if err := protocol.WriteMessage(dataConn, protocol.Message{Type: protocol.MsgChunkRetry, Chunks: retry}); err != nil {
+				return "", "", err
+			}
+			if len(retry) > 0 {
+				round++
+				continue
+			}
+			if !patched {
+				return trailer, sum.Sum(), nil
+			}
+
+			// The inline hash saw the corrupt chunks, so hash the repaired file once
+			sum, err = helper.NewStreamChecksum(algorithm)
+			if err != nil {
+				return "", "", err
+			}
+			if _, err := io.Copy(sum, io.NewSectionReader(partial.file, 0, size)); err != nil {
+				return "", "", err
+			}
+			return trailer, sum.Sum(), nil
+		}
+	}
+}
+
+// firstBadOffset is where the first corrupt chunk starts, or -1 if there is none
+func firstBadOffset(bad map[int64]bool) int64 {
+	first := int64(-1)
+	for index := range bad {
+		if first < 0 || index < first {
+			first = index
+		}
+	}
+	if first < 0 {
+		return -1
+	}
+	return first * protocol.ChunkSize
+}
+
+// writeFull keeps writing until all of data is accepted, since a paused
+// CheckpointedWriter accepts nothing until it is resumed
+func writeFull(w io.Writer, data []byte) error {
+	for len(data) > 0 {
+		n, err := w.Write(data)
+		if err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
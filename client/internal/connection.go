@@ -2,6 +2,7 @@ package connection
 
 import (
 	"bufio"
+	"drizlink/protocol"
 	"drizlink/utils"
 	"errors"
 	"fmt"
@@ -9,16 +10,39 @@ import (
 	"os"
 	"strconv"
 	"strings"
-	"time"
+
+	"golang.org/x/term"
 )
 
 var currentRoom string
 
+// moderationMessages maps the room moderation commands that take a room
+// and a user to the message they send
+var moderationMessages = map[string]protocol.MessageType{
+	"/invite":        protocol.MsgInvite,
+	"/kick":          protocol.MsgKick,
+	"/ban":           protocol.MsgBan,
+	"/unban":         protocol.MsgUnban,
+	"/transferowner": protocol.MsgTransferOwner,
+}
+
+// stdin is shared by every prompt so buffered input is never lost between readers
+var stdin = bufio.NewReader(os.Stdin)
+
 func Connect(address string) (net.Conn, error) {
-	conn, err := net.Dial("tcp", address)
+	conn, err := dialServer(address)
 	if err != nil {
 		return nil, err
 	}
+
+	// Agree on the protocol version before the login exchange
+	if err := protocol.ClientHandshake(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// Data channels for transfers are opened to the same server
+	serverAddress = address
 	return conn, nil
 }
 
@@ -26,29 +50,114 @@ func Close(conn net.Conn) {
 	conn.Close()
 }
 
-func UserInput(attribute string, conn net.Conn) error {
-	// First check if we get a reconnection signal
-	buffer := make([]byte, 1024)
-	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
-	n, err := conn.Read(buffer)
-	conn.SetReadDeadline(time.Time{}) // Reset read deadline
+// Login resumes the session saved for this server if it is still valid,
+// otherwise it logs in to or registers an account
+func Login(conn net.Conn) error {
+	// A saved token resumes the session even if this machine's address changed
+	if saved := loadSession(serverAddress); saved.Token != "" {
+		// The share root is ours to choose; only this machine remembers it
+		if saved.StorePath == "" {
+			saved.StorePath = UserInput("Store File Path")
+		}
+		reply, err := authenticate(conn, protocol.Message{Type: protocol.MsgReconnect, Token: saved.Token, StorePath: saved.StorePath})
+		if err != nil {
+			return err
+		}
+		if reply.Type == protocol.MsgSession {
+			startSession(reply, saved.StorePath)
+			fmt.Printf("Welcome back %s!\n", reply.Username)
+			return errors.New("reconnect")
+		}
+		fmt.Println(utils.WarningColor("⚠️  " + reply.Text))
+		saveSession(serverAddress, savedSession{})
+	}
 
-	if err == nil && n > 0 {
-		message := string(buffer[:n])
-		if strings.HasPrefix(message, "/RECONNECT") {
-			parts := strings.SplitN(message, " ", 4)
-			if len(parts) == 3 {
-				fmt.Printf("Welcome back %s!\n", parts[1])
-				return errors.New("reconnect")
-			}
+	fmt.Println(utils.InfoColor("Do you have an account? (y/n)"))
+	fmt.Print(utils.CommandColor(">>> "))
+	choice, _ := stdin.ReadString('\n')
+	choice = strings.TrimSpace(strings.ToLower(choice))
+	register := choice != "y" && choice != "yes"
+	if register {
+		fmt.Println(utils.InfoColor("Let's create one."))
+	}
+
+	var storeFilePath string
+	for {
+		username := UserInput("Username")
+		password := PasswordInput("Password")
+		if register && PasswordInput("Password again") != password {
+			fmt.Println(utils.ErrorColor("❌ Passwords do not match"))
+			continue
+		}
+		if storeFilePath == "" {
+			storeFilePath = UserInput("Store File Path")
+		}
+
+		request := protocol.Message{Type: protocol.MsgLogin, Username: username, Password: password, StorePath: storeFilePath}
+		if register {
+			request.Type = protocol.MsgRegister
 		}
+		reply, err := authenticate(conn, request)
+		if err != nil {
+			return err
+		}
+		if reply.Type == protocol.MsgSession {
+			startSession(reply, storeFilePath)
+			return nil
+		}
+		fmt.Println(utils.ErrorColor("❌ " + reply.Text))
 	}
+}
 
-	// If no reconnection signal, proceed with normal user input
-	reader := bufio.NewReader(os.Stdin)
+// authenticate sends one login, registration or reconnect request and returns
+// the server's MsgSession or MsgError
+func authenticate(conn net.Conn, request protocol.Message) (protocol.Message, error) {
+	if err := protocol.WriteMessage(conn, request); err != nil {
+		return protocol.Message{}, fmt.Errorf("error in write login: %v", err)
+	}
+	reply, err := protocol.ReadMessage(conn)
+	if err != nil {
+		return protocol.Message{}, fmt.Errorf("error in read login: %v", err)
+	}
+	if reply.Type != protocol.MsgSession && reply.Type != protocol.MsgError {
+		return protocol.Message{}, fmt.Errorf("unexpected %s during login", reply.Type)
+	}
+	return reply, nil
+}
+
+// startSession shares storePath, the folder picked on this machine, and saves
+// it with the token the server issued so the next run can resume. It also
+// restores the active room of a resumed session.
+func startSession(session protocol.Message, storePath string) {
+	if err := saveSession(serverAddress, savedSession{Token: session.Token, StorePath: storePath}); err != nil {
+		fmt.Println(utils.WarningColor("⚠️  Could not save session:"), err)
+	}
+	fmt.Println(utils.SuccessColor("🔓 Logged in as"), utils.UserColor(fmt.Sprintf("%s [ID: %s]", session.Username, session.UserId)))
 
+	shareRoot = storePath
+	currentRoom = session.RoomId
+	if currentRoom != "" {
+		fmt.Println(utils.InfoColor("🏠 Active room:"), utils.CommandColor(fmt.Sprintf("%s (ID: %s)", session.RoomName, session.RoomId)))
+	}
+}
+
+// PasswordInput reads a password without echoing it when stdin is a terminal
+func PasswordInput(attribute string) string {
+	fmt.Println("Enter your " + attribute + ": ")
+	if term.IsTerminal(int(os.Stdin.Fd())) && stdin.Buffered() == 0 {
+		password, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Println()
+		if err == nil {
+			return string(password)
+		}
+	}
+	input, _ := stdin.ReadString('\n')
+	return strings.TrimRight(input, "\r\n")
+}
+
+func UserInput(attribute string) string {
 	fmt.Println("Enter your " + attribute + ": ")
-	input, _ := reader.ReadString('\n')
+	input, _ := stdin.ReadString('\n')
 	input = strings.TrimSpace(input)
 
 	// If it's a store file path, validate it
@@ -58,7 +167,7 @@ func UserInput(attribute string, conn net.Conn) error {
 			if _, err := os.Stat(input); os.IsNotExist(err) {
 				fmt.Println(utils.ErrorColor("❌ Error: Directory does not exist"))
 				fmt.Println("Enter a valid " + attribute + ": ")
-				input, _ = reader.ReadString('\n')
+				input, _ = stdin.ReadString('\n')
 				input = strings.TrimSpace(input)
 				continue
 			}
@@ -68,7 +177,7 @@ func UserInput(attribute string, conn net.Conn) error {
 			if err != nil || !fileInfo.IsDir() {
 				fmt.Println(utils.ErrorColor("❌ Error: Path is not a directory"))
 				fmt.Println("Enter a valid " + attribute + ": ")
-				input, _ = reader.ReadString('\n')
+				input, _ = stdin.ReadString('\n')
 				input = strings.TrimSpace(input)
 				continue
 			}
@@ -77,194 +186,137 @@ func UserInput(attribute string, conn net.Conn) error {
 		}
 	}
 
-	_, err = conn.Write([]byte(input))
-	if err != nil {
-		fmt.Println("error in write " + attribute)
-		panic(err)
-	}
-
-	return nil
+	return input
 }
 
 func ReadLoop(conn net.Conn) {
 	for {
-		buffer := make([]byte, 1024)
-		n, err := conn.Read(buffer)
+		msg, err := protocol.ReadMessage(conn)
 		if err != nil {
 			fmt.Println(utils.ErrorColor("❌ Connection lost:"), err)
 			return
 		}
-		message := string(buffer[:n])
-		switch {
-		case strings.HasPrefix(message, "/FILE_RESPONSE"):
-			fmt.Println(utils.InfoColor("📥 File transfer starting..."))
-			args := strings.SplitN(message, " ", 5)
-			if len(args) != 5 {
-				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /FILE_RESPONSE <userId> <filename> <fileSize> <storeFilePath>"))
-				continue
-			}
-			recipientId := args[1]
-			fileName := args[2]
-			fileSizeStr := strings.TrimSpace(args[3])
-			fileSize, err := strconv.ParseInt(fileSizeStr, 10, 64)
-			storeFilePath := args[4]
-			if err != nil {
-				fmt.Println(utils.ErrorColor("❌ Invalid fileSize. Use: /FILE_RESPONSE <userId> <filename> <fileSize> <storeFilePath>"))
+		switch msg.Type {
+		case protocol.MsgFileResponse:
+			if msg.Transfer == nil {
+				fmt.Println(utils.ErrorColor("❌ Invalid file offer: missing transfer details"))
 				continue
 			}
-
-			HandleFileTransfer(conn, recipientId, fileName, int64(fileSize), storeFilePath)
+			HandleTransferOffer(conn, msg, false)
 			continue
-		case strings.HasPrefix(message, "/FOLDER_RESPONSE"):
-			fmt.Println(utils.InfoColor("📥 Folder transfer starting..."))
-			args := strings.SplitN(message, " ", 5)
-			if len(args) != 5 {
-				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /FOLDER_RESPONSE <userId> <folderName> <folderSize> <storeFilePath>"))
-				continue
-			}
-			recipientId := args[1]
-			folderName := args[2]
-			folderSizeStr := strings.TrimSpace(args[3])
-			folderSize, err := strconv.ParseInt(folderSizeStr, 10, 64)
-			storeFilePath := args[4]
-			if err != nil {
-				fmt.Println(utils.ErrorColor("❌ Invalid folderSize. Use: /FOLDER_RESPONSE <userId> <folderName> <folderSize> <storeFilePath>"))
+		case protocol.MsgFolderResponse:
+			if msg.Transfer == nil {
+				fmt.Println(utils.ErrorColor("❌ Invalid folder offer: missing transfer details"))
 				continue
 			}
-			HandleFolderTransfer(conn, recipientId, folderName, folderSize, storeFilePath)
+			HandleTransferOffer(conn, msg, true)
 			continue
-		case strings.HasPrefix(message, "PING"):
-			_, err = conn.Write([]byte("PONG\n"))
+		case protocol.MsgTransferReady, protocol.MsgTransferRejected:
+			deliverTransferReply(msg)
+			continue
+		case protocol.MsgRelayReady:
+			deliverRelayToken(msg)
+			continue
+		case protocol.MsgHistory:
+			printHistory(msg)
+			continue
+		case protocol.MsgRoomMembers:
+			deliverRoomMembers(msg)
+			continue
+		case protocol.MsgPing:
+			err = protocol.WriteMessage(conn, protocol.Message{Type: protocol.MsgPong})
 			if err != nil {
 				fmt.Println(utils.ErrorColor("❌ Error responding to heartbeat:"), err)
 				continue
 			}
-		case strings.HasPrefix(message, "🏠") || strings.Contains(message, "room"):
-			// Room-related messages
-			if strings.Contains(message, "created") || strings.Contains(message, "joined") || 
-			   strings.Contains(message, "left") || strings.Contains(message, "Selected") {
-				fmt.Println(utils.SuccessColor(message))
-			} else {
-				fmt.Println(utils.InfoColor(message))
-			}
-			continue
-		case message == "USERS:":
-			// Improved approach to accumulate the complete user list
+		case protocol.MsgUserList:
 			fmt.Println(utils.HeaderColor("\n👥 Online Users:"))
 			fmt.Println(utils.InfoColor("-------------------"))
 
-			// Read the complete user list with timeout
-			userList := ""
-			tempBuf := make([]byte, 1024)
-			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
-
-			for {
-				m, err := conn.Read(tempBuf)
-				if err != nil {
-					break // Break on error (likely timeout)
-				}
-				userList += string(tempBuf[:m])
-				if m < 1024 {
-					break // All data received
+			for _, user := range msg.Users {
+				roomStatus := "No room"
+				if user.RoomName != "" {
+					roomStatus = fmt.Sprintf("In room: %s", user.RoomName)
 				}
+				fmt.Println(utils.SuccessColor(" • "), utils.UserColor(fmt.Sprintf("%s [ID: %s] - %s", user.Username, user.UserId, roomStatus)))
 			}
 
-			// Reset the deadline
-			conn.SetReadDeadline(time.Time{})
-
-			// Process users
-			userCount := 0
-			for _, line := range strings.Split(userList, "\n") {
-				if strings.TrimSpace(line) != "" {
-					userCount++
-					fmt.Println(utils.SuccessColor(" • "), utils.UserColor(line))
-				}
-			}
-
-			if userCount == 0 {
+			if len(msg.Users) == 0 {
 				fmt.Println(utils.InfoColor(" No users currently online"))
 			}
 
 			fmt.Println(utils.InfoColor("-------------------"))
 			continue
-		case strings.HasPrefix(message, "/LOOK_REQUEST"):
-			args := strings.SplitN(message, " ", 3)
-			if len(args) != 3 {
-				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /LOOK_REQUEST <storageFilePath> <userId>"))
-				continue
-			}
-			storageFilePath := args[2]
-			userId := args[1]
-			fmt.Println(utils.InfoColor("🔍 Processing directory lookup request from"), utils.UserColor(userId))
-			HandleLookupResponse(conn, storageFilePath, userId)
+		case protocol.MsgLookupRequest:
+			fmt.Println(utils.InfoColor("🔍 Processing directory lookup request from"), utils.UserColor(msg.From))
+			HandleLookupResponse(conn, msg.From)
 			continue
-		case strings.HasPrefix(message, "/LOOK_RESPONSE"):
-			args := strings.SplitN(message, " ", 3)
-			if len(args) != 3 {
-				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /LOOK_RESPONSE <userId> <files>"))
-				continue
-			}
-			userId := args[1]
-			files := strings.Split(args[2], " ")
-
-			fmt.Println(utils.HeaderColor("\n📂 Directory Listing for User:"), utils.UserColor(userId))
+		case protocol.MsgLookupResponse:
+			fmt.Println(utils.HeaderColor("\n📂 Directory Listing for User:"), utils.UserColor(msg.From))
 			fmt.Println(utils.InfoColor("-------------------------------------------"))
 
-			for _, file := range files {
-				if strings.HasPrefix(file, "[FOLDER]") {
-					fmt.Println(utils.WarningColor("📁"), utils.InfoColor(file))
-				} else if strings.HasPrefix(file, "[FILE]") {
-					fmt.Println(utils.SuccessColor("📄"), utils.InfoColor(file))
-				} else if strings.HasPrefix(file, "===") {
-					fmt.Println(utils.HeaderColor(file))
-				} else {
-					fmt.Println(utils.InfoColor(file))
-				}
-			}
+			printDirListing(msg.Entries)
 
 			fmt.Println(utils.InfoColor("-------------------------------------------\n"))
 			continue
-		case strings.HasPrefix(message, "/DOWNLOAD_REQUEST"):
-			args := strings.SplitN(message, " ", 3)
-			if len(args) != 3 {
-				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /DOWNLOAD_REQUEST <userId> <filename>"))
-				continue
-			}
-			userId := args[1]
-			filePath := args[2]
-			fmt.Println(utils.InfoColor("📤 Download request from"), utils.UserColor(userId), utils.InfoColor("for"), utils.InfoColor(filePath))
-			HandleDownloadResponse(conn, userId, filePath)
+		case protocol.MsgDownloadRequest:
+			fmt.Println(utils.InfoColor("📤 Download request from"), utils.UserColor(msg.From), utils.InfoColor("for"), utils.InfoColor(msg.Path))
+			go HandleDownloadResponse(conn, msg.From, msg.Path)
 			continue
 		default:
-			if strings.Contains(message, "has joined the chat") {
-				fmt.Println(utils.WarningColor("👋 " + message))
-			} else if strings.Contains(message, "has rejoined the chat") {
-				fmt.Println(utils.WarningColor("🔄 " + message))
-			} else if strings.Contains(message, "is now offline") {
-				fmt.Println(utils.WarningColor("👋 " + message))
-			} else if strings.HasPrefix(message, "[") && strings.Contains(message, "]") {
-				// Room message format: [RoomName] Username: message
-				fmt.Println(utils.InfoColor(message))
-			} else {
-				fmt.Println(message)
-			}
+			printMessage(msg)
 		}
 	}
 }
 
+// printMessage shows chat lines and server notices
+func printMessage(msg protocol.Message) {
+	switch msg.Type {
+	case protocol.MsgChat:
+		// Messages held while we were offline say when they were sent
+		sent := ""
+		if msg.Time != "" {
+			sent = fmt.Sprintf("[%s] ", formatSentTime(msg.Time))
+		}
+		if msg.RoomName != "" {
+			// Room message format: [RoomName] Username: message
+			fmt.Println(utils.InfoColor(fmt.Sprintf("%s[%s] %s: %s", sent, msg.RoomName, msg.Username, msg.Text)))
+		} else {
+			fmt.Printf("%s%s: %s\n", sent, msg.Username, msg.Text)
+		}
+	case protocol.MsgDirect:
+		printDirect(msg)
+	case protocol.MsgReceipt:
+		printReceipt(msg)
+	case protocol.MsgNotice:
+		switch msg.Level {
+		case protocol.NoticeSuccess:
+			fmt.Println(utils.SuccessColor(msg.Text))
+		case protocol.NoticeWarning:
+			fmt.Println(utils.WarningColor(msg.Text))
+		case protocol.NoticeError:
+			fmt.Println(utils.ErrorColor(msg.Text))
+		default:
+			fmt.Println(utils.InfoColor(msg.Text))
+		}
+	case protocol.MsgError:
+		fmt.Println(utils.ErrorColor("❌ Server error:"), msg.Text)
+	}
+}
+
 func WriteLoop(conn net.Conn) {
-	reader := bufio.NewReader(os.Stdin)
 	for {
 		prompt := ">>> "
 		if currentRoom != "" {
 			prompt = fmt.Sprintf("[Room: %s] >>> ", currentRoom)
 		}
 		fmt.Print(utils.CommandColor(prompt))
-		message, _ := reader.ReadString('\n')
+		message, _ := stdin.ReadString('\n')
 		message = strings.TrimSpace(message)
 		switch {
 		case message == "exit":
 			fmt.Println(utils.InfoColor("👋 Goodbye!"))
+			protocol.WriteMessage(conn, protocol.Message{Type: protocol.MsgExit})
 			conn.Close()
 			return
 		case message == "/help":
@@ -273,11 +325,11 @@ func WriteLoop(conn net.Conn) {
 		case strings.HasPrefix(message, "/createroom"):
 			args := strings.Fields(message)
 			if len(args) < 3 {
-				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /createroom <roomName> <userId1> [userId2] ..."))
+				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /createroom <roomName> <user1> [user2] ..."))
 				continue
 			}
 			fmt.Println(utils.InfoColor("🏠 Creating room..."))
-			_, err := conn.Write([]byte(message))
+			err := protocol.WriteMessage(conn, protocol.Message{Type: protocol.MsgCreateRoom, RoomName: args[1], Participants: args[2:]})
 			if err != nil {
 				fmt.Println(utils.ErrorColor("❌ Error creating room:"), err)
 				continue
@@ -285,12 +337,16 @@ func WriteLoop(conn net.Conn) {
 			continue
 		case strings.HasPrefix(message, "/joinroom"):
 			args := strings.Fields(message)
-			if len(args) != 2 {
-				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /joinroom <roomId>"))
+			if len(args) < 2 || len(args) > 3 {
+				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /joinroom <roomId> [password]"))
 				continue
 			}
+			join := protocol.Message{Type: protocol.MsgJoinRoom, RoomId: args[1]}
+			if len(args) == 3 {
+				join.Password = args[2]
+			}
 			fmt.Println(utils.InfoColor("🏠 Joining room..."))
-			_, err := conn.Write([]byte(message))
+			err := protocol.WriteMessage(conn, join)
 			if err != nil {
 				fmt.Println(utils.ErrorColor("❌ Error joining room:"), err)
 				continue
@@ -303,7 +359,7 @@ func WriteLoop(conn net.Conn) {
 				continue
 			}
 			fmt.Println(utils.InfoColor("🏠 Leaving room..."))
-			_, err := conn.Write([]byte(message))
+			err := protocol.WriteMessage(conn, protocol.Message{Type: protocol.MsgLeaveRoom, RoomId: args[1]})
 			if err != nil {
 				fmt.Println(utils.ErrorColor("❌ Error leaving room:"), err)
 				continue
@@ -317,7 +373,7 @@ func WriteLoop(conn net.Conn) {
 			}
 			roomId := args[1]
 			fmt.Println(utils.InfoColor("🏠 Selecting room..."))
-			_, err := conn.Write([]byte(message))
+			err := protocol.WriteMessage(conn, protocol.Message{Type: protocol.MsgSelectRoom, RoomId: roomId})
 			if err != nil {
 				fmt.Println(utils.ErrorColor("❌ Error selecting room:"), err)
 				continue
@@ -327,7 +383,7 @@ func WriteLoop(conn net.Conn) {
 			continue
 		case strings.HasPrefix(message, "/listrooms"):
 			fmt.Println(utils.InfoColor("🏠 Fetching room list..."))
-			_, err := conn.Write([]byte(message))
+			err := protocol.WriteMessage(conn, protocol.Message{Type: protocol.MsgListRooms})
 			if err != nil {
 				fmt.Println(utils.ErrorColor("❌ Error listing rooms:"), err)
 				continue
@@ -340,38 +396,145 @@ func WriteLoop(conn net.Conn) {
 				continue
 			}
 			fmt.Println(utils.InfoColor("🏠 Fetching room information..."))
-			_, err := conn.Write([]byte(message))
+			err := protocol.WriteMessage(conn, protocol.Message{Type: protocol.MsgRoomInfo, RoomId: args[1]})
 			if err != nil {
 				fmt.Println(utils.ErrorColor("❌ Error getting room info:"), err)
 				continue
 			}
 			continue
+		case moderationMessages[strings.SplitN(message, " ", 2)[0]] != 0:
+			args := strings.Fields(message)
+			if len(args) != 3 {
+				fmt.Println(utils.ErrorColor(fmt.Sprintf("❌ Invalid arguments. Use: %s <roomId> <user>", args[0])))
+				continue
+			}
+			err := protocol.WriteMessage(conn, protocol.Message{Type: moderationMessages[args[0]], RoomId: args[1], Target: args[2]})
+			if err != nil {
+				fmt.Println(utils.ErrorColor("❌ Error sending command:"), err)
+			}
+			continue
+		case strings.HasPrefix(message, "/role"):
+			args := strings.Fields(message)
+			if len(args) != 4 || (args[3] != "moderator" && args[3] != "member") {
+				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /role <roomId> <user> <moderator|member>"))
+				continue
+			}
+			err := protocol.WriteMessage(conn, protocol.Message{Type: protocol.MsgSetRole, RoomId: args[1], Target: args[2], Role: args[3]})
+			if err != nil {
+				fmt.Println(utils.ErrorColor("❌ Error changing role:"), err)
+			}
+			continue
+		case strings.HasPrefix(message, "/roomaccess"):
+			args := strings.Fields(message)
+			if len(args) < 3 || (args[2] == "password") != (len(args) == 4) || len(args) > 4 {
+				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /roomaccess <roomId> <open|invite|password> [password]"))
+				continue
+			}
+			access := protocol.Message{Type: protocol.MsgRoomAccess, RoomId: args[1], Access: args[2]}
+			if len(args) == 4 {
+				access.Password = args[3]
+			}
+			if err := protocol.WriteMessage(conn, access); err != nil {
+				fmt.Println(utils.ErrorColor("❌ Error changing room access:"), err)
+			}
+			continue
+		case strings.HasPrefix(message, "/roompolicy"):
+			args := strings.SplitN(message, " ", 4)
+			if len(args) != 4 || strings.TrimSpace(args[3]) == "" {
+				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /roompolicy <roomId> <send|browse|maxsize|allow|deny> <value>"))
+				continue
+			}
+			err := protocol.WriteMessage(conn, protocol.Message{Type: protocol.MsgRoomPolicy, RoomId: args[1], Setting: strings.ToLower(args[2]), Value: args[3]})
+			if err != nil {
+				fmt.Println(utils.ErrorColor("❌ Error changing room policy:"), err)
+			}
+			continue
+		case strings.HasPrefix(message, "/history"):
+			args := strings.Fields(message)
+			if len(args) < 2 || len(args) > 3 {
+				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /history <roomId> [n]"))
+				continue
+			}
+			limit := 0
+			if len(args) == 3 {
+				n, err := strconv.Atoi(args[2])
+				if err != nil || n <= 0 {
+					fmt.Println(utils.ErrorColor("❌ The number of messages must be a positive number"))
+					continue
+				}
+				limit = n
+			}
+			if err := HandleHistoryRequest(conn, args[1], limit); err != nil {
+				fmt.Println(utils.ErrorColor("❌ Error requesting history:"), err)
+			}
+			continue
+		case strings.HasPrefix(message, "/msg"):
+			args := strings.SplitN(message, " ", 3)
+			if len(args) != 3 || strings.TrimSpace(args[2]) == "" {
+				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /msg <user> <text>"))
+				continue
+			}
+			if err := SendDirectMessage(conn, args[1], args[2]); err != nil {
+				fmt.Println(utils.ErrorColor("❌ Error sending direct message:"), err)
+			}
+			continue
 		case strings.HasPrefix(message, "/sendfile"):
 			args := strings.SplitN(message, " ", 3)
 			if len(args) != 3 {
-				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /sendfile <userId> <filename>"))
+				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /sendfile <user> <filename>"))
 				continue
 			}
 			recipientId := args[1]
 			filePath := args[2]
 			fmt.Println(utils.InfoColor("📤 Sending file to"), utils.UserColor(recipientId))
-			HandleSendFile(conn, recipientId, filePath)
+			go HandleSendFile(conn, recipientId, filePath)
 			continue
 		case strings.HasPrefix(message, "/sendfolder"):
 			args := strings.SplitN(message, " ", 3)
 			if len(args) != 3 {
-				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /sendfolder <userId> <folderPath>"))
+				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /sendfolder <user> <folderPath>"))
 				continue
 			}
 			recipientId := args[1]
 			folderPath := args[2]
 			fmt.Println(utils.InfoColor("📤 Sending folder to"), utils.UserColor(recipientId))
-			HandleSendFolder(conn, recipientId, folderPath)
+			go HandleSendFolder(conn, recipientId, folderPath)
+			continue
+		case strings.HasPrefix(message, "/syncfolder"):
+			args := strings.SplitN(message, " ", 3)
+			if len(args) != 3 {
+				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /syncfolder <user> [--delete] <folderPath>"))
+				continue
+			}
+			recipientId := args[1]
+			folderPath := args[2]
+			mirror := strings.HasPrefix(folderPath, "--delete ")
+			if mirror {
+				folderPath = strings.TrimSpace(strings.TrimPrefix(folderPath, "--delete "))
+			}
+			fmt.Println(utils.InfoColor("🔄 Syncing folder to"), utils.UserColor(recipientId))
+			go HandleSyncFolder(conn, recipientId, folderPath, mirror)
+			continue
+		case message == "/sync" || strings.HasPrefix(message, "/sync "):
+			args := strings.SplitN(message, " ", 3)
+			if len(args) != 3 || strings.TrimSpace(args[2]) == "" {
+				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /sync <roomId> <localDir>"))
+				continue
+			}
+			HandleStartSync(conn, args[1], strings.TrimSpace(args[2]))
+			continue
+		case strings.HasPrefix(message, "/unsync"):
+			args := strings.Fields(message)
+			if len(args) != 2 {
+				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /unsync <roomId>"))
+				continue
+			}
+			HandleStopSync(args[1])
 			continue
 		case strings.HasPrefix(message, "/lookup"):
 			args := strings.SplitN(message, " ", 2)
 			if len(args) != 2 {
-				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /lookup <userId>"))
+				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /lookup <user>"))
 				continue
 			}
 			recipientId := args[1]
@@ -380,7 +543,7 @@ func WriteLoop(conn net.Conn) {
 			continue
 		case strings.HasPrefix(message, "/status"):
 			fmt.Println(utils.InfoColor("👥 Fetching online users..."))
-			_, err := conn.Write([]byte(message))
+			err := protocol.WriteMessage(conn, protocol.Message{Type: protocol.MsgStatus})
 			if err != nil {
 				fmt.Println(utils.ErrorColor("❌ Error checking status:"), err)
 				continue
@@ -389,7 +552,7 @@ func WriteLoop(conn net.Conn) {
 		case strings.HasPrefix(message, "/download"):
 			args := strings.SplitN(message, " ", 3)
 			if len(args) != 3 {
-				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /download <userId> <filename>"))
+				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /download <user> <filename>"))
 				continue
 			}
 			recipientId := args[1]
@@ -397,6 +560,49 @@ func WriteLoop(conn net.Conn) {
 			fmt.Println(utils.InfoColor("📥 Requesting download from"), utils.UserColor(recipientId))
 			HandleDownloadRequest(conn, recipientId, filePath)
 			continue
+		case strings.HasPrefix(message, "/accept"):
+			args := strings.Fields(message)
+			if len(args) < 2 || len(args) > 3 {
+				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /accept <transferId> [newName]"))
+				continue
+			}
+			newName := ""
+			if len(args) == 3 {
+				newName = args[2]
+			}
+			HandleAcceptOffer(conn, args[1], newName)
+			continue
+		case strings.HasPrefix(message, "/decline"):
+			args := strings.SplitN(message, " ", 3)
+			if len(args) < 2 {
+				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /decline <transferId> [reason]"))
+				continue
+			}
+			reason := ""
+			if len(args) == 3 {
+				reason = args[2]
+			}
+			HandleDeclineOffer(conn, args[1], reason)
+			continue
+		case strings.HasPrefix(message, "/offers"):
+			HandleListOffers()
+			continue
+		case strings.HasPrefix(message, "/trust"):
+			args := strings.Fields(message)
+			if len(args) != 2 {
+				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /trust <user>"))
+				continue
+			}
+			HandleTrustUser(args[1], true)
+			continue
+		case strings.HasPrefix(message, "/untrust"):
+			args := strings.Fields(message)
+			if len(args) != 2 {
+				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /untrust <user>"))
+				continue
+			}
+			HandleTrustUser(args[1], false)
+			continue
 		case strings.HasPrefix(message, "/transfers"):
 			HandleListTransfers()
 			continue
@@ -416,11 +622,11 @@ func WriteLoop(conn net.Conn) {
 				continue
 			}
 			transferID := args[1]
-			HandleResumeTransfer(transferID)
+			HandleResumeTransfer(conn, transferID)
 			continue
 		default:
 			if message != "" {
-				_, err := conn.Write([]byte(message))
+				err := protocol.WriteMessage(conn, protocol.Message{Type: protocol.MsgChat, Text: message})
 				if err != nil {
 					fmt.Println(utils.ErrorColor("❌ Error sending message:"), err)
 					return
@@ -0,0 +1,80 @@
+package connection
+
+import (
+	"drizlink/protocol"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// TransferReadyTimeout bounds how long a sender waits for its request to be
+// accepted. It outlasts the server's offer timeout so the server's answer wins.
+const TransferReadyTimeout = 3 * time.Minute
+
+var (
+	// serverAddress is where data channels are opened; set by Connect
+	serverAddress string
+
+	// pendingSends hands the server's go-ahead or rejection to the goroutine
+	// waiting to send, keyed by transfer ID
+	pendingSends      = make(map[string]chan protocol.Message)
+	pendingSendsMutex sync.Mutex
+)
+
+// awaitTransferReply registers interest in the server's answer to a transfer
+// request. It must be called before the request is sent.
+func awaitTransferReply(transferID string) chan protocol.Message {
+	replies := make(chan protocol.Message, 1)
+	pendingSendsMutex.Lock()
+	pendingSends[transferID] = replies
+	pendingSendsMutex.Unlock()
+	return replies
+}
+
+// deliverTransferReply routes a MsgTransferReady or MsgTransferRejected to its waiting sender
+func deliverTransferReply(msg protocol.Message) {
+	if msg.Transfer == nil {
+		return
+	}
+	pendingSendsMutex.Lock()
+	replies, exists := pendingSends[msg.Transfer.Id]
+	delete(pendingSends, msg.Transfer.Id)
+	pendingSendsMutex.Unlock()
+
+	if exists {
+		replies <- msg
+	}
+}
+
+// waitForTransferReady blocks until the server tells us how to reach the
+// recipient for transferID
+func waitForTransferReady(transferID string, replies chan protocol.Message) (protocol.Message, error) {
+	select {
+	case reply := <-replies:
+		if reply.Type == protocol.MsgTransferRejected {
+			return protocol.Message{}, errors.New(reply.Text)
+		}
+		return reply, nil
+	case <-time.After(TransferReadyTimeout):
+		pendingSendsMutex.Lock()
+		delete(pendingSends, transferID)
+		pendingSendsMutex.Unlock()
+		return protocol.Message{}, fmt.Errorf("server did not accept transfer %s in time", transferID)
+	}
+}
+
+// openDataChannel dials a fresh connection to the server and attaches it to a
+// transfer, keeping payload bytes off the control connection
+func openDataChannel(token string) (net.Conn, error) {
+	conn, err := dialServer(serverAddress)
+	if err != nil {
+		return nil, err
+	}
+	if err := protocol.AttachDataChannel(conn, token); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
@@ -0,0 +1,65 @@
+package connection
+
+import (
+	"drizlink/helper"
+	"drizlink/protocol"
+	"drizlink/utils"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// maxPreviewLength is how much of a direct message a receipt repeats
+const maxPreviewLength = 40
+
+var (
+	// sentDirect remembers the start of each direct message sent this
+	// session, so receipts can say which message they are about
+	sentDirect  = make(map[string]string)
+	directMutex sync.Mutex
+)
+
+// SendDirectMessage sends text privately to target, a user ID or username
+func SendDirectMessage(conn net.Conn, target, text string) error {
+	messageId := helper.GenerateMessageId()
+	preview := []rune(text)
+	if len(preview) > maxPreviewLength {
+		preview = append(preview[:maxPreviewLength], '…')
+	}
+
+	directMutex.Lock()
+	sentDirect[messageId] = string(preview)
+	directMutex.Unlock()
+
+	return protocol.WriteMessage(conn, protocol.Message{Type: protocol.MsgDirect, Target: target, Text: text, MessageId: messageId})
+}
+
+// printDirect shows a direct message sent to us
+func printDirect(msg protocol.Message) {
+	sent := ""
+	if msg.Time != "" {
+		sent = fmt.Sprintf("[%s] ", formatSentTime(msg.Time))
+	}
+	fmt.Println(utils.WarningColor(fmt.Sprintf("%s💌 [DM] %s: %s", sent, msg.Username, msg.Text)))
+}
+
+// printReceipt shows how far one of our direct messages got
+func printReceipt(msg protocol.Message) {
+	directMutex.Lock()
+	preview, known := sentDirect[msg.MessageId]
+	if msg.Status == protocol.ReceiptDelivered {
+		delete(sentDirect, msg.MessageId)
+	}
+	directMutex.Unlock()
+
+	switch msg.Status {
+	case protocol.ReceiptQueued:
+		fmt.Println(utils.InfoColor(fmt.Sprintf("📬 %s is offline; your message will be delivered when they log in", msg.Username)))
+	case protocol.ReceiptDelivered:
+		if known {
+			fmt.Println(utils.SuccessColor(fmt.Sprintf("✓ Delivered to %s: \"%s\"", msg.Username, preview)))
+		} else {
+			fmt.Println(utils.SuccessColor(fmt.Sprintf("✓ %s received a message you sent earlier", msg.Username)))
+		}
+	}
+}
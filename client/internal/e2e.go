@@ -0,0 +1,55 @@
+package connection
+
+import (
+	"drizlink/helper"
+	"drizlink/protocol"
+	"drizlink/utils"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// sessionKeys is this run's X25519 key pair. Payloads are sealed with keys
+// derived from it and a key pair of each transfer's own, so neither the relay
+// nor the server can read them.
+var sessionKeys *helper.KeyPair
+
+// AnnounceEncryptionKey creates this session's key pair and gives the public
+// half to the server, which passes it to peers we exchange transfers with
+func AnnounceEncryptionKey(conn net.Conn) error {
+	keys, err := helper.GenerateKeyPair()
+	if err != nil {
+		return err
+	}
+	sessionKeys = keys
+
+	if err := protocol.WriteMessage(conn, protocol.Message{Type: protocol.MsgKeyAnnounce, PublicKey: keys.PublicKey()}); err != nil {
+		return err
+	}
+	fmt.Println(utils.InfoColor("🔑 Your encryption key fingerprint:"), utils.CommandColor(helper.KeyFingerprint(keys.PublicKey())))
+	return nil
+}
+
+// sendingCipher derives the key for a payload we send to the recipient that
+// answered ready. transferKeys is the key pair we made for this transfer and
+// offered it with; it is not needed once the key is derived.
+func sendingCipher(ready protocol.Message, transferKeys *helper.KeyPair) (*helper.PayloadCipher, error) {
+	if sessionKeys == nil {
+		return nil, errors.New("no encryption key for this session")
+	}
+	if ready.PublicKey == "" || ready.Transfer == nil || ready.Transfer.TransferKey == "" {
+		return nil, errors.New("recipient has no encryption key")
+	}
+	return sessionKeys.PayloadCipher(transferKeys, ready.PublicKey, ready.Transfer.TransferKey, ready.PeerToken, true)
+}
+
+// receivingCipher derives the key for a payload the sender of incoming sends to us
+func receivingCipher(incoming *incomingTransfer) (*helper.PayloadCipher, error) {
+	if sessionKeys == nil {
+		return nil, errors.New("no encryption key for this session")
+	}
+	if incoming.senderKey == "" || incoming.senderTransferKey == "" {
+		return nil, errors.New("sender has no encryption key")
+	}
+	return sessionKeys.PayloadCipher(incoming.transferKeys, incoming.senderKey, incoming.senderTransferKey, incoming.peerToken, false)
+}
@@ -2,6 +2,7 @@ package connection
 
 import (
 	"drizlink/helper"
+	"drizlink/protocol"
 	"drizlink/utils"
 	"fmt"
 	"io"
@@ -14,6 +15,13 @@ import (
 )
 
 func HandleSendFile(conn net.Conn, recipientId, filePath string) {
+	sendFile(conn, recipientId, filePath, GenerateTransferID())
+}
+
+// sendFile offers filePath to recipientId under transferID. Resending an
+// interrupted transfer reuses its ID, and the receiver's journal decides where
+// the bytes continue from.
+func sendFile(conn net.Conn, recipientId, filePath, transferID string) {
 	file, err := os.Open(filePath)
 	if err != nil {
 		fmt.Println(utils.ErrorColor("❌ Error opening file:"), err)
@@ -30,67 +38,119 @@ func HandleSendFile(conn net.Conn, recipientId, filePath string) {
 	fileSize := fileInfo.Size()
 	fileName := fileInfo.Name()
 
-	// Calculate checksum of file
-	checksum, err := helper.CalculateFileChecksum(filePath)
+	// Resumed transfers are matched by fingerprint; the checksum itself is
+	// computed while sending, so the file is read only once
+	algorithm := checksumAlgorithm
+	fingerprint, err := helper.Fingerprint(filePath)
 	if err != nil {
-		fmt.Println(utils.ErrorColor("❌ Error calculating checksum:"), err)
+		fmt.Println(utils.ErrorColor("❌ Error reading file info:"), err)
 		return
 	}
 
-	transferID := GenerateTransferID()
 	fmt.Printf("%s Sending file '%s' to user %s (Transfer ID: %s)...\n",
 		utils.InfoColor("📤"),
 		utils.InfoColor(fileName),
 		utils.UserColor(recipientId),
 		utils.CommandColor(transferID))
 
+	// A key pair for this transfer alone, so its key dies with it
+	transferKeys, err := helper.GenerateKeyPair()
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error creating transfer key:"), err)
+		return
+	}
+
+	// Register for the server's answer before asking, so it cannot be missed
+	replies := awaitTransferReply(transferID)
+
 	// Send file request with file size, checksum, and transfer ID
-	_, err = conn.Write([]byte(fmt.Sprintf("/FILE_REQUEST %s %s %d %s %s\n",
-		recipientId, fileName, fileSize, checksum, transferID)))
+	err = protocol.WriteMessage(conn, protocol.Message{
+		Type:   protocol.MsgFileRequest,
+		Target: recipientId,
+		Transfer: &protocol.TransferInfo{
+			Id:                transferID,
+			Name:              fileName,
+			Size:              fileSize,
+			ChecksumAlgorithm: algorithm,
+			Fingerprint:       fingerprint,
+			TransferKey:       transferKeys.PublicKey(),
+		},
+	})
 	if err != nil {
 		fmt.Println(utils.ErrorColor("❌ Error sending file request:"), err)
 		return
 	}
+	fmt.Println(utils.InfoColor("⏳ Waiting for the recipient to accept..."))
+
+	ready, err := waitForTransferReady(transferID, replies)
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ File transfer not started:"), err)
+		return
+	}
+
+	// Only the recipient can open what we send, even when the server relays it
+	sealer, err := sendingCipher(ready, transferKeys)
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error setting up encryption:"), err)
+		return
+	}
+
+	// Payload goes over its own connection so chat and heartbeats keep flowing
+	dataConn, err := dialTransfer(ready)
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error opening data channel:"), err)
+		return
+	}
+	defer dataConn.Close()
+
+	// The receiver tells us how much it already has from an earlier attempt
+	offset, err := readResumeOffset(dataConn, fileSize)
+	if err == nil {
+		_, err = file.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error starting file transfer:"), err)
+		return
+	}
+	if offset > 0 {
+		fmt.Println(utils.InfoColor("⏩ Resuming from"), utils.InfoColor(helper.FormatSize(offset)))
+	}
 
 	// Create progress bar with transfer ID
 	bar := utils.CreateProgressBar(fileSize, "📤 Sending file")
 	bar.SetTransferId(transferID)
+	bar.Bar.Set64(offset)
 
 	transfer := &Transfer{
 		ID:            transferID,
 		Type:          FileTransfer,
 		Name:          fileName,
 		Size:          fileSize,
-		BytesComplete: 0,
+		BytesComplete: offset,
 		Status:        Active,
 		Direction:     "send",
 		Recipient:     recipientId,
 		Path:          filePath,
-		Checksum:      checksum,
 		StartTime:     time.Now(),
 		File:          file,
-		Connection:    conn,
+		Connection:    dataConn,
 		ProgressBar:   bar,
 	}
 
 	RegisterTransfer(transfer)
 
 	reader := NewCheckpointedReader(file, transfer, 32768) // 32KB chunks
+	reader.BytesRead = offset
 
-	n, err := io.CopyN(conn, io.TeeReader(reader, bar), fileSize)
+	// Every chunk carries its own SHA-256, so only corrupted chunks are resent,
+	// and the file checksum is computed from the same read
+	checksum, err := sendChunks(dataConn, io.TeeReader(reader, bar), file, offset, fileSize, algorithm, sealer)
 
 	if err != nil {
-		UpdateTransferStatus(transferID, Failed)
+		// Keep the transfer around so /resume can pick it up again
+		UpdateTransferStatus(transferID, Interrupted)
 		fmt.Println(utils.ErrorColor("\n❌ Error sending file:"), err)
-		RemoveTransfer(transferID)
-		return
-	}
-
-	if n != fileSize {
-		UpdateTransferStatus(transferID, Failed)
-		fmt.Println(utils.ErrorColor("\n❌ Error: sent"), utils.ErrorColor(n),
-			utils.ErrorColor("bytes, expected"), utils.ErrorColor(fileSize), utils.ErrorColor("bytes"))
-		RemoveTransfer(transferID)
+		fmt.Println(utils.InfoColor("💾 Use"), utils.CommandColor("/resume "+transferID), utils.InfoColor("to continue where it stopped"))
 		return
 	}
 
@@ -100,29 +160,18 @@ func HandleSendFile(conn net.Conn, recipientId, filePath string) {
 	fmt.Printf("%s File '%s' sent successfully!\n",
 		utils.SuccessColor("\n✅"),
 		utils.SuccessColor(fileName))
-	fmt.Println(utils.InfoColor("  MD5 Checksum:"), utils.InfoColor(checksum))
+	fmt.Println(utils.InfoColor("  "+strings.ToUpper(algorithm)+" Checksum:"), utils.InfoColor(checksum))
 
 	// Clean up the transfer
 	RemoveTransfer(transferID)
 }
 
-func HandleFileTransfer(conn net.Conn, recipientId, fileName string, fileSize int64, storeFilePath string) {
-	// Get checksum and transfer ID from the split content
-	parts := strings.SplitN(fileName, "|", 3)
-	checksum := ""
-	transferID := ""
-
-	if len(parts) >= 2 {
-		fileName = parts[0]
-		checksum = parts[1]
-		fmt.Println(utils.InfoColor("📋 Original checksum:"), utils.InfoColor(checksum))
-
-		if len(parts) >= 3 {
-			transferID = parts[2]
-		} else {
-			transferID = GenerateTransferID()
-		}
-	} else {
+func HandleFileTransfer(senderId string, info protocol.TransferInfo, storeFilePath string, incoming *incomingTransfer) {
+	// Only the base name is used so a sender cannot pick where the file lands
+	fileName := filepath.Base(info.Name)
+	fileSize := info.Size
+	transferID := info.Id
+	if transferID == "" {
 		transferID = GenerateTransferID()
 	}
 
@@ -132,74 +181,106 @@ func HandleFileTransfer(conn net.Conn, recipientId, fileName string, fileSize in
 		utils.InfoColor(fmt.Sprintf("%d bytes", fileSize)),
 		utils.CommandColor(transferID))
 
-	filePath := filepath.Join(storeFilePath, fileName)
-	file, err := os.Create(filePath)
+	dataConn, err := incoming.accept()
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error opening data channel:"), err)
+		return
+	}
+	defer dataConn.Close()
+
+	// Payload is sealed by the sender; without the key nothing can be verified
+	opener, err := receivingCipher(incoming)
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error setting up encryption:"), err)
+		return
+	}
+
+	// Bytes land in a journaled partial file until the transfer is complete
+	journal, file, err := openPartial(storeFilePath, info)
 	if err != nil {
 		fmt.Println(utils.ErrorColor("❌ Error creating file:"), err)
 		return
 	}
-	defer file.Close()
+	offset := journal.Offset
+	partial := newJournalWriter(file, journal)
+
+	if err := sendResumeOffset(dataConn, transferID, offset); err != nil {
+		partial.Close()
+		fmt.Println(utils.ErrorColor("❌ Error starting file transfer:"), err)
+		return
+	}
+	if offset > 0 {
+		fmt.Println(utils.InfoColor("⏩ Resuming from"), utils.InfoColor(helper.FormatSize(offset)))
+	}
 
 	// Create progress bar with transfer ID
 	bar := utils.CreateProgressBar(fileSize, "📥 Receiving file")
 	bar.SetTransferId(transferID)
+	bar.Bar.Set64(offset)
 
+	// The final name is only picked once the file is complete
+	filePath := filepath.Join(storeFilePath, fileName)
 	transfer := &Transfer{
 		ID:            transferID,
 		Type:          FileTransfer,
 		Name:          fileName,
 		Size:          fileSize,
-		BytesComplete: 0,
+		BytesComplete: offset,
 		Status:        Active,
 		Direction:     "receive",
-		Recipient:     recipientId,
+		Recipient:     senderId,
 		Path:          filePath,
-		Checksum:      checksum,
 		StartTime:     time.Now(),
 		File:          file,
-		Connection:    conn,
+		Connection:    dataConn,
 		ProgressBar:   bar,
 	}
 
 	RegisterTransfer(transfer)
 
-	writer := NewCheckpointedWriter(file, transfer, 32768) // 32KB chunks
+	writer := NewCheckpointedWriter(partial, transfer, 32768) // 32KB chunks
+	writer.BytesWritten = offset
 
-	// Write to file and update progress bar simultaneously
-	n, err := io.CopyN(writer, io.TeeReader(conn, bar), fileSize)
+	// Each chunk is verified as it arrives; bad ones are requested again
+	checksum, receivedChecksum, err := receiveChunks(dataConn, writer, partial, offset, fileSize, bar, info.ChecksumAlgorithm, opener)
+	if closeErr := partial.Close(); err == nil {
+		err = closeErr
+	}
 
 	if err != nil {
 		UpdateTransferStatus(transferID, Failed)
 		fmt.Println(utils.ErrorColor("\n❌ Error receiving file:"), err)
+		fmt.Println(utils.InfoColor("💾 Kept"), utils.InfoColor(helper.FormatSize(journal.Offset)), utils.InfoColor("so the sender can resume"))
 		RemoveTransfer(transferID)
 		return
 	}
 
-	if n != fileSize {
-		UpdateTransferStatus(transferID, Failed)
-		fmt.Println(utils.ErrorColor("\n❌ Error: received"), utils.ErrorColor(n),
-			utils.ErrorColor("bytes, expected"), utils.ErrorColor(fileSize), utils.ErrorColor("bytes"))
-		RemoveTransfer(transferID)
-		return
-	}
-
-	// Verify checksum if provided
+	// The sender's checksum arrives as a trailer and ours was hashed on the way in
 	if checksum != "" {
-		file.Close() // Close file before calculating checksum
-		receivedChecksum, err := helper.CalculateFileChecksum(filePath)
-		if err != nil {
-			fmt.Println(utils.ErrorColor("\n❌ Error calculating checksum:"), err)
-		} else {
-			fmt.Println(utils.InfoColor("\n📋 Calculated checksum:"), utils.InfoColor(receivedChecksum))
+		fmt.Println(utils.InfoColor("\n📋 Original checksum:"), utils.InfoColor(checksum))
+		fmt.Println(utils.InfoColor("📋 Calculated checksum:"), utils.InfoColor(receivedChecksum))
 
-			if helper.VerifyChecksum(checksum, receivedChecksum) {
-				fmt.Println(utils.SuccessColor("✅ Checksum verification successful! File integrity confirmed."))
-			} else {
-				fmt.Println(utils.ErrorColor("❌ Checksum verification failed! File may be corrupted."))
-			}
+		if helper.VerifyChecksum(checksum, receivedChecksum) {
+			fmt.Println(utils.SuccessColor("✅ Checksum verification successful! File integrity confirmed."))
+		} else {
+			// The data stays in its partial file rather than passing for a good copy
+			UpdateTransferStatus(transferID, Failed)
+			fmt.Println(utils.ErrorColor("❌ Checksum verification failed! File may be corrupted."))
+			fmt.Println(utils.InfoColor("💾 Kept the received data in"), utils.InfoColor(journal.partialPath))
+			RemoveTransfer(transferID)
+			return
 		}
 	}
 
+	filePath, err = claimPath(journal.partialPath, filePath)
+	if err != nil {
+		UpdateTransferStatus(transferID, Failed)
+		fmt.Println(utils.ErrorColor("❌ Error saving file:"), err)
+		RemoveTransfer(transferID)
+		return
+	}
+	journal.discard()
+
 	// Mark transfer as completed
 	UpdateTransferStatus(transferID, Completed)
 
@@ -213,7 +294,7 @@ func HandleFileTransfer(conn net.Conn, recipientId, fileName string, fileSize in
 }
 
 func HandleDownloadRequest(conn net.Conn, recipientId, filePath string) {
-	_, err := conn.Write([]byte(fmt.Sprintf("/DOWNLOAD_REQUEST %s %s\n", recipientId, filePath)))
+	err := protocol.WriteMessage(conn, protocol.Message{Type: protocol.MsgDownloadRequest, Target: recipientId, Path: filePath})
 	if err != nil {
 		fmt.Println("Error sending file request:", err)
 		return
@@ -221,11 +302,12 @@ func HandleDownloadRequest(conn net.Conn, recipientId, filePath string) {
 	fmt.Println("File download request sent successfully")
 }
 
+// HandleDownloadResponse serves a download of filePath, relative to the
+// shared folder, to userId
 func HandleDownloadResponse(conn net.Conn, userId, filePath string) {
-	cleanPath := filepath.Clean(strings.TrimSpace(filePath))
-	absPath, err := filepath.Abs(cleanPath)
+	absPath, err := resolveSharePath(filePath)
 	if err != nil {
-		fmt.Printf("Error resolving absolute path: %v\n", err)
+		fmt.Println(utils.ErrorColor("🚫 Refused download of"), filePath, utils.ErrorColor("("+err.Error()+")"))
 		return
 	}
 
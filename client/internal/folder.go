@@ -2,138 +2,183 @@ package connection
 
 import (
 	"drizlink/helper"
+	"drizlink/protocol"
 	"drizlink/utils"
 	"fmt"
 	"io"
 	"net"
-	"os"
 	"path/filepath"
 	"strings"
 	"time"
 )
 
 func HandleSendFolder(conn net.Conn, recipientId, folderPath string) {
+	sendFolder(conn, recipientId, folderPath, GenerateTransferID(), false, false)
+}
+
+// sendFolder offers folderPath under transferID and streams its files straight
+// from disk, described by a manifest sent ahead of them. The stream of an
+// unchanged folder is identical on every attempt, so the receiver can resume it.
+// With sync the recipient answers the manifest with the files it needs and
+// only those are sent; see HandleSyncFolder.
+func sendFolder(conn net.Conn, recipientId, folderPath, transferID string, sync, mirror bool) {
 	fmt.Println(utils.InfoColor("📦 Preparing folder for transfer..."))
 
-	//Create a temporary zip file
-	tempZipPath := folderPath + ".zip"
-	err := helper.CreateZipFromFolder(folderPath, tempZipPath)
+	// Resumed transfers are matched by fingerprint; the checksum itself is
+	// computed while sending, so every file is read only once. A sync also
+	// hashes every file, which is only redone for files that changed.
+	manifest, fingerprint, err := buildManifest(folderPath, sync)
 	if err != nil {
-		fmt.Println(utils.ErrorColor("❌ Error creating zip file:"), err)
+		fmt.Println(utils.ErrorColor("❌ Error reading folder:"), err)
 		return
 	}
-	defer os.Remove(tempZipPath) //clean up temporary zip file
 
-	//open zip file
-	zipFile, err := os.Open(tempZipPath)
+	folderSize := manifestSize(manifest)
+	folderName := filepath.Base(folderPath)
+	algorithm := checksumAlgorithm
+
+	fmt.Printf("%s Sending folder '%s' (%s, %s) to user %s (Transfer ID: %s)...\n",
+		utils.InfoColor("📤"),
+		utils.InfoColor(folderName),
+		utils.InfoColor(describeManifest(manifest)),
+		utils.InfoColor(helper.FormatSize(folderSize)),
+		utils.UserColor(recipientId),
+		utils.CommandColor(transferID))
+
+	// A key pair for this transfer alone, so its key dies with it
+	transferKeys, err := helper.GenerateKeyPair()
 	if err != nil {
-		fmt.Println(utils.ErrorColor("❌ Error opening temp zip file:"), err)
+		fmt.Println(utils.ErrorColor("❌ Error creating transfer key:"), err)
 		return
 	}
-	defer zipFile.Close()
 
-	//Get zip file info
-	zipInfo, err := zipFile.Stat()
+	// Register for the server's answer before asking, so it cannot be missed
+	replies := awaitTransferReply(transferID)
+
+	// Send folder request with the folder's real size, checksum and transfer ID
+	err = protocol.WriteMessage(conn, protocol.Message{
+		Type:   protocol.MsgFolderRequest,
+		Target: recipientId,
+		Transfer: &protocol.TransferInfo{
+			Id:                transferID,
+			Name:              folderName,
+			Size:              folderSize,
+			ChecksumAlgorithm: algorithm,
+			Fingerprint:       fingerprint,
+			TransferKey:       transferKeys.PublicKey(),
+			Sync:              sync,
+			Mirror:            sync && mirror,
+			Extensions:        manifestTypes(manifest),
+		},
+	})
 	if err != nil {
-		fmt.Println(utils.ErrorColor("❌ Error getting zip file info:"), err)
+		fmt.Println(utils.ErrorColor("❌ Error sending folder request:"), err)
 		return
 	}
+	fmt.Println(utils.InfoColor("⏳ Waiting for the recipient to accept..."))
 
-	zipSize := zipInfo.Size()
-	folderName := filepath.Base(folderPath)
-
-	// Calculate checksum of the zip file
-	checksum, err := helper.CalculateFileChecksum(tempZipPath)
+	ready, err := waitForTransferReady(transferID, replies)
 	if err != nil {
-		fmt.Println(utils.ErrorColor("❌ Error calculating checksum:"), err)
+		fmt.Println(utils.ErrorColor("❌ Folder transfer not started:"), err)
 		return
 	}
 
-	transferID := GenerateTransferID()
+	// Only the recipient can open what we send, even when the server relays it
+	sealer, err := sendingCipher(ready, transferKeys)
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error setting up encryption:"), err)
+		return
+	}
 
-	fmt.Printf("%s Sending folder '%s' to user %s (Transfer ID: %s)...\n",
-		utils.InfoColor("📤"),
-		utils.InfoColor(folderName),
-		utils.UserColor(recipientId),
-		utils.CommandColor(transferID))
+	// Payload goes over its own connection so chat and heartbeats keep flowing
+	dataConn, err := dialTransfer(ready)
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error opening data channel:"), err)
+		return
+	}
+	defer dataConn.Close()
+
+	// The receiver needs the manifest to lay out the folder before telling us
+	// how much it already has from an earlier attempt
+	needed := manifest
+	err = sendManifest(dataConn, manifest, sealer, helper.SealManifest)
+	if err == nil && sync {
+		needed, err = readNeededEntries(dataConn, sealer, manifest)
+	}
+	payload := newFolderPayload(folderPath, needed, false)
+	defer payload.Close()
+	folderSize = payload.size
 
-	// Send folder request with zip size, checksum and transfer ID
-	_, err = conn.Write([]byte(fmt.Sprintf("/FOLDER_REQUEST %s %s %d %s %s\n",
-		recipientId, folderName, zipSize, checksum, transferID)))
+	var offset int64
+	if err == nil {
+		offset, err = readResumeOffset(dataConn, folderSize)
+	}
 	if err != nil {
-		fmt.Println(utils.ErrorColor("❌ Error sending folder request:"), err)
+		fmt.Println(utils.ErrorColor("❌ Error starting folder transfer:"), err)
 		return
 	}
+	if sync {
+		fmt.Println(utils.InfoColor("🔄 Recipient needs"), utils.InfoColor(describeSync(manifest, needed)))
+	}
+	if offset > 0 {
+		fmt.Println(utils.InfoColor("⏩ Resuming from"), utils.InfoColor(helper.FormatSize(offset)))
+	}
 
 	// Create progress bar with transfer ID
-	bar := utils.CreateProgressBar(zipSize, "📤 Sending folder")
+	bar := utils.CreateProgressBar(folderSize, "📤 Sending folder")
 	bar.SetTransferId(transferID)
+	bar.Bar.Set64(offset)
 
 	// Create transfer record
 	transfer := &Transfer{
 		ID:            transferID,
 		Type:          FolderTransfer,
 		Name:          folderName,
-		Size:          zipSize,
-		BytesComplete: 0,
+		Size:          folderSize,
+		BytesComplete: offset,
 		Status:        Active,
 		Direction:     "send",
 		Recipient:     recipientId,
 		Path:          folderPath,
-		Checksum:      checksum,
 		StartTime:     time.Now(),
-		File:          zipFile,
-		Connection:    conn,
+		Connection:    dataConn,
 		ProgressBar:   bar,
+		Sync:          sync,
+		Mirror:        mirror,
 	}
 
 	// Register the transfer
 	RegisterTransfer(transfer)
 
-	checkpointedReader := NewCheckpointedReader(zipFile, transfer, 32768) // 32KB chunks
+	checkpointedReader := NewCheckpointedReader(io.NewSectionReader(payload, offset, folderSize-offset), transfer, 32768) // 32KB chunks
+	checkpointedReader.BytesRead = offset
 
-	// Stream zip file data using the checkpointed reader with progress bar
+	// Stream the files as hashed chunks, resending only corrupted ones
 	reader := io.TeeReader(checkpointedReader, bar)
-	n, err := io.CopyN(conn, reader, zipSize)
+	checksum, err := sendChunks(dataConn, reader, payload, offset, folderSize, algorithm, sealer)
 
 	if err != nil {
-		UpdateTransferStatus(transferID, Failed)
+		// Keep the transfer around so /resume can pick it up again
+		UpdateTransferStatus(transferID, Interrupted)
 		fmt.Println(utils.ErrorColor("\n❌ Error sending folder:"), err)
-		RemoveTransfer(transferID)
-		return
-	}
-	if n != zipSize {
-		UpdateTransferStatus(transferID, Failed)
-		fmt.Println(utils.ErrorColor("\n❌ Error: sent"), utils.ErrorColor(n), utils.ErrorColor("bytes, expected"), utils.ErrorColor(zipSize), utils.ErrorColor("bytes"))
-		RemoveTransfer(transferID)
+		fmt.Println(utils.InfoColor("💾 Use"), utils.CommandColor("/resume "+transferID), utils.InfoColor("to continue where it stopped"))
 		return
 	}
 
 	UpdateTransferStatus(transferID, Completed)
 
 	fmt.Println(utils.SuccessColor("\n✅ Folder"), utils.SuccessColor(folderName), utils.SuccessColor("sent successfully!"))
-	fmt.Println(utils.InfoColor("  MD5 Checksum:"), utils.InfoColor(checksum))
+	fmt.Println(utils.InfoColor("  "+strings.ToUpper(algorithm)+" Checksum:"), utils.InfoColor(checksum))
 
 	RemoveTransfer(transferID)
 }
 
-func HandleFolderTransfer(conn net.Conn, recipientId, folderName string, folderSize int64, storeFilePath string) {
-	// Extract checksum and transfer ID if present
-	checksum := ""
-	transferID := ""
-
-	parts := strings.SplitN(folderName, "|", 3)
-	if len(parts) >= 2 {
-		folderName = parts[0]
-		checksum = parts[1]
-		fmt.Println(utils.InfoColor("📋 Original checksum:"), utils.InfoColor(checksum))
-
-		if len(parts) >= 3 {
-			transferID = parts[2]
-		} else {
-			transferID = GenerateTransferID()
-		}
-	} else {
+func HandleFolderTransfer(senderId string, info protocol.TransferInfo, storeFilePath string, incoming *incomingTransfer) {
+	// Only the base name is used so a sender cannot pick where the folder lands
+	folderName := filepath.Base(info.Name)
+	folderSize := info.Size
+	transferID := info.Id
+	if transferID == "" {
 		transferID = GenerateTransferID()
 	}
 
@@ -143,17 +188,72 @@ func HandleFolderTransfer(conn net.Conn, recipientId, folderName string, folderS
 		utils.InfoColor(fmt.Sprintf("%d bytes", folderSize)),
 		utils.CommandColor(transferID))
 
-	// Create temporary zip file to store received data
-	tempZipPath := filepath.Join(storeFilePath, folderName+".zip")
-	zipFile, err := os.Create(tempZipPath)
+	dataConn, err := incoming.accept()
 	if err != nil {
-		fmt.Println(utils.ErrorColor("❌ Error creating temporary zip file:"), err)
+		fmt.Println(utils.ErrorColor("❌ Error opening data channel:"), err)
 		return
 	}
+	defer dataConn.Close()
+
+	// Payload is sealed by the sender; without the key nothing can be verified
+	opener, err := receivingCipher(incoming)
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error setting up encryption:"), err)
+		return
+	}
+
+	// Every path and size is checked before anything is written
+	manifest, err := readManifest(dataConn, opener, helper.SealManifest)
+	if err == nil {
+		err = checkManifest(manifest, info)
+	}
+	if err != nil {
+		fmt.Println(utils.ErrorColor("🚫 Refused folder:"), err)
+		return
+	}
+
+	// A sync only asks for the files our copy lacks or holds in another version
+	needed, partialInfo, destPath := manifest, info, ""
+	if info.Sync {
+		destPath = syncDestination(storeFilePath, folderName)
+		needed, err = neededEntries(destPath, manifest)
+		if err == nil {
+			err = sendManifest(dataConn, needed, opener, helper.SealManifestReply)
+		}
+		if err != nil {
+			fmt.Println(utils.ErrorColor("❌ Error comparing folder:"), err)
+			return
+		}
+		partialInfo = syncPartialInfo(info, needed)
+		folderSize = partialInfo.Size
+	}
+
+	// Files are written in place inside a partial folder until all have arrived
+	journal, payload, err := openFolderPartial(storeFilePath, partialInfo, needed)
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error creating folder:"), err)
+		return
+	}
+	offset := journal.Offset
+	partial := newJournalWriter(payload, journal)
+
+	if err := sendResumeOffset(dataConn, transferID, offset); err != nil {
+		partial.Close()
+		fmt.Println(utils.ErrorColor("❌ Error starting folder transfer:"), err)
+		return
+	}
+	fmt.Println(utils.InfoColor("📦 Folder contains"), utils.InfoColor(describeManifest(manifest)))
+	if info.Sync {
+		fmt.Println(utils.InfoColor("🔄 Updating"), utils.InfoColor(destPath+":"), utils.InfoColor(describeSync(manifest, needed)), utils.InfoColor("to receive"))
+	}
+	if offset > 0 {
+		fmt.Println(utils.InfoColor("⏩ Resuming from"), utils.InfoColor(helper.FormatSize(offset)))
+	}
 
 	// Create progress bar with transfer ID
 	bar := utils.CreateProgressBar(folderSize, "📥 Receiving folder")
 	bar.SetTransferId(transferID)
+	bar.Bar.Set64(offset)
 
 	// Create transfer record
 	transfer := &Transfer{
@@ -161,165 +261,151 @@ func HandleFolderTransfer(conn net.Conn, recipientId, folderName string, folderS
 		Type:          FolderTransfer,
 		Name:          folderName,
 		Size:          folderSize,
-		BytesComplete: 0,
+		BytesComplete: offset,
 		Status:        Active,
 		Direction:     "receive",
-		Recipient:     recipientId,
-		Path:          tempZipPath,
-		Checksum:      checksum,
+		Recipient:     senderId,
+		Path:          journal.partialPath,
 		StartTime:     time.Now(),
-		File:          zipFile,
-		Connection:    conn,
+		Connection:    dataConn,
 		ProgressBar:   bar,
+		Sync:          info.Sync,
+		Mirror:        info.Mirror,
 	}
 
 	RegisterTransfer(transfer)
 
-	writer := NewCheckpointedWriter(zipFile, transfer, 32768) // 32KB chunks
+	writer := NewCheckpointedWriter(partial, transfer, 32768) // 32KB chunks
+	writer.BytesWritten = offset
 
-	// Receive the zip file data with progress
-	n, err := io.CopyN(writer, io.TeeReader(conn, bar), folderSize)
-	zipFile.Close()
+	// Receive the files chunk by chunk, verifying each as it arrives
+	checksum, receivedChecksum, err := receiveChunks(dataConn, writer, partial, offset, folderSize, bar, info.ChecksumAlgorithm, opener)
+	if closeErr := partial.Close(); err == nil {
+		err = closeErr
+	}
 
 	if err != nil {
 		UpdateTransferStatus(transferID, Failed)
-		os.Remove(tempZipPath)
 		fmt.Println(utils.ErrorColor("\n❌ Error receiving folder data:"), err)
+		fmt.Println(utils.InfoColor("💾 Kept"), utils.InfoColor(helper.FormatSize(journal.Offset)), utils.InfoColor("so the sender can resume"))
 		RemoveTransfer(transferID)
 		return
 	}
 
-	if n != folderSize {
-		UpdateTransferStatus(transferID, Failed)
-		os.Remove(tempZipPath)
-		fmt.Println(utils.ErrorColor("\n❌ Error: received"), utils.ErrorColor(n), utils.ErrorColor("bytes, expected"), utils.ErrorColor(folderSize), utils.ErrorColor("bytes"))
-		RemoveTransfer(transferID)
-		return
+	// The sender's checksum arrives as a trailer and ours was hashed on the way in
+	if checksum != "" {
+		fmt.Println(utils.InfoColor("\n📋 Original checksum:"), utils.InfoColor(checksum))
+		fmt.Println(utils.InfoColor("📋 Calculated checksum:"), utils.InfoColor(receivedChecksum))
+
+		if helper.VerifyChecksum(checksum, receivedChecksum) {
+			fmt.Println(utils.SuccessColor("✅ Checksum verification successful! Folder integrity confirmed."))
+		} else {
+			// Nothing is applied or renamed into place; the data stays partial
+			UpdateTransferStatus(transferID, Failed)
+			fmt.Println(utils.ErrorColor("❌ Checksum verification failed! Folder may be corrupted."))
+			fmt.Println(utils.InfoColor("💾 Kept the received data in"), utils.InfoColor(journal.partialPath))
+			RemoveTransfer(transferID)
+			return
+		}
 	}
 
-	// Verify checksum if provided
-	if checksum != "" {
-		receivedChecksum, err := helper.CalculateFileChecksum(tempZipPath)
+	if err := payload.restoreTimes(); err != nil {
+		fmt.Println(utils.WarningColor("⚠️  Could not restore modification times:"), err)
+	}
+
+	if info.Sync {
+		// Each changed file replaces its old version in one step
+		removed, err := applyFolderSync(journal.partialPath, destPath, manifest, needed, info.Mirror)
 		if err != nil {
-			fmt.Println(utils.ErrorColor("\n❌ Error calculating checksum:"), err)
-		} else {
-			fmt.Println(utils.InfoColor("\n📋 Calculated checksum:"), utils.InfoColor(receivedChecksum))
+			UpdateTransferStatus(transferID, Failed)
+			fmt.Println(utils.ErrorColor("❌ Error updating folder:"), err)
+			RemoveTransfer(transferID)
+			return
+		}
+		journal.discard()
+		UpdateTransferStatus(transferID, Completed)
 
-			if helper.VerifyChecksum(checksum, receivedChecksum) {
-				fmt.Println(utils.SuccessColor("✅ Checksum verification successful! Folder integrity confirmed."))
-			} else {
-				fmt.Println(utils.ErrorColor("❌ Checksum verification failed! Folder may be corrupted."))
-			}
+		fmt.Println(utils.SuccessColor("✅ Folder"), utils.SuccessColor(folderName), utils.SuccessColor("is up to date!"))
+		if removed > 0 {
+			fmt.Println(utils.InfoColor("🗑️  Removed"), utils.InfoColor(fmt.Sprint(removed)), utils.InfoColor("entries the sender no longer has"))
 		}
+		fmt.Println(utils.InfoColor("📂 Saved to:"), utils.InfoColor(destPath))
+		RemoveTransfer(transferID)
+		return
 	}
 
-	fmt.Println(utils.InfoColor("\n📦 Extracting folder..."))
-	//Extract the zip file
-	destPath := filepath.Join(storeFilePath, folderName)
-	err = helper.ExtractZip(tempZipPath, destPath)
+	// Only the finished folder leaves the partial store, under a name nothing
+	// else holds
+	destPath, err = claimPath(journal.partialPath, filepath.Join(storeFilePath, folderName))
 	if err != nil {
 		UpdateTransferStatus(transferID, Failed)
-		os.Remove(tempZipPath)
-		fmt.Println(utils.ErrorColor("❌ Error extracting folder:"), err)
+		fmt.Println(utils.ErrorColor("❌ Error saving folder:"), err)
 		RemoveTransfer(transferID)
 		return
 	}
+	journal.discard()
 
 	UpdateTransferStatus(transferID, Completed)
 
-	// Clean up the temporary zip file
-	os.Remove(tempZipPath)
-	fmt.Println(utils.SuccessColor("✅ Folder"), utils.SuccessColor(folderName), utils.SuccessColor("received and extracted successfully!"))
+	fmt.Println(utils.SuccessColor("✅ Folder"), utils.SuccessColor(folderName), utils.SuccessColor("received successfully!"))
 	fmt.Println(utils.InfoColor("📂 Saved to:"), utils.InfoColor(destPath))
 
 	RemoveTransfer(transferID)
 }
 
 func HandleLookupRequest(conn net.Conn, userId string) {
-	_, err := conn.Write([]byte(fmt.Sprintf("/LOOK %s\n", userId)))
+	err := protocol.WriteMessage(conn, protocol.Message{Type: protocol.MsgLookupRequest, Target: userId})
 	if err != nil {
 		fmt.Printf("Error sending look request: %v\n", err)
 		return
 	}
 }
 
-func HandleLookupResponse(conn net.Conn, storeFilePath string, userId string) {
-	// Clean and normalize the path
-	cleanPath := filepath.Clean(strings.TrimSpace(storeFilePath))
-	absPath, err := filepath.Abs(cleanPath)
+// HandleLookupResponse lists the shared folder for userId
+func HandleLookupResponse(conn net.Conn, userId string) {
+	entries, err := listShare()
 	if err != nil {
-		fmt.Printf("Error resolving absolute path: %v\n", err)
+		fmt.Printf("Error listing shared folder: %v\n", err)
 		return
 	}
 
-	// Verify directory exists and is accessible
-	info, err := os.Stat(absPath)
+	err = protocol.WriteMessage(conn, protocol.Message{Type: protocol.MsgDirListing, Target: userId, Entries: entries})
 	if err != nil {
-		if os.IsNotExist(err) {
-			fmt.Printf("Store directory does not exist: %s\n", absPath)
-		} else {
-			fmt.Printf("Error accessing directory: %v\n", err)
-		}
-		return
+		fmt.Printf("Error sending lookup response: %v\n", err)
 	}
 
-	if !info.IsDir() {
-		fmt.Printf("Path is not a directory: %s\n", absPath)
-		return
-	}
+	printDirListing(entries)
+}
 
+// printDirListing shows folders first, then files
+func printDirListing(entries []protocol.DirEntry) {
 	var folders []string
 	var files []string
-
-	err = filepath.Walk(absPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			fmt.Printf("Error accessing path %s: %v\n", path, err)
-			return nil
-		}
-		if path == absPath {
-			return nil
-		}
-
-		// Get clean relative path
-		absolutePath := filepath.ToSlash(path)
-
-		if info.IsDir() {
-			folders = append(folders, fmt.Sprintf("[FOLDER] %s (Size: %d bytes)", absolutePath, info.Size()))
+	for _, entry := range entries {
+		if entry.IsDir {
+			folders = append(folders, fmt.Sprintf("[FOLDER] %s (Size: %d bytes)", entry.Path, entry.Size))
 		} else {
-			files = append(files, fmt.Sprintf("[FILE] %s (Size: %d bytes)", absolutePath, info.Size()))
+			files = append(files, fmt.Sprintf("[FILE] %s (Size: %d bytes)", entry.Path, entry.Size))
 		}
-		return nil
-	})
-
-	if err != nil {
-		fmt.Printf("Error walking directory: %v\n", err)
-		return
 	}
 
-	var allEntries []string
 	if len(folders) > 0 {
-		allEntries = append(allEntries, "=== FOLDERS ===")
-		allEntries = append(allEntries, folders...)
+		fmt.Println(utils.HeaderColor("=== FOLDERS ==="))
+		for _, folder := range folders {
+			fmt.Println(utils.WarningColor("📁"), utils.InfoColor(folder))
+		}
 	}
 	if len(files) > 0 {
-		if len(allEntries) > 0 {
-			allEntries = append(allEntries, "") // Add spacing between folders and files
+		if len(folders) > 0 {
+			fmt.Println() // Add spacing between folders and files
+		}
+		fmt.Println(utils.HeaderColor("=== FILES ==="))
+		for _, file := range files {
+			fmt.Println(utils.SuccessColor("📄"), utils.InfoColor(file))
 		}
-		allEntries = append(allEntries, "=== FILES ===")
-		allEntries = append(allEntries, files...)
-	}
-
-	if len(allEntries) == 0 {
-		allEntries = append(allEntries, "Directory is empty")
-	}
-
-	response := fmt.Sprintf("LOOK_RESPONSE %s %s\n", userId, strings.Join(allEntries, "\n"))
-	_, err = conn.Write([]byte(response))
-	if err != nil {
-		fmt.Printf("Error sending lookup response: %v\n", err)
 	}
 
-	for _, entry := range allEntries {
-		fmt.Println(entry)
+	if len(entries) == 0 {
+		fmt.Println(utils.InfoColor("Directory is empty"))
 	}
 }
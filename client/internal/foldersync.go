@@ -0,0 +1,238 @@
+package connection
+
+import (
+	"crypto/sha256"
+	"drizlink/helper"
+	"drizlink/protocol"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// HandleSyncFolder sends only what recipientId's copy of folderPath lacks or
+// has in a different version. With mirror, files the recipient has that the
+// folder no longer contains are deleted on its side.
+func HandleSyncFolder(conn net.Conn, recipientId, folderPath string, mirror bool) {
+	sendFolder(conn, recipientId, folderPath, GenerateTransferID(), true, mirror)
+}
+
+// syncDestination is the folder a sync updates: the recipient's folder of the
+// same name, unless something that is not a folder already uses that name
+func syncDestination(storePath, name string) string {
+	dest := filepath.Join(storePath, name)
+	if name == partialDirName {
+		return availablePath(dest)
+	}
+	info, err := os.Lstat(dest)
+	if os.IsNotExist(err) || (err == nil && info.IsDir()) {
+		return dest
+	}
+	return availablePath(dest)
+}
+
+// neededEntries lists the files of manifest that dest lacks or holds in a
+// different version. A file whose size and modification time match is taken
+// as current; one whose time differs is hashed before it is asked for again,
+// and takes the sender's time if it turns out to be the same.
+func neededEntries(dest string, manifest []protocol.DirEntry) ([]protocol.DirEntry, error) {
+	needed := []protocol.DirEntry{}
+	realDirs := make(map[string]bool)
+	for _, entry := range manifest {
+		if entry.IsDir || entry.Deleted {
+			continue
+		}
+		current, err := isCurrent(dest, entry, realDirs)
+		if err != nil {
+			return nil, err
+		}
+		if !current {
+			needed = append(needed, entry)
+		}
+	}
+	return needed, nil
+}
+
+// isCurrent reports whether dest already holds entry. Files reached through
+// a symlinked folder do not count, since the sync replaces such links.
+func isCurrent(dest string, entry protocol.DirEntry, realDirs map[string]bool) (bool, error) {
+	for dir := path.Dir(entry.Path); dir != "."; dir = path.Dir(dir) {
+		real, checked := realDirs[dir]
+		if !checked {
+			info, err := os.Lstat(filepath.Join(dest, filepath.FromSlash(dir)))
+			real = err == nil && info.IsDir()
+			realDirs[dir] = real
+		}
+		if !real {
+			return false, nil
+		}
+	}
+
+	local := filepath.Join(dest, filepath.FromSlash(entry.Path))
+	info, err := os.Lstat(local)
+	if err != nil || !info.Mode().IsRegular() || info.Size() != entry.Size {
+		return false, nil
+	}
+	if info.ModTime().UnixNano() == entry.ModTime {
+		return true, nil
+	}
+	if entry.Hash == "" {
+		return false, nil
+	}
+	hash, err := hashFile(local, info)
+	if err != nil || hash != entry.Hash {
+		return false, err
+	}
+	modTime := time.Unix(0, entry.ModTime)
+	os.Chtimes(local, modTime, modTime)
+	return true, nil
+}
+
+// readNeededEntries receives the recipient's answer to a sync manifest and
+// maps it back onto the sender's own entries, in the recipient's order
+func readNeededEntries(dataConn io.Reader, sealer *helper.PayloadCipher, manifest []protocol.DirEntry) ([]protocol.DirEntry, error) {
+	requested, err := readManifest(dataConn, sealer, helper.SealManifestReply)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]protocol.DirEntry, len(manifest))
+	for _, entry := range manifest {
+		if !entry.IsDir && !entry.Deleted {
+			files[entry.Path] = entry
+		}
+	}
+	needed := make([]protocol.DirEntry, 0, len(requested))
+	for _, request := range requested {
+		entry, exists := files[request.Path]
+		if !exists {
+			return nil, fmt.Errorf("recipient asked for unknown file %q", request.Path)
+		}
+		delete(files, request.Path)
+		needed = append(needed, entry)
+	}
+	return needed, nil
+}
+
+// syncPartialInfo identifies the partial payload of a sync by the files it
+// carries, so an interrupted sync resumes only while the same files are needed
+func syncPartialInfo(info protocol.TransferInfo, needed []protocol.DirEntry) protocol.TransferInfo {
+	partial := info
+	partial.Size = manifestSize(needed)
+	if info.Fingerprint != "" {
+		hash := sha256.New()
+		fmt.Fprintf(hash, "%s\n", info.Fingerprint)
+		for _, entry := range needed {
+			fmt.Fprintf(hash, "%s\x00", entry.Path)
+		}
+		partial.Fingerprint = hex.EncodeToString(hash.Sum(nil)[:16])
+	}
+	return partial
+}
+
+// applyFolderSync moves the received files from partialDir into dest and
+// creates the folders of manifest, replacing whatever is in their way. With
+// mirror, everything in dest that manifest does not list is deleted. It
+// returns how many entries were deleted.
+func applyFolderSync(partialDir, dest string, manifest, received []protocol.DirEntry, mirror bool) (int, error) {
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return 0, err
+	}
+	for _, entry := range manifest {
+		if entry.IsDir && !entry.Deleted {
+			if err := ensureDir(dest, entry.Path); err != nil {
+				return 0, err
+			}
+		}
+	}
+	for _, entry := range received {
+		if err := ensureDir(dest, path.Dir(entry.Path)); err != nil {
+			return 0, err
+		}
+		target := filepath.Join(dest, filepath.FromSlash(entry.Path))
+		if info, err := os.Lstat(target); err == nil && info.IsDir() {
+			if err := os.RemoveAll(target); err != nil {
+				return 0, err
+			}
+		}
+		// Rename replaces a file or symlink in place, never what a link points to
+		if err := os.Rename(filepath.Join(partialDir, filepath.FromSlash(entry.Path)), target); err != nil {
+			return 0, err
+		}
+	}
+	if !mirror {
+		return 0, nil
+	}
+
+	listed := make(map[string]bool, len(manifest))
+	for _, entry := range manifest {
+		listed[entry.Path] = !entry.Deleted
+	}
+	removed := 0
+	err := filepath.Walk(dest, func(current string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(dest, current)
+		if err != nil || relPath == "." {
+			return err
+		}
+		if info.IsDir() && info.Name() == partialDirName {
+			return filepath.SkipDir
+		}
+		if listed[filepath.ToSlash(relPath)] {
+			return nil
+		}
+		if err := os.RemoveAll(current); err != nil {
+			return err
+		}
+		removed++
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return removed, err
+}
+
+// ensureDir makes every folder on rel below root a real folder, replacing
+// files and symlinks in the way so nothing is written outside root
+func ensureDir(root, rel string) error {
+	if rel == "." || rel == "" {
+		return nil
+	}
+	current := root
+	for _, part := range strings.Split(rel, "/") {
+		current = filepath.Join(current, part)
+		info, err := os.Lstat(current)
+		if err == nil && info.IsDir() {
+			continue
+		}
+		if err == nil {
+			if err := os.RemoveAll(current); err != nil {
+				return err
+			}
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.Mkdir(current, 0755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// describeSync summarises what a sync transfers, e.g. "3 of 120 files (1.2 MB)"
+func describeSync(manifest, needed []protocol.DirEntry) string {
+	files := 0
+	for _, entry := range manifest {
+		if !entry.IsDir {
+			files++
+		}
+	}
+	return fmt.Sprintf("%d of %d files (%s)", len(needed), files, helper.FormatSize(manifestSize(needed)))
+}
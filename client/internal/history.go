@@ -0,0 +1,69 @@
+package connection
+
+import (
+	"drizlink/protocol"
+	"drizlink/utils"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	// historyCursors remembers, per room, the oldest message shown so far so
+	// that repeated /history commands page further back
+	historyCursors = make(map[string]int64)
+	historyMutex   sync.Mutex
+)
+
+// HandleHistoryRequest asks for the page of a room's history before the
+// oldest message already shown
+func HandleHistoryRequest(conn net.Conn, roomId string, limit int) error {
+	historyMutex.Lock()
+	before := historyCursors[roomId]
+	historyMutex.Unlock()
+
+	return protocol.WriteMessage(conn, protocol.Message{Type: protocol.MsgHistoryRequest, RoomId: roomId, Before: before, Limit: limit})
+}
+
+// printHistory shows a page of room history, oldest first
+func printHistory(msg protocol.Message) {
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+
+	if len(msg.History) == 0 {
+		if msg.Before > 0 {
+			fmt.Println(utils.InfoColor(fmt.Sprintf("📜 No older messages in '%s'", msg.RoomName)))
+			delete(historyCursors, msg.RoomId)
+		} else {
+			fmt.Println(utils.InfoColor(fmt.Sprintf("📜 No messages in '%s' yet", msg.RoomName)))
+		}
+		return
+	}
+
+	header := "📜 Recent messages in"
+	if msg.Before > 0 {
+		header = "📜 Earlier messages in"
+	}
+	fmt.Println(utils.HeaderColor(fmt.Sprintf("\n%s '%s' (ID: %s):", header, msg.RoomName, msg.RoomId)))
+	for _, entry := range msg.History {
+		fmt.Println(utils.InfoColor(fmt.Sprintf("  [%s] %s: %s", formatSentTime(entry.Time), entry.Username, entry.Text)))
+	}
+
+	// Start over from the newest messages once the beginning is reached
+	if oldest := msg.History[0].Seq; oldest <= 1 {
+		fmt.Println(utils.InfoColor("  — start of history —"))
+		delete(historyCursors, msg.RoomId)
+	} else {
+		historyCursors[msg.RoomId] = oldest
+		fmt.Println(utils.InfoColor(fmt.Sprintf("  (/history %s for older messages)", msg.RoomId)))
+	}
+}
+
+// formatSentTime shows an RFC 3339 server timestamp in local time
+func formatSentTime(stamp string) string {
+	if sent, err := time.Parse(time.RFC3339, stamp); err == nil {
+		return sent.Local().Format("Jan 2 15:04")
+	}
+	return stamp
+}
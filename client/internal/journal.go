@@ -0,0 +1,243 @@
+package connection
+
+import (
+	"crypto/sha256"
+	"drizlink/protocol"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// journalInterval is how many bytes are written between journal updates
+const journalInterval = 1 << 20
+
+// partialDirName holds unfinished incoming payloads inside the store path
+const partialDirName = ".drizlink"
+
+// partialJournal records how much of an incoming payload is safely on disk, so a
+// later offer of the same content can continue from Offset instead of zero
+type partialJournal struct {
+	TransferId  string `json:"transferId"`
+	Name        string `json:"name"`
+	Size        int64  `json:"size"`
+	Fingerprint string `json:"fingerprint"`
+	Offset      int64  `json:"offset"`
+
+	journalPath string
+	partialPath string
+}
+
+// partialKey identifies a payload by its source fingerprint rather than by
+// transfer ID or name, which change when the sender restarts or the recipient
+// renames it
+func partialKey(info protocol.TransferInfo) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d\x00%s", info.Size, info.Fingerprint)))
+	return hex.EncodeToString(sum[:16])
+}
+
+// openPartial opens the partial file for info, positioned at the last offset
+// the journal confirmed. Without a fingerprint the content cannot be recognised
+// later, so such transfers always start from zero.
+func openPartial(storePath string, info protocol.TransferInfo) (*partialJournal, *os.File, error) {
+	journal, err := loadJournal(storePath, info, ".part")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	file, err := os.OpenFile(journal.partialPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Bytes past the confirmed offset may not have reached the disk intact
+	stat, err := file.Stat()
+	if err != nil || journal.Offset > stat.Size() || journal.Offset > info.Size || journal.Offset < 0 {
+		journal.Offset = 0
+	}
+	// Payloads travel in chunks, so resume on a chunk boundary
+	if journal.Offset != info.Size {
+		journal.Offset -= journal.Offset % protocol.ChunkSize
+	}
+	if err := file.Truncate(journal.Offset); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	if _, err := file.Seek(journal.Offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	return journal, file, journal.save()
+}
+
+// openFolderPartial lays out the folder described by manifest in a partial
+// folder, keeping what an earlier attempt confirmed
+func openFolderPartial(storePath string, info protocol.TransferInfo, manifest []protocol.DirEntry) (*partialJournal, *folderPayload, error) {
+	journal, err := loadJournal(storePath, info, ".dir")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	payload := newFolderPayload(journal.partialPath, manifest, true)
+	journal.Offset, err = payload.prepare(journal.Offset)
+	if err != nil {
+		return nil, nil, err
+	}
+	return journal, payload, journal.save()
+}
+
+// loadJournal reads the journal kept for info, if any. The partial payload
+// sits next to it, named with suffix.
+func loadJournal(storePath string, info protocol.TransferInfo, suffix string) (*partialJournal, error) {
+	dir := filepath.Join(storePath, partialDirName, "partial")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	key := partialKey(info)
+	journal := &partialJournal{
+		TransferId:  info.Id,
+		Name:        info.Name,
+		Size:        info.Size,
+		Fingerprint: info.Fingerprint,
+		journalPath: filepath.Join(dir, key+".json"),
+		partialPath: filepath.Join(dir, key+suffix),
+	}
+
+	if info.Fingerprint != "" {
+		if data, err := os.ReadFile(journal.journalPath); err == nil {
+			var saved partialJournal
+			if json.Unmarshal(data, &saved) == nil && saved.Size == info.Size && saved.Fingerprint == info.Fingerprint {
+				journal.Offset = saved.Offset
+			}
+		}
+	}
+	return journal, nil
+}
+
+// resumableOffset reports how much of info is already journaled under storePath
+func resumableOffset(storePath string, info protocol.TransferInfo) int64 {
+	if info.Fingerprint == "" {
+		return 0
+	}
+	data, err := os.ReadFile(filepath.Join(storePath, partialDirName, "partial", partialKey(info)+".json"))
+	if err != nil {
+		return 0
+	}
+	var saved partialJournal
+	if json.Unmarshal(data, &saved) != nil || saved.Size != info.Size || saved.Fingerprint != info.Fingerprint {
+		return 0
+	}
+	return saved.Offset
+}
+
+// save atomically rewrites the journal with the current offset
+func (journal *partialJournal) save() error {
+	data, err := json.Marshal(journal)
+	if err != nil {
+		return err
+	}
+	tempPath := journal.journalPath + ".tmp"
+	if err := os.WriteFile(tempPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, journal.journalPath)
+}
+
+// confirm flushes file to disk and then records offset as safe to resume from
+func (journal *partialJournal) confirm(file partialFile, offset int64) error {
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	journal.Offset = offset
+	return journal.save()
+}
+
+// discard removes the journal and its partial file or folder
+func (journal *partialJournal) discard() {
+	os.RemoveAll(journal.partialPath)
+	os.Remove(journal.journalPath)
+}
+
+// journalWriter writes to the partial file and confirms progress in the journal
+// every journalInterval bytes
+type journalWriter struct {
+	file     partialFile
+	journal  *partialJournal
+	offset   int64
+	unsynced int64
+	// ceiling caps the confirmed offset while earlier bytes still need
+	// replacing; -1 means everything written is good
+	ceiling int64
+}
+
+func newJournalWriter(file partialFile, journal *partialJournal) *journalWriter {
+	return &journalWriter{file: file, journal: journal, offset: journal.Offset, ceiling: -1}
+}
+
+// holdAt stops the journal from confirming anything at or past offset; -1 lifts the cap
+func (jw *journalWriter) holdAt(offset int64) {
+	jw.ceiling = offset
+}
+
+// confirmed is the offset it is safe to resume from
+func (jw *journalWriter) confirmed() int64 {
+	if jw.ceiling >= 0 && jw.ceiling < jw.offset {
+		return jw.ceiling
+	}
+	return jw.offset
+}
+
+// Write implements io.Writer
+func (jw *journalWriter) Write(p []byte) (int, error) {
+	n, err := jw.file.Write(p)
+	jw.offset += int64(n)
+	jw.unsynced += int64(n)
+	if err != nil {
+		return n, err
+	}
+	if jw.unsynced >= journalInterval {
+		jw.unsynced = 0
+		if err := jw.journal.confirm(jw.file, jw.confirmed()); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Close confirms everything written so far, so an interrupted transfer resumes
+// from the last byte that reached us
+func (jw *journalWriter) Close() error {
+	err := jw.journal.confirm(jw.file, jw.confirmed())
+	if closeErr := jw.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// sendResumeOffset tells the sender, over the data channel, where to continue
+func sendResumeOffset(dataConn io.Writer, transferID string, offset int64) error {
+	return protocol.WriteMessage(dataConn, protocol.Message{
+		Type:     protocol.MsgResumeFrom,
+		Offset:   offset,
+		Transfer: &protocol.TransferInfo{Id: transferID},
+	})
+}
+
+// readResumeOffset waits for the receiver's confirmed offset on the data channel
+func readResumeOffset(dataConn io.Reader, size int64) (int64, error) {
+	msg, err := protocol.ReadMessage(dataConn)
+	if err != nil {
+		return 0, fmt.Errorf("waiting for receiver's offset: %v", err)
+	}
+	if msg.Type != protocol.MsgResumeFrom {
+		return 0, fmt.Errorf("expected resume offset, got %s", msg.Type)
+	}
+	if msg.Offset < 0 || msg.Offset > size {
+		return 0, fmt.Errorf("receiver asked to resume from invalid offset %d", msg.Offset)
+	}
+	return msg.Offset, nil
+}
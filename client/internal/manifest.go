@@ -0,0 +1,329 @@
+package connection
+
+import (
+	"crypto/sha256"
+	"drizlink/helper"
+	"drizlink/protocol"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// manifestPieceSize bounds each sealed piece of a folder manifest, so a piece
+// always fits in one control frame
+const manifestPieceSize = 256 * 1024
+
+// maxManifestPieces bounds how large a manifest a receiver reads, about
+// 100,000 entries with typical path lengths
+const maxManifestPieces = 64
+
+// FolderLimits bound what a received folder may hold, so a hostile manifest
+// cannot fill the disk
+type FolderLimits struct {
+	// MaxBytes caps the total size of the files
+	MaxBytes int64
+	// MaxEntries caps the number of files and folders
+	MaxEntries int
+}
+
+// DefaultFolderLimits suit folders shared between people
+var DefaultFolderLimits = FolderLimits{MaxBytes: 10 << 30, MaxEntries: 100000}
+
+// folderLimits are what checkManifest enforces
+var folderLimits = DefaultFolderLimits
+
+// SetFolderLimits caps the total size and number of entries of received
+// folders; zero keeps the default
+func SetFolderLimits(maxBytes int64, maxEntries int) {
+	if maxBytes > 0 {
+		folderLimits.MaxBytes = maxBytes
+	}
+	if maxEntries > 0 {
+		folderLimits.MaxEntries = maxEntries
+	}
+}
+
+// cachedHash is the hash of a file as it was when last read
+type cachedHash struct {
+	size    int64
+	modTime time.Time
+	hash    string
+}
+
+var (
+	hashCache      = make(map[string]cachedHash)
+	hashCacheMutex sync.Mutex
+)
+
+// buildManifest lists the folder at root in the order its files are streamed,
+// each folder before what it contains, and folders listed so even empty ones
+// arrive. Symlinks are sent as the file they point to, and only when that file is
+// inside the folder. With hashes every file's contents are hashed too, so a
+// recipient can tell which of its files are current. It also returns a
+// fingerprint of the listing, so an unchanged folder can resume an interrupted
+// transfer.
+func buildManifest(root string, hashes bool) ([]protocol.DirEntry, string, error) {
+	entries := []protocol.DirEntry{}
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\n", filepath.Base(root))
+
+	err := filepath.Walk(root, func(current string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(root, current)
+		if err != nil || relPath == "." {
+			return err
+		}
+		// Our own bookkeeping, e.g. when the whole shared folder is sent
+		if info.IsDir() && info.Name() == partialDirName {
+			return filepath.SkipDir
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := helper.ResolveInside(root, current)
+			if err != nil || target.IsDir() {
+				return nil
+			}
+			info = target
+		}
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			return nil
+		}
+
+		entry := protocol.DirEntry{Path: filepath.ToSlash(relPath), IsDir: info.IsDir()}
+		if !entry.IsDir {
+			entry.Size = info.Size()
+			entry.Executable = info.Mode()&0111 != 0
+			entry.ModTime = info.ModTime().UnixNano()
+		}
+		if hashes && !entry.IsDir {
+			if entry.Hash, err = hashFile(current, info); err != nil {
+				return err
+			}
+		}
+		entries = append(entries, entry)
+		fmt.Fprintf(hash, "%s\x00%d\x00%o\x00%d\n", entry.Path, entry.Size, info.Mode(), info.ModTime().UnixNano())
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return entries, hex.EncodeToString(hash.Sum(nil)[:16]), nil
+}
+
+// hashFile returns the SHA-256 of the file at path, whose metadata is info.
+// Hashes are remembered for as long as the client runs and reused while a
+// file's size and modification time stay the same, so sending the same folder
+// again only reads what changed.
+func hashFile(path string, info os.FileInfo) (string, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	hashCacheMutex.Lock()
+	cached, known := hashCache[absPath]
+	hashCacheMutex.Unlock()
+	if known && cached.size == info.Size() && cached.modTime.Equal(info.ModTime()) {
+		return cached.hash, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+
+	hashCacheMutex.Lock()
+	hashCache[absPath] = cachedHash{size: info.Size(), modTime: info.ModTime(), hash: sum}
+	hashCacheMutex.Unlock()
+	return sum, nil
+}
+
+// rememberHash records hash as the contents of the file at path, e.g. for a
+// file just received and verified, so it is not read again
+func rememberHash(path string, info os.FileInfo, hash string) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return
+	}
+	hashCacheMutex.Lock()
+	hashCache[absPath] = cachedHash{size: info.Size(), modTime: info.ModTime(), hash: hash}
+	hashCacheMutex.Unlock()
+}
+
+// manifestSize is the number of payload bytes a manifest describes
+func manifestSize(entries []protocol.DirEntry) int64 {
+	var size int64
+	for _, entry := range entries {
+		size += entry.Size
+	}
+	return size
+}
+
+// manifestTypes lists the file types of the files a manifest sends, for the
+// server to check against room file policies
+func manifestTypes(entries []protocol.DirEntry) []string {
+	seen := make(map[string]bool)
+	types := []string{}
+	for _, entry := range entries {
+		fileType := helper.FileType(entry.Path)
+		if entry.IsDir || entry.Deleted || seen[fileType] {
+			continue
+		}
+		seen[fileType] = true
+		types = append(types, fileType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// checkManifest refuses a manifest that would write outside the folder,
+// contradicts itself, holds files of types its offer did not declare, or
+// exceeds the folder limits
+func checkManifest(entries []protocol.DirEntry, info protocol.TransferInfo) error {
+	if folderLimits.MaxEntries > 0 && len(entries) > folderLimits.MaxEntries {
+		return fmt.Errorf("folder has %d entries, at most %d allowed", len(entries), folderLimits.MaxEntries)
+	}
+
+	declared := make(map[string]bool, len(info.Extensions))
+	for _, fileType := range info.Extensions {
+		declared[fileType] = true
+	}
+	seen := make(map[string]bool, len(entries))
+	files := make(map[string]bool)
+	var total int64
+	for _, entry := range entries {
+		if !helper.IsSharePath(entry.Path) || path.Clean(entry.Path) != entry.Path || entry.Path == "." {
+			return fmt.Errorf("entry %q would land outside the folder", entry.Path)
+		}
+		if seen[entry.Path] {
+			return fmt.Errorf("entry %q appears more than once", entry.Path)
+		}
+		seen[entry.Path] = true
+		if entry.Size < 0 || ((entry.IsDir || entry.Deleted) && entry.Size != 0) {
+			return fmt.Errorf("entry %q has an invalid size", entry.Path)
+		}
+		if !entry.IsDir && !entry.Deleted {
+			// The server checked the room's file policy against the declared types
+			if !declared[helper.FileType(entry.Path)] {
+				return fmt.Errorf("file %q is of a type the offer did not declare", entry.Path)
+			}
+			files[entry.Path] = true
+		}
+		total += entry.Size
+		if folderLimits.MaxBytes > 0 && total > folderLimits.MaxBytes {
+			return fmt.Errorf("folder is larger than %s", helper.FormatSize(folderLimits.MaxBytes))
+		}
+	}
+	// A file cannot also be the folder of another entry, except one now gone
+	for _, entry := range entries {
+		if entry.Deleted {
+			continue
+		}
+		for dir := path.Dir(entry.Path); dir != "."; dir = path.Dir(dir) {
+			if files[dir] {
+				return fmt.Errorf("entry %q is inside file %q", entry.Path, dir)
+			}
+		}
+	}
+	if total != info.Size {
+		return fmt.Errorf("manifest describes %d bytes but the offer was for %d", total, info.Size)
+	}
+	return nil
+}
+
+// sendManifest seals the manifest for purpose and sends it over the data
+// channel in pieces, numbered by Seq out of Limit
+func sendManifest(dataConn io.Writer, entries []protocol.DirEntry, sealer *helper.PayloadCipher, purpose uint32) error {
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	pieces := (len(data) + manifestPieceSize - 1) / manifestPieceSize
+	if pieces > maxManifestPieces {
+		return fmt.Errorf("folder has too many entries to send at once")
+	}
+	for index := 0; index < pieces; index++ {
+		piece := data[index*manifestPieceSize:]
+		if len(piece) > manifestPieceSize {
+			piece = piece[:manifestPieceSize]
+		}
+		err := protocol.WriteMessage(dataConn, protocol.Message{
+			Type:  protocol.MsgFolderManifest,
+			Seq:   int64(index),
+			Limit: pieces,
+			Text:  hex.EncodeToString(sealer.Seal(purpose, int64(index), piece)),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readManifest receives and opens what sendManifest sent for purpose
+func readManifest(dataConn io.Reader, opener *helper.PayloadCipher, purpose uint32) ([]protocol.DirEntry, error) {
+	var data []byte
+	for index, pieces := 0, 1; index < pieces; index++ {
+		msg, err := protocol.ReadMessage(dataConn)
+		if err != nil {
+			return nil, fmt.Errorf("waiting for folder manifest: %v", err)
+		}
+		if msg.Type != protocol.MsgFolderManifest {
+			return nil, fmt.Errorf("expected folder manifest, got %s", msg.Type)
+		}
+		if index == 0 {
+			pieces = msg.Limit
+		}
+		if msg.Limit != pieces || pieces < 1 || pieces > maxManifestPieces || msg.Seq != int64(index) {
+			return nil, fmt.Errorf("malformed folder manifest")
+		}
+		sealed, err := hex.DecodeString(msg.Text)
+		if err != nil {
+			return nil, fmt.Errorf("malformed folder manifest: %v", err)
+		}
+		piece, err := opener.Open(purpose, int64(index), sealed)
+		if err != nil {
+			return nil, fmt.Errorf("folder manifest: %v", err)
+		}
+		data = append(data, piece...)
+	}
+
+	var entries []protocol.DirEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("malformed folder manifest: %v", err)
+	}
+	return entries, nil
+}
+
+// describeManifest summarises a manifest as e.g. "12 files, 3 folders"
+func describeManifest(entries []protocol.DirEntry) string {
+	files, folders := 0, 0
+	for _, entry := range entries {
+		if entry.IsDir {
+			folders++
+		} else {
+			files++
+		}
+	}
+	plural := func(n int, word string) string {
+		if n == 1 {
+			return "1 " + word
+		}
+		return fmt.Sprintf("%d %ss", n, word)
+	}
+	return plural(files, "file") + ", " + plural(folders, "folder")
+}
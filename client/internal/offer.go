@@ -0,0 +1,362 @@
+package connection
+
+import (
+	"drizlink/helper"
+	"drizlink/protocol"
+	"drizlink/utils"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// offerLifetime matches how long the server keeps an unanswered offer open
+const offerLifetime = 2 * time.Minute
+
+// AutoAcceptPolicy decides which offers are accepted without asking. Every
+// configured condition must hold; with none configured nothing is auto-accepted.
+type AutoAcceptPolicy struct {
+	TrustedUsers map[string]bool // user IDs or usernames
+	MaxSize      int64           // 0 means no size condition
+}
+
+// transferOffer is an incoming file or folder waiting for our decision
+type transferOffer struct {
+	Sender     string
+	SenderName string
+	PeerToken  string
+	SenderKey  string
+	Info       protocol.TransferInfo
+	IsFolder   bool
+	ReceivedAt time.Time
+}
+
+var (
+	autoAccept = AutoAcceptPolicy{TrustedUsers: make(map[string]bool)}
+
+	// pendingOffers are keyed by transfer ID, which is what the user types
+	pendingOffers = make(map[string]*transferOffer)
+	offersMutex   sync.Mutex
+)
+
+// SetAutoAcceptPolicy configures which offers are accepted unattended
+func SetAutoAcceptPolicy(trustedUsers []string, maxSize int64) {
+	offersMutex.Lock()
+	defer offersMutex.Unlock()
+	for _, user := range trustedUsers {
+		if user = strings.TrimSpace(user); user != "" {
+			autoAccept.TrustedUsers[user] = true
+		}
+	}
+	autoAccept.MaxSize = maxSize
+}
+
+// allows reports whether the policy accepts offer without asking
+func (policy AutoAcceptPolicy) allows(offer *transferOffer) bool {
+	if len(policy.TrustedUsers) == 0 && policy.MaxSize <= 0 {
+		return false
+	}
+	if len(policy.TrustedUsers) > 0 && !policy.TrustedUsers[offer.Sender] && !policy.TrustedUsers[offer.SenderName] {
+		return false
+	}
+	if policy.MaxSize > 0 && offer.Info.Size > policy.MaxSize {
+		return false
+	}
+	return true
+}
+
+// HandleTransferOffer shows an incoming file or folder and either accepts it
+// under the auto-accept policy or waits for /accept or /decline
+func HandleTransferOffer(conn net.Conn, msg protocol.Message, isFolder bool) {
+	offer := &transferOffer{
+		Sender:     msg.From,
+		SenderName: msg.Username,
+		PeerToken:  msg.PeerToken,
+		SenderKey:  msg.PublicKey,
+		Info:       *msg.Transfer,
+		IsFolder:   isFolder,
+		ReceivedAt: time.Now(),
+	}
+
+	// Both sides must know the checksum algorithm, otherwise the file could never be verified
+	algorithm, err := helper.GetChecksumAlgorithm(offer.Info.ChecksumAlgorithm)
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Declined transfer from"), utils.UserColor(offer.SenderName), utils.ErrorColor(":"), err)
+		answerOffer(conn, offer, protocol.MsgTransferDecline, err.Error()+", supported: "+strings.Join(helper.ChecksumAlgorithms(), ", "))
+		return
+	}
+
+	// Updates of a folder synced with a room never wait for an answer
+	if offer.Info.Room != "" {
+		handleSyncOffer(conn, offer)
+		return
+	}
+
+	offersMutex.Lock()
+	_, duplicate := pendingOffers[offer.Info.Id]
+	autoAccepted := !duplicate && autoAccept.allows(offer)
+	if !duplicate && !autoAccepted {
+		pendingOffers[offer.Info.Id] = offer
+	}
+	offersMutex.Unlock()
+
+	if duplicate {
+		answerOffer(conn, offer, protocol.MsgTransferDecline, "transfer ID already pending, please resend")
+		return
+	}
+
+	kind := "file"
+	if isFolder {
+		kind = "folder"
+	}
+	fmt.Printf("%s %s offers %s '%s' (Size: %s, Transfer ID: %s)\n",
+		utils.InfoColor("📨"),
+		utils.UserColor(fmt.Sprintf("%s [ID: %s]", offer.SenderName, offer.Sender)),
+		kind,
+		utils.InfoColor(offer.Info.Name),
+		utils.InfoColor(helper.FormatSize(offer.Info.Size)),
+		utils.CommandColor(offer.Info.Id))
+	fmt.Println(utils.InfoColor("🔑 Sender key:"), utils.InfoColor(helper.KeyFingerprint(offer.SenderKey)), utils.InfoColor("(compare with /roominfo)"))
+	fmt.Println(utils.InfoColor("📋 Checksum:"), utils.InfoColor(algorithm.Name()), utils.InfoColor("(verified as it arrives)"))
+	if algorithm.Legacy() {
+		fmt.Println(utils.WarningColor("⚠️  " + strings.ToUpper(algorithm.Name()) + " is a legacy checksum and does not protect against tampering"))
+	}
+	if offer.Info.Sync {
+		fmt.Println(utils.InfoColor("🔄 Updates your copy of"), utils.InfoColor(filepath.Base(offer.Info.Name)), utils.InfoColor("with only the files that differ"))
+		if offer.Info.Mirror {
+			fmt.Println(utils.WarningColor("⚠️  Files in your copy that the sender no longer has will be deleted"))
+		}
+	}
+	if offset := resumableOffset(shareRoot, offer.Info); offset > 0 {
+		fmt.Println(utils.InfoColor("💾 Resumes an earlier attempt:"), utils.InfoColor(helper.FormatSize(offset)), utils.InfoColor("already received"))
+	}
+
+	if autoAccepted {
+		fmt.Println(utils.SuccessColor("✅ Accepted automatically by your auto-accept policy"))
+		acceptOffer(conn, offer, "")
+		return
+	}
+
+	fmt.Printf("   %s to accept, %s to decline\n",
+		utils.CommandColor("/accept "+offer.Info.Id+" [newName]"),
+		utils.CommandColor("/decline "+offer.Info.Id))
+}
+
+// HandleAcceptOffer handles the /accept command
+func HandleAcceptOffer(conn net.Conn, transferID, newName string) {
+	if newName != "" {
+		base := filepath.Base(newName)
+		if base != newName || base == "." || base == ".." {
+			fmt.Println(utils.ErrorColor("❌ New name must be a plain file name without directories"))
+			return
+		}
+	}
+
+	offer := takeOffer(transferID)
+	if offer == nil {
+		fmt.Println(utils.ErrorColor("❌ No pending offer with ID"), utils.CommandColor(transferID))
+		return
+	}
+	acceptOffer(conn, offer, newName)
+}
+
+// HandleDeclineOffer handles the /decline command
+func HandleDeclineOffer(conn net.Conn, transferID, reason string) {
+	offer := takeOffer(transferID)
+	if offer == nil {
+		fmt.Println(utils.ErrorColor("❌ No pending offer with ID"), utils.CommandColor(transferID))
+		return
+	}
+	answerOffer(conn, offer, protocol.MsgTransferDecline, reason)
+	fmt.Println(utils.InfoColor("🚫 Declined transfer"), utils.CommandColor(transferID))
+}
+
+// HandleListOffers handles the /offers command
+func HandleListOffers() {
+	offersMutex.Lock()
+	defer offersMutex.Unlock()
+
+	if len(pendingOffers) == 0 {
+		fmt.Println(utils.InfoColor("📨 No pending offers"))
+		return
+	}
+
+	fmt.Println(utils.HeaderColor("📨 Pending Offers:"))
+	fmt.Println(utils.InfoColor("-----------------------------------"))
+	for id, offer := range pendingOffers {
+		fmt.Printf("  %s %s from %s (%s, expires in %s)\n",
+			utils.CommandColor("ID: "+id),
+			utils.InfoColor(offer.Info.Name),
+			utils.UserColor(offer.SenderName),
+			helper.FormatSize(offer.Info.Size),
+			formatDuration(time.Until(offer.ReceivedAt.Add(offerLifetime))))
+	}
+	fmt.Println(utils.InfoColor("-----------------------------------"))
+}
+
+// HandleTrustUser handles /trust and /untrust, changing who is auto-accepted
+func HandleTrustUser(user string, trusted bool) {
+	offersMutex.Lock()
+	defer offersMutex.Unlock()
+	if trusted {
+		autoAccept.TrustedUsers[user] = true
+		fmt.Println(utils.SuccessColor("🤝 Offers from"), utils.UserColor(user), utils.SuccessColor("will be accepted automatically"))
+	} else {
+		delete(autoAccept.TrustedUsers, user)
+		fmt.Println(utils.InfoColor("🔒 Offers from"), utils.UserColor(user), utils.InfoColor("will need your approval"))
+	}
+}
+
+// takeOffer removes and returns a pending offer, dropping it if the server has
+// already given up on it
+func takeOffer(transferID string) *transferOffer {
+	offersMutex.Lock()
+	defer offersMutex.Unlock()
+	for id, offer := range pendingOffers {
+		if time.Since(offer.ReceivedAt) > offerLifetime {
+			delete(pendingOffers, id)
+		}
+	}
+	offer, exists := pendingOffers[transferID]
+	if !exists {
+		return nil
+	}
+	delete(pendingOffers, transferID)
+	return offer
+}
+
+// acceptOffer starts receiving before telling the server, so the sender can
+// never connect to us before we are listening for it
+func acceptOffer(conn net.Conn, offer *transferOffer, newName string) {
+	info := offer.Info
+	if newName != "" {
+		info.Name = newName
+	}
+
+	incoming, err := acceptTransfer(conn, offer)
+	if err != nil {
+		return
+	}
+
+	// Whatever arrives lands in our own store folder, never where the server says
+	if offer.IsFolder {
+		go HandleFolderTransfer(offer.Sender, info, shareRoot, incoming)
+	} else {
+		go HandleFileTransfer(offer.Sender, info, shareRoot, incoming)
+	}
+}
+
+// acceptTransfer registers for an offered transfer and accepts it, answering
+// with the public half of a key pair made for this transfer alone
+func acceptTransfer(conn net.Conn, offer *transferOffer) (*incomingTransfer, error) {
+	transferKeys, err := helper.GenerateKeyPair()
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error creating transfer key:"), err)
+		answerOffer(conn, offer, protocol.MsgTransferDecline, "could not create an encryption key")
+		return nil, err
+	}
+	incoming := expectIncomingTransfer(offer, transferKeys)
+	err = protocol.WriteMessage(conn, protocol.Message{
+		Type:      protocol.MsgTransferAccept,
+		PeerToken: offer.PeerToken,
+		PublicKey: transferKeys.PublicKey(),
+	})
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error answering transfer offer:"), err)
+		takeIncomingTransfer(offer.PeerToken)
+		return nil, err
+	}
+	return incoming, nil
+}
+
+func answerOffer(conn net.Conn, offer *transferOffer, answer protocol.MessageType, reason string) error {
+	err := protocol.WriteMessage(conn, protocol.Message{
+		Type:      answer,
+		PeerToken: offer.PeerToken,
+		Text:      reason,
+	})
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error answering transfer offer:"), err)
+	}
+	return err
+}
+
+// availablePath returns path, or the first "name (n).ext" next to it that does
+// not exist yet. Use claimPath to move something there without a race.
+func availablePath(path string) string {
+	if _, err := os.Lstat(path); os.IsNotExist(err) {
+		return path
+	}
+	ext := filepath.Ext(path)
+	stem := strings.TrimSuffix(path, ext)
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s (%d)%s", stem, i, ext)
+		if _, err := os.Lstat(candidate); os.IsNotExist(err) {
+			return candidate
+		}
+	}
+}
+
+// claimPath moves source, a finished file or folder, to path or else the
+// first "name (n).ext" next to it that is free at that moment. Each name is
+// claimed with an exclusive create before anything is moved there, so
+// accepted transfers never overwrite existing files, even ones that appeared
+// while the transfer ran. It returns where source ended up.
+func claimPath(source, path string) (string, error) {
+	info, err := os.Lstat(source)
+	if err != nil {
+		return "", err
+	}
+	ext := filepath.Ext(path)
+	stem := strings.TrimSuffix(path, ext)
+	candidate := path
+	for i := 1; ; i++ {
+		err := claimName(candidate, info.IsDir())
+		if err == nil {
+			if info.IsDir() {
+				return candidate, moveInto(source, candidate)
+			}
+			// Only our own empty placeholder is replaced
+			if err := os.Rename(source, candidate); err != nil {
+				os.Remove(candidate)
+				return "", err
+			}
+			return candidate, nil
+		}
+		if !os.IsExist(err) {
+			return "", err
+		}
+		candidate = fmt.Sprintf("%s (%d)%s", stem, i, ext)
+	}
+}
+
+// moveInto moves what the folder source holds into dir, a new empty folder
+// of ours, and removes source. A folder cannot be renamed onto another.
+func moveInto(source, dir string) error {
+	entries, err := os.ReadDir(source)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := os.Rename(filepath.Join(source, entry.Name()), filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return os.Remove(source)
+}
+
+// claimName creates an empty file, or folder, at path unless something is
+// already there
+func claimName(path string, dir bool) error {
+	if dir {
+		return os.Mkdir(path, 0755)
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
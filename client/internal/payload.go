@@ -0,0 +1,274 @@
+package connection
+
+import (
+	"drizlink/protocol"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// partialFile is where an incoming payload is written: a single file, or the
+// files of a folder
+type partialFile interface {
+	io.Writer
+	io.ReaderAt
+	io.WriterAt
+	Sync() error
+	Close() error
+}
+
+// folderPayload presents the files of a folder manifest as one stream, their
+// contents back to back in manifest order. Senders read it and receivers write
+// it at any offset, so folders are chunked, verified and resumed exactly like
+// single files, without ever being archived. Only one file is open at a time.
+type folderPayload struct {
+	root     string
+	dirs     []protocol.DirEntry
+	files    []protocol.DirEntry
+	starts   []int64
+	size     int64
+	writable bool
+
+	current *os.File
+	index   int
+	// offset is where sequential Read and Write continue
+	offset int64
+}
+
+// newFolderPayload lays out manifest below root. Receivers pass writable and
+// then call prepare before writing.
+func newFolderPayload(root string, manifest []protocol.DirEntry, writable bool) *folderPayload {
+	payload := &folderPayload{root: root, writable: writable}
+	for _, entry := range manifest {
+		if entry.Deleted {
+			continue
+		}
+		if entry.IsDir {
+			payload.dirs = append(payload.dirs, entry)
+			continue
+		}
+		payload.files = append(payload.files, entry)
+		payload.starts = append(payload.starts, payload.size)
+		payload.size += entry.Size
+	}
+	return payload
+}
+
+// prepare creates every folder and file of the manifest, keeping what an
+// earlier attempt wrote before offset. It returns the offset that is actually
+// on disk, rounded down to a chunk boundary.
+func (payload *folderPayload) prepare(offset int64) (int64, error) {
+	if offset < 0 || offset > payload.size {
+		offset = 0
+	}
+	if err := os.MkdirAll(payload.root, 0755); err != nil {
+		return 0, err
+	}
+	for _, dir := range payload.dirs {
+		if err := os.MkdirAll(payload.path(dir), 0755); err != nil {
+			return 0, err
+		}
+	}
+
+	// The journal only confirms synced bytes, but a file may have been removed
+	for i, file := range payload.files {
+		have := int64(0)
+		if info, err := os.Lstat(payload.path(file)); err == nil && info.Mode().IsRegular() {
+			have = info.Size()
+		}
+		if have < payload.expected(i, offset) {
+			offset = payload.starts[i] + have
+			break
+		}
+	}
+	if offset != payload.size {
+		offset -= offset % protocol.ChunkSize
+	}
+
+	for i, file := range payload.files {
+		perm := os.FileMode(0644)
+		if file.Executable {
+			perm = 0755
+		}
+		name := payload.path(file)
+		if info, err := os.Lstat(name); err == nil && !info.Mode().IsRegular() {
+			if err := os.RemoveAll(name); err != nil {
+				return 0, err
+			}
+		}
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			return 0, err
+		}
+		handle, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, perm)
+		if err != nil {
+			return 0, err
+		}
+		err = handle.Truncate(payload.expected(i, offset))
+		if closeErr := handle.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	payload.offset = offset
+	return offset, nil
+}
+
+// restoreTimes gives every received file the modification time it has on
+// the sender, so a later sync can tell it is unchanged without hashing it
+func (payload *folderPayload) restoreTimes() error {
+	for _, file := range payload.files {
+		if file.ModTime == 0 {
+			continue
+		}
+		modTime := time.Unix(0, file.ModTime)
+		if err := os.Chtimes(payload.path(file), modTime, modTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expected is how much of file i lies before offset
+func (payload *folderPayload) expected(i int, offset int64) int64 {
+	part := offset - payload.starts[i]
+	if part < 0 {
+		return 0
+	}
+	if part > payload.files[i].Size {
+		return payload.files[i].Size
+	}
+	return part
+}
+
+// ReadAt implements io.ReaderAt
+func (payload *folderPayload) ReadAt(p []byte, off int64) (int, error) {
+	return payload.transfer(p, off, false)
+}
+
+// WriteAt implements io.WriterAt
+func (payload *folderPayload) WriteAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > payload.size {
+		return 0, fmt.Errorf("write past the end of the folder")
+	}
+	return payload.transfer(p, off, true)
+}
+
+// Read implements io.Reader
+func (payload *folderPayload) Read(p []byte) (int, error) {
+	n, err := payload.ReadAt(p, payload.offset)
+	payload.offset += int64(n)
+	return n, err
+}
+
+// Write implements io.Writer
+func (payload *folderPayload) Write(p []byte) (int, error) {
+	n, err := payload.WriteAt(p, payload.offset)
+	payload.offset += int64(n)
+	return n, err
+}
+
+// Sync flushes the open file; files are synced as they are closed
+func (payload *folderPayload) Sync() error {
+	if payload.current == nil || !payload.writable {
+		return nil
+	}
+	return payload.current.Sync()
+}
+
+// Close closes the open file
+func (payload *folderPayload) Close() error {
+	return payload.release()
+}
+
+// transfer reads or writes p at off, crossing file boundaries as needed
+func (payload *folderPayload) transfer(p []byte, off int64, write bool) (int, error) {
+	if off >= payload.size && len(p) > 0 {
+		return 0, io.EOF
+	}
+	done := 0
+	for len(p) > 0 && off < payload.size {
+		// The first file that ends after off; empty files never do
+		i := sort.Search(len(payload.files), func(i int) bool {
+			return payload.starts[i]+payload.files[i].Size > off
+		})
+		within := off - payload.starts[i]
+		part := p
+		if remaining := payload.files[i].Size - within; int64(len(part)) > remaining {
+			part = part[:remaining]
+		}
+
+		handle, err := payload.open(i)
+		if err != nil {
+			return done, err
+		}
+		var n int
+		if write {
+			n, err = handle.WriteAt(part, within)
+		} else {
+			n, err = handle.ReadAt(part, within)
+			if err == io.EOF && n == len(part) {
+				err = nil
+			} else if err == io.EOF {
+				err = fmt.Errorf("%s changed while being sent", payload.files[i].Path)
+			}
+		}
+		done += n
+		off += int64(n)
+		p = p[n:]
+		if err != nil {
+			return done, err
+		}
+	}
+	if len(p) > 0 {
+		return done, io.EOF
+	}
+	return done, nil
+}
+
+// open returns file i, closing the one opened before
+func (payload *folderPayload) open(i int) (*os.File, error) {
+	if payload.current != nil && payload.index == i {
+		return payload.current, nil
+	}
+	if err := payload.release(); err != nil {
+		return nil, err
+	}
+	var handle *os.File
+	var err error
+	if payload.writable {
+		handle, err = os.OpenFile(payload.path(payload.files[i]), os.O_RDWR, 0)
+	} else {
+		handle, err = os.Open(payload.path(payload.files[i]))
+	}
+	if err != nil {
+		return nil, err
+	}
+	payload.current, payload.index = handle, i
+	return handle, nil
+}
+
+// release syncs and closes the open file
+func (payload *folderPayload) release() error {
+	if payload.current == nil {
+		return nil
+	}
+	var err error
+	if payload.writable {
+		err = payload.current.Sync()
+	}
+	if closeErr := payload.current.Close(); err == nil {
+		err = closeErr
+	}
+	payload.current = nil
+	return err
+}
+
+// path is where entry lives on disk
+func (payload *folderPayload) path(entry protocol.DirEntry) string {
+	return filepath.Join(payload.root, filepath.FromSlash(entry.Path))
+}
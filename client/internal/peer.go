@@ -0,0 +1,178 @@
+package connection
+
+import (
+	"crypto/tls"
+	"drizlink/helper"
+	"drizlink/protocol"
+	"drizlink/utils"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// PeerDialTimeout bounds how long a sender tries to reach the recipient directly
+// before falling back to the server relay
+const PeerDialTimeout = 3 * time.Second
+
+var (
+	// incomingTransfers are the transfers we are about to receive, keyed by the
+	// peer token the server issued for them
+	incomingTransfers      = make(map[string]*incomingTransfer)
+	incomingTransfersMutex sync.Mutex
+)
+
+// incomingTransfer tracks the two ways a payload can reach us: a sender
+// connecting straight to our peer listener, or the server relay
+type incomingTransfer struct {
+	transferID string
+	peerToken  string
+	senderKey  string
+	// senderTransferKey and transferKeys are the two sides' key pairs made
+	// for this transfer alone
+	senderTransferKey string
+	transferKeys      *helper.KeyPair
+	direct            chan net.Conn
+	relay             chan string
+}
+
+// StartPeerListener accepts direct transfers from other peers on port (0 picks a
+// free one) and tells the server where to find us. The listener uses a fresh
+// self-signed certificate whose fingerprint reaches senders through the server.
+func StartPeerListener(conn net.Conn, port int) error {
+	cert, err := helper.NewSelfSignedCertificate()
+	if err != nil {
+		return err
+	}
+	tcpListener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return err
+	}
+	listener := tls.NewListener(tcpListener, &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12})
+
+	go func() {
+		for {
+			peerConn, err := listener.Accept()
+			if err != nil {
+				fmt.Println(utils.ErrorColor("❌ Peer listener stopped:"), err)
+				return
+			}
+			go handlePeerConnection(peerConn)
+		}
+	}()
+
+	port = tcpListener.Addr().(*net.TCPAddr).Port
+	err = protocol.WriteMessage(conn, protocol.Message{
+		Type:            protocol.MsgPeerAnnounce,
+		PeerPort:        port,
+		PeerFingerprint: helper.LeafFingerprint(cert),
+	})
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	return nil
+}
+
+// handlePeerConnection accepts a sender's direct data channel if it presents the
+// token of a transfer we are waiting for
+func handlePeerConnection(conn net.Conn) {
+	hello, err := protocol.ServerHandshake(conn)
+	if err != nil || hello.Type != protocol.MsgAttach {
+		conn.Close()
+		return
+	}
+
+	incoming := takeIncomingTransfer(hello.Token)
+	if incoming == nil {
+		protocol.WriteMessage(conn, protocol.Message{Type: protocol.MsgError, Code: protocol.CodeInvalidToken, Text: "unknown or expired transfer token"})
+		conn.Close()
+		return
+	}
+
+	if err := protocol.WriteMessage(conn, protocol.Message{Type: protocol.MsgWelcome, Version: protocol.Version}); err != nil {
+		conn.Close()
+		return
+	}
+	incoming.direct <- conn
+}
+
+// deliverRelayToken hands the server's relay token to a transfer whose sender
+// could not reach us directly
+func deliverRelayToken(msg protocol.Message) {
+	if incoming := takeIncomingTransfer(msg.PeerToken); incoming != nil {
+		incoming.relay <- msg.Token
+	}
+}
+
+// takeIncomingTransfer removes and returns the transfer registered for a peer
+// token. Tokens are single use, so only the first delivery path wins.
+func takeIncomingTransfer(peerToken string) *incomingTransfer {
+	incomingTransfersMutex.Lock()
+	defer incomingTransfersMutex.Unlock()
+	incoming, exists := incomingTransfers[peerToken]
+	if !exists {
+		return nil
+	}
+	delete(incomingTransfers, peerToken)
+	return incoming
+}
+
+// expectIncomingTransfer registers for both delivery paths of a transfer. It must
+// be called before the control loop reads its next message, so neither the
+// sender's direct connection nor the server's relay token can be missed.
+func expectIncomingTransfer(offer *transferOffer, transferKeys *helper.KeyPair) *incomingTransfer {
+	incoming := &incomingTransfer{
+		transferID:        offer.Info.Id,
+		peerToken:         offer.PeerToken,
+		senderKey:         offer.SenderKey,
+		senderTransferKey: offer.Info.TransferKey,
+		transferKeys:      transferKeys,
+		direct:            make(chan net.Conn, 1),
+		relay:             make(chan string, 1),
+	}
+	incomingTransfersMutex.Lock()
+	incomingTransfers[offer.PeerToken] = incoming
+	incomingTransfersMutex.Unlock()
+	return incoming
+}
+
+// accept waits for the sender to connect directly or for the server to hand
+// out a relay token, whichever comes first
+func (incoming *incomingTransfer) accept() (net.Conn, error) {
+	select {
+	case conn := <-incoming.direct:
+		fmt.Println(utils.SuccessColor("🔗 Sender connected directly"))
+		return conn, nil
+	case token := <-incoming.relay:
+		fmt.Println(utils.InfoColor("🔁 Receiving through the server relay"))
+		return openDataChannel(token)
+	case <-time.After(TransferReadyTimeout):
+		takeIncomingTransfer(incoming.peerToken)
+		return nil, fmt.Errorf("sender did not connect for transfer %s in time", incoming.transferID)
+	}
+}
+
+// dialTransfer opens the sender's data channel: straight to the recipient when
+// the server knows its peer address and certificate, through the relay otherwise
+func dialTransfer(ready protocol.Message) (net.Conn, error) {
+	if ready.PeerAddr != "" && ready.PeerFingerprint != "" {
+		config := &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			// Peers use self-signed certificates, vouched for by the server
+			InsecureSkipVerify: true,
+			VerifyConnection:   helper.VerifyFingerprint(ready.PeerFingerprint),
+		}
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: PeerDialTimeout}, "tcp", ready.PeerAddr, config)
+		if err == nil {
+			err = protocol.AttachDataChannel(conn, ready.PeerToken)
+			if err == nil {
+				fmt.Println(utils.SuccessColor("🔗 Connected directly to recipient"))
+				return conn, nil
+			}
+			conn.Close()
+		}
+		fmt.Println(utils.WarningColor("⚠️  Direct connection failed, using server relay:"), err)
+	}
+	return openDataChannel(ready.Token)
+}
@@ -0,0 +1,880 @@
+package connection
+
+import (
+	"crypto/sha256"
+	"drizlink/helper"
+	"drizlink/protocol"
+	"drizlink/utils"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultSyncInterval is how often a synced folder is checked for changes
+const DefaultSyncInterval = 3 * time.Second
+
+// syncRetryDelay is how long a member is left alone after it declined an
+// update, or the server refused one, e.g. for the room's file policy
+const syncRetryDelay = time.Minute
+
+// dirState stands for a folder where a sync state holds a file's hash
+const dirState = "/"
+
+// roomSync is a folder kept the same for every member of a room who syncs it.
+// Each side polls its folder and sends what changed to the others as an
+// incremental folder transfer, deletions included.
+type roomSync struct {
+	RoomId   string
+	RoomName string
+	Dir      string
+
+	conn      net.Conn
+	stop      chan struct{}
+	statePath string
+
+	// applying lets one update at a time into the folder, so each is decided
+	// against the one before. It is held while scanning and moving files;
+	// mutex only guards the state below and is never held that long.
+	applying sync.Mutex
+
+	mutex sync.Mutex
+	peers map[string]*syncPeer
+	// members are the room's other online participants who sync it, as last
+	// told by the server
+	members map[string]string
+	// greeted peers have exchanged an update with us since /sync started
+	greeted  map[string]bool
+	local    map[string]string
+	scanning bool
+
+	lastChange time.Time
+	lastError  string
+	sent       int
+	received   int
+	conflicts  int
+}
+
+// syncPeer is what one other member was last known to have
+type syncPeer struct {
+	Username string `json:"username"`
+	// Base maps each path to its state as last exchanged with the peer: the
+	// contents' hash for files, dirState for folders. A path changed on only
+	// one side since then is simply copied; one changed on both is a conflict.
+	Base map[string]string `json:"base"`
+
+	retryAt   time.Time
+	pushing   bool
+	receiving bool
+}
+
+// syncStateFile is what a synced folder remembers across restarts
+type syncStateFile struct {
+	Room  string               `json:"room"`
+	Peers map[string]*syncPeer `json:"peers"`
+}
+
+// syncAction is what an incoming entry does to our copy
+type syncAction int
+
+const (
+	syncKeep syncAction = iota
+	syncTake
+	syncConflict
+)
+
+var (
+	// roomSyncs are keyed by room ID; a room is synced into one folder at most
+	roomSyncs      = make(map[string]*roomSync)
+	roomSyncsMutex sync.Mutex
+
+	syncInterval = DefaultSyncInterval
+)
+
+// SetSyncInterval sets how often synced folders are checked for changes
+func SetSyncInterval(interval time.Duration) {
+	if interval > 0 {
+		syncInterval = interval
+	}
+}
+
+// HandleStartSync handles the /sync command
+func HandleStartSync(conn net.Conn, roomId, localDir string) {
+	dir, err := filepath.Abs(localDir)
+	if err == nil {
+		err = os.MkdirAll(dir, 0755)
+	}
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error opening folder:"), err)
+		return
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		fmt.Println(utils.ErrorColor("❌ Not a folder:"), dir)
+		return
+	}
+
+	roomSyncsMutex.Lock()
+	defer roomSyncsMutex.Unlock()
+	if existing, exists := roomSyncs[roomId]; exists {
+		fmt.Println(utils.ErrorColor("❌ Room"), utils.InfoColor(roomId), utils.ErrorColor("is already synced with"), utils.InfoColor(existing.Dir))
+		return
+	}
+	for _, existing := range roomSyncs {
+		if existing.Dir == dir {
+			fmt.Println(utils.ErrorColor("❌"), utils.InfoColor(dir), utils.ErrorColor("is already synced with room"), utils.InfoColor(existing.RoomId))
+			return
+		}
+	}
+
+	rs := &roomSync{
+		RoomId:    roomId,
+		Dir:       dir,
+		conn:      conn,
+		stop:      make(chan struct{}),
+		statePath: syncStatePath(dir, roomId),
+		peers:     make(map[string]*syncPeer),
+		members:   make(map[string]string),
+		greeted:   make(map[string]bool),
+	}
+	if err := rs.load(); err != nil {
+		fmt.Println(utils.WarningColor("⚠️  Could not read earlier sync state, starting afresh:"), err)
+	}
+	roomSyncs[roomId] = rs
+	go rs.run()
+
+	fmt.Println(utils.SuccessColor("🔄 Syncing"), utils.InfoColor(dir), utils.SuccessColor("with room"), utils.InfoColor(roomId))
+	fmt.Println(utils.InfoColor("   Changes are checked every"), utils.InfoColor(syncInterval.String()), utils.InfoColor("; see"), utils.CommandColor("/transfers"), utils.InfoColor("for status"))
+}
+
+// HandleStopSync handles the /unsync command
+func HandleStopSync(roomId string) {
+	roomSyncsMutex.Lock()
+	rs, exists := roomSyncs[roomId]
+	delete(roomSyncs, roomId)
+	roomSyncsMutex.Unlock()
+
+	if !exists {
+		fmt.Println(utils.ErrorColor("❌ Room"), utils.InfoColor(roomId), utils.ErrorColor("is not being synced"))
+		return
+	}
+	close(rs.stop)
+	// Other members stop sending us updates
+	err := protocol.WriteMessage(rs.conn, protocol.Message{Type: protocol.MsgRoomMembers, RoomId: roomId, Status: protocol.SyncStopped})
+	if err != nil {
+		fmt.Println(utils.WarningColor("⚠️  Could not tell the server:"), err)
+	}
+	fmt.Println(utils.InfoColor("⏹️  Stopped syncing"), utils.InfoColor(rs.Dir), utils.InfoColor("with room"), utils.InfoColor(roomId))
+}
+
+// lookupRoomSync returns the sync of roomId, or nil
+func lookupRoomSync(roomId string) *roomSync {
+	roomSyncsMutex.Lock()
+	defer roomSyncsMutex.Unlock()
+	return roomSyncs[roomId]
+}
+
+// syncStatePath is where the state of dir's sync with roomId is kept, next
+// to the partial transfers inside the folder
+func syncStatePath(dir, roomId string) string {
+	sum := sha256.Sum256([]byte(roomId))
+	return filepath.Join(dir, partialDirName, "sync-"+hex.EncodeToString(sum[:8])+".json")
+}
+
+// run announces the sync to the server once per interval, which answers with
+// the members syncing the room too; each answer starts a scan for changes
+// to send
+func (rs *roomSync) run() {
+	ticker := time.NewTicker(syncInterval)
+	defer ticker.Stop()
+	for {
+		err := protocol.WriteMessage(rs.conn, protocol.Message{Type: protocol.MsgRoomMembers, RoomId: rs.RoomId, Status: protocol.SyncActive})
+		if err != nil {
+			rs.setError(err)
+		}
+		select {
+		case <-rs.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// deliverRoomMembers hands the server's list of online members syncing the
+// room to the room's sync, or stops the sync if we may no longer take part
+func deliverRoomMembers(msg protocol.Message) {
+	rs := lookupRoomSync(msg.RoomId)
+	if rs == nil {
+		return
+	}
+	if msg.Text != "" {
+		roomSyncsMutex.Lock()
+		if roomSyncs[msg.RoomId] == rs {
+			delete(roomSyncs, msg.RoomId)
+			close(rs.stop)
+		}
+		roomSyncsMutex.Unlock()
+		fmt.Println(utils.ErrorColor("⏹️  Stopped syncing room"), utils.InfoColor(msg.RoomId+":"), utils.ErrorColor(msg.Text))
+		return
+	}
+
+	rs.mutex.Lock()
+	rs.RoomName = msg.RoomName
+	rs.members = make(map[string]string, len(msg.Users))
+	for _, user := range msg.Users {
+		rs.members[user.UserId] = user.Username
+	}
+	rs.mutex.Unlock()
+	go rs.pushChanges()
+}
+
+// pushChanges scans the folder and sends it to every member whose last known
+// state differs from it. Only one scan runs at a time, and only one update
+// is sent to each member at a time.
+func (rs *roomSync) pushChanges() {
+	rs.mutex.Lock()
+	if rs.scanning {
+		rs.mutex.Unlock()
+		return
+	}
+	rs.scanning = true
+	rs.mutex.Unlock()
+
+	manifest, fingerprint, err := buildManifest(rs.Dir, true)
+
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	rs.scanning = false
+	if err != nil {
+		rs.setErrorLocked(err)
+		return
+	}
+	rs.local = syncStates(manifest)
+
+	for userId, username := range rs.members {
+		peer := rs.peerLocked(userId, username)
+		if peer.pushing || peer.receiving || time.Now().Before(peer.retryAt) {
+			continue
+		}
+		if rs.greeted[userId] && sameStates(peer.Base, rs.local) {
+			continue
+		}
+		peer.pushing = true
+		go rs.push(userId, peer, manifest, fingerprint, rs.local)
+	}
+}
+
+// push sends our folder to one member: the manifest lists every entry plus
+// those deleted since the last exchange, and the member asks for the files
+// it takes
+func (rs *roomSync) push(userId string, peer *syncPeer, manifest []protocol.DirEntry, fingerprint string, local map[string]string) {
+	defer func() {
+		rs.mutex.Lock()
+		peer.pushing = false
+		rs.mutex.Unlock()
+	}()
+
+	rs.mutex.Lock()
+	deletions := deletedEntries(peer.Base, local)
+	username := peer.Username
+	rs.mutex.Unlock()
+	entries := append(append([]protocol.DirEntry{}, manifest...), deletions...)
+
+	transferKeys, err := helper.GenerateKeyPair()
+	if err != nil {
+		rs.setError(err)
+		return
+	}
+	info := protocol.TransferInfo{
+		Id:                GenerateTransferID(),
+		Name:              filepath.Base(rs.Dir),
+		Size:              manifestSize(manifest),
+		ChecksumAlgorithm: checksumAlgorithm,
+		Fingerprint:       fingerprint,
+		Sync:              true,
+		Room:              rs.RoomId,
+		Extensions:        manifestTypes(manifest),
+		TransferKey:       transferKeys.PublicKey(),
+	}
+	replies := awaitTransferReply(info.Id)
+	err = protocol.WriteMessage(rs.conn, protocol.Message{Type: protocol.MsgFolderRequest, Target: userId, Transfer: &info})
+	if err != nil {
+		rs.setError(err)
+		return
+	}
+
+	// A member may decline if it stopped syncing since the server last told
+	// us, and the server refuses what the room's file policy does not allow
+	ready, err := waitForTransferReady(info.Id, replies)
+	if err != nil {
+		rs.mutex.Lock()
+		peer.retryAt = time.Now().Add(syncRetryDelay)
+		rs.mutex.Unlock()
+		rs.setError(fmt.Errorf("update for %s not sent: %v", username, err))
+		return
+	}
+
+	sealer, err := sendingCipher(ready, transferKeys)
+	if err != nil {
+		rs.setError(err)
+		return
+	}
+	dataConn, err := dialTransfer(ready)
+	if err != nil {
+		rs.setError(err)
+		return
+	}
+	defer dataConn.Close()
+
+	var needed []protocol.DirEntry
+	err = sendManifest(dataConn, entries, sealer, helper.SealManifest)
+	if err == nil {
+		needed, err = readNeededEntries(dataConn, sealer, manifest)
+	}
+	payload := newFolderPayload(rs.Dir, needed, false)
+	defer payload.Close()
+
+	var offset int64
+	if err == nil {
+		offset, err = readResumeOffset(dataConn, payload.size)
+	}
+	if err != nil {
+		rs.setError(fmt.Errorf("sending to %s: %v", username, err))
+		return
+	}
+
+	transfer := &Transfer{
+		ID:            info.Id,
+		Type:          FolderTransfer,
+		Name:          info.Name + " (room sync)",
+		Size:          payload.size,
+		BytesComplete: offset,
+		Status:        Active,
+		Direction:     "send",
+		Recipient:     userId,
+		Path:          rs.Dir,
+		StartTime:     time.Now(),
+		Connection:    dataConn,
+		Sync:          true,
+	}
+	RegisterTransfer(transfer)
+	defer RemoveTransfer(info.Id)
+
+	reader := NewCheckpointedReader(io.NewSectionReader(payload, offset, payload.size-offset), transfer, 32768)
+	reader.BytesRead = offset
+	if _, err := sendChunks(dataConn, reader, payload, offset, payload.size, info.ChecksumAlgorithm, sealer); err != nil {
+		// The next scan sends again and the member's journal resumes it
+		rs.setError(fmt.Errorf("sending to %s: %v", username, err))
+		return
+	}
+
+	// The member now has our version of every path, or knowingly kept its own
+	rs.mutex.Lock()
+	peer.Base = local
+	rs.greeted[userId] = true
+	rs.lastError = ""
+	if len(needed) > 0 || len(deletions) > 0 {
+		rs.lastChange = time.Now()
+		rs.sent++
+	}
+	rs.saveLocked()
+	rs.mutex.Unlock()
+
+	if len(needed) > 0 || len(deletions) > 0 {
+		fmt.Printf("%s Sent %d changed and %d deleted entries of %s to %s\n",
+			utils.InfoColor("🔄"),
+			len(needed),
+			len(deletions),
+			utils.InfoColor(filepath.Base(rs.Dir)),
+			utils.UserColor(username))
+	}
+}
+
+// handleSyncOffer accepts an update of a room we sync without asking, since
+// /sync already agreed to them, and declines it for any other room
+func handleSyncOffer(conn net.Conn, offer *transferOffer) {
+	rs := lookupRoomSync(offer.Info.Room)
+	if rs == nil || !offer.IsFolder {
+		answerOffer(conn, offer, protocol.MsgTransferDecline, "not syncing room "+offer.Info.Room)
+		return
+	}
+
+	rs.mutex.Lock()
+	peer := rs.peerLocked(offer.Sender, offer.SenderName)
+	peer.retryAt = time.Time{}
+	peer.receiving = true
+	rs.greeted[offer.Sender] = true
+	rs.mutex.Unlock()
+
+	incoming, err := acceptTransfer(conn, offer)
+	if err != nil {
+		rs.mutex.Lock()
+		peer.receiving = false
+		rs.mutex.Unlock()
+		return
+	}
+	go rs.receive(offer, peer, incoming)
+}
+
+// receive takes one member's update: it compares the member's manifest with
+// our folder and what we last exchanged, asks for the files we take, and
+// applies them once all have arrived
+func (rs *roomSync) receive(offer *transferOffer, peer *syncPeer, incoming *incomingTransfer) {
+	defer func() {
+		rs.mutex.Lock()
+		peer.receiving = false
+		rs.mutex.Unlock()
+	}()
+	info := offer.Info
+
+	dataConn, err := incoming.accept()
+	if err != nil {
+		rs.setError(err)
+		return
+	}
+	defer dataConn.Close()
+
+	opener, err := receivingCipher(incoming)
+	if err != nil {
+		rs.setError(err)
+		return
+	}
+
+	// Every path and size is checked before anything is written
+	manifest, err := readManifest(dataConn, opener, helper.SealManifest)
+	if err == nil {
+		err = checkManifest(manifest, info)
+	}
+	var needed []protocol.DirEntry
+	if err == nil {
+		needed, err = rs.plan(peer, manifest)
+	}
+	if err == nil {
+		err = sendManifest(dataConn, needed, opener, helper.SealManifestReply)
+	}
+	if err != nil {
+		rs.setError(fmt.Errorf("update from %s refused: %v", offer.SenderName, err))
+		return
+	}
+
+	// Files arrive in a partial folder inside the synced one, so they can be
+	// moved into place and an interrupted update resumes
+	partialInfo := syncPartialInfo(info, needed)
+	journal, payload, err := openFolderPartial(rs.Dir, partialInfo, needed)
+	if err != nil {
+		rs.setError(err)
+		return
+	}
+	offset := journal.Offset
+	partial := newJournalWriter(payload, journal)
+	if err := sendResumeOffset(dataConn, info.Id, offset); err != nil {
+		partial.Close()
+		rs.setError(err)
+		return
+	}
+
+	transfer := &Transfer{
+		ID:            info.Id,
+		Type:          FolderTransfer,
+		Name:          filepath.Base(rs.Dir) + " (room sync)",
+		Size:          partialInfo.Size,
+		BytesComplete: offset,
+		Status:        Active,
+		Direction:     "receive",
+		Recipient:     offer.Sender,
+		Path:          journal.partialPath,
+		StartTime:     time.Now(),
+		Connection:    dataConn,
+		Sync:          true,
+	}
+	RegisterTransfer(transfer)
+	defer RemoveTransfer(info.Id)
+
+	writer := NewCheckpointedWriter(partial, transfer, 32768)
+	writer.BytesWritten = offset
+	checksum, receivedChecksum, err := receiveChunks(dataConn, writer, partial, offset, partialInfo.Size, io.Discard, info.ChecksumAlgorithm, opener)
+	if closeErr := partial.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && checksum != "" && !helper.VerifyChecksum(checksum, receivedChecksum) {
+		err = errors.New("checksum verification failed")
+	}
+	if err != nil {
+		rs.setError(fmt.Errorf("update from %s: %v", offer.SenderName, err))
+		return
+	}
+	if err := payload.restoreTimes(); err != nil {
+		fmt.Println(utils.WarningColor("⚠️  Could not restore modification times:"), err)
+	}
+
+	updated, deleted, conflicts, err := rs.apply(peer, journal.partialPath, manifest, needed)
+	journal.discard()
+	if err != nil {
+		rs.setError(fmt.Errorf("applying update from %s: %v", offer.SenderName, err))
+		return
+	}
+	if updated == 0 && deleted == 0 && len(conflicts) == 0 {
+		return
+	}
+	fmt.Printf("%s %s updated %d and deleted %d entries of %s\n",
+		utils.InfoColor("🔄"),
+		utils.UserColor(offer.SenderName),
+		updated,
+		deleted,
+		utils.InfoColor(filepath.Base(rs.Dir)))
+	for _, conflict := range conflicts {
+		fmt.Println(utils.WarningColor("⚠️  Conflict: changed here and by"), utils.UserColor(offer.SenderName+";"), utils.WarningColor("their version is saved as"), utils.InfoColor(conflict))
+	}
+}
+
+// plan lists the files of a member's manifest that we take, either in place
+// of ours or as a conflicting copy next to ours
+func (rs *roomSync) plan(peer *syncPeer, manifest []protocol.DirEntry) ([]protocol.DirEntry, error) {
+	current, _, err := buildManifest(rs.Dir, true)
+	if err != nil {
+		return nil, err
+	}
+	local := syncStates(current)
+
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	needed := []protocol.DirEntry{}
+	for _, entry := range manifest {
+		if entry.IsDir || entry.Deleted {
+			continue
+		}
+		if syncDecision(entry.Hash, local[entry.Path], peer.Base[entry.Path]) != syncKeep {
+			needed = append(needed, entry)
+		}
+	}
+	return needed, nil
+}
+
+// apply moves the received files from partialDir into the folder and removes
+// what the member deleted. Everything is decided again against the folder as
+// it is now, since it may have changed while the files arrived. It returns
+// how many entries were updated and deleted, and where conflicting copies
+// were saved.
+func (rs *roomSync) apply(peer *syncPeer, partialDir string, manifest, received []protocol.DirEntry) (int, int, []string, error) {
+	rs.applying.Lock()
+	defer rs.applying.Unlock()
+
+	current, _, err := buildManifest(rs.Dir, true)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	local := syncStates(current)
+	arrived := make(map[string]bool, len(received))
+	for _, entry := range received {
+		arrived[entry.Path] = true
+	}
+
+	rs.mutex.Lock()
+	base := make(map[string]string, len(peer.Base))
+	for entryPath, state := range peer.Base {
+		base[entryPath] = state
+	}
+	rs.mutex.Unlock()
+	updated, deleted := 0, 0
+	var conflicts []string
+	var removals []protocol.DirEntry
+
+	for _, entry := range manifest {
+		if entry.Deleted {
+			removals = append(removals, entry)
+			continue
+		}
+		incoming := syncState(entry)
+		action := syncDecision(incoming, local[entry.Path], base[entry.Path])
+		if entry.IsDir {
+			if action == syncTake {
+				if err := ensureDir(rs.Dir, entry.Path); err != nil {
+					return updated, deleted, conflicts, err
+				}
+			}
+			base[entry.Path] = incoming
+			continue
+		}
+		if action == syncKeep {
+			base[entry.Path] = incoming
+			continue
+		}
+		if !arrived[entry.Path] {
+			// Ours changed after we asked; the member gets it with our next update
+			base[entry.Path] = incoming
+			continue
+		}
+
+		source := filepath.Join(partialDir, filepath.FromSlash(entry.Path))
+		info, err := os.Lstat(source)
+		if err != nil {
+			return updated, deleted, conflicts, err
+		}
+		// A file that changed while it was sent is left for the member's next update
+		if hash, err := hashFile(source, info); err != nil || hash != entry.Hash {
+			continue
+		}
+		if err := ensureDir(rs.Dir, path.Dir(entry.Path)); err != nil {
+			return updated, deleted, conflicts, err
+		}
+		target := filepath.Join(rs.Dir, filepath.FromSlash(entry.Path))
+		if existing, err := os.Lstat(target); err == nil && existing.IsDir() {
+			action = syncConflict
+		}
+		if action == syncConflict {
+			if target, err = claimPath(source, conflictPath(target, peer.Username)); err != nil {
+				return updated, deleted, conflicts, err
+			}
+			conflicts = append(conflicts, target)
+		} else {
+			if err := os.Rename(source, target); err != nil {
+				return updated, deleted, conflicts, err
+			}
+			updated++
+		}
+		if moved, err := os.Lstat(target); err == nil {
+			rememberHash(target, moved, entry.Hash)
+		}
+		base[entry.Path] = incoming
+	}
+
+	// Deepest first, so folders are emptied before they are removed. What we
+	// changed since the last exchange is kept and sent back instead.
+	sort.Slice(removals, func(i, j int) bool { return removals[i].Path > removals[j].Path })
+	for _, entry := range removals {
+		if known := base[entry.Path]; known != "" && local[entry.Path] == known {
+			target := filepath.Join(rs.Dir, filepath.FromSlash(entry.Path))
+			if err := os.Remove(target); err == nil {
+				deleted++
+			} else if !os.IsNotExist(err) && known != dirState {
+				return updated, deleted, conflicts, err
+			}
+		}
+		delete(base, entry.Path)
+	}
+
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	peer.Base = base
+	rs.conflicts += len(conflicts)
+	if updated > 0 || deleted > 0 || len(conflicts) > 0 {
+		rs.lastChange = time.Now()
+		rs.received++
+	}
+	rs.lastError = ""
+	rs.saveLocked()
+	return updated, deleted, conflicts, nil
+}
+
+// syncDecision settles one path given the member's state, ours and the one
+// last exchanged, each "" when the path does not exist there
+func syncDecision(incoming, local, base string) syncAction {
+	switch {
+	case incoming == local:
+		return syncKeep
+	case incoming == base:
+		// Only we changed it; the member gets ours with our next update
+		return syncKeep
+	case local == base, local == "":
+		// Only the member changed it, or changed what we deleted
+		return syncTake
+	default:
+		return syncConflict
+	}
+}
+
+// conflictPath is where a member's conflicting version of target is saved,
+// e.g. "notes (conflict from bob 2026-01-02).txt", numbered by claimPath if
+// taken
+func conflictPath(target, username string) string {
+	ext := filepath.Ext(target)
+	stem := strings.TrimSuffix(target, ext)
+	return fmt.Sprintf("%s (conflict from %s %s)%s", stem, username, time.Now().Format("2006-01-02"), ext)
+}
+
+// deletedEntries lists what base has and local no longer does, sorted by path
+func deletedEntries(base, local map[string]string) []protocol.DirEntry {
+	deletions := []protocol.DirEntry{}
+	for entryPath, state := range base {
+		if _, exists := local[entryPath]; !exists {
+			deletions = append(deletions, protocol.DirEntry{Path: entryPath, IsDir: state == dirState, Deleted: true})
+		}
+	}
+	sort.Slice(deletions, func(i, j int) bool { return deletions[i].Path < deletions[j].Path })
+	return deletions
+}
+
+// syncStates maps every entry of a manifest to its sync state
+func syncStates(manifest []protocol.DirEntry) map[string]string {
+	states := make(map[string]string, len(manifest))
+	for _, entry := range manifest {
+		if !entry.Deleted {
+			states[entry.Path] = syncState(entry)
+		}
+	}
+	return states
+}
+
+// syncState is the hash of a file, or dirState for a folder
+func syncState(entry protocol.DirEntry) string {
+	if entry.IsDir {
+		return dirState
+	}
+	return entry.Hash
+}
+
+func sameStates(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for entryPath, state := range a {
+		if b[entryPath] != state {
+			return false
+		}
+	}
+	return true
+}
+
+// peerLocked returns what we know about userId, adding it if it is new
+func (rs *roomSync) peerLocked(userId, username string) *syncPeer {
+	peer, exists := rs.peers[userId]
+	if !exists {
+		peer = &syncPeer{Base: make(map[string]string)}
+		rs.peers[userId] = peer
+	}
+	if username != "" {
+		peer.Username = username
+	}
+	return peer
+}
+
+// setError records a problem for /transfers, printing it only when it is new
+// so a member that stays unreachable does not flood the screen
+func (rs *roomSync) setError(err error) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	rs.setErrorLocked(err)
+}
+
+func (rs *roomSync) setErrorLocked(err error) {
+	if err.Error() == rs.lastError {
+		return
+	}
+	rs.lastError = err.Error()
+	fmt.Println(utils.ErrorColor("❌ Sync of room"), utils.InfoColor(rs.RoomId+":"), err)
+}
+
+// load reads what an earlier run of this sync knew about the members
+func (rs *roomSync) load() error {
+	data, err := os.ReadFile(rs.statePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state syncStateFile
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	for userId, peer := range state.Peers {
+		if peer != nil && peer.Base != nil {
+			rs.peers[userId] = peer
+		}
+	}
+	return nil
+}
+
+// saveLocked atomically rewrites the sync state, so deletions made while a
+// member was away still reach it after a restart
+func (rs *roomSync) saveLocked() {
+	data, err := json.Marshal(syncStateFile{Room: rs.RoomId, Peers: rs.peers})
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(rs.statePath), 0755)
+	}
+	if err == nil {
+		tempPath := rs.statePath + ".tmp"
+		if err = os.WriteFile(tempPath, data, 0644); err == nil {
+			err = os.Rename(tempPath, rs.statePath)
+		}
+	}
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error saving sync state:"), err)
+	}
+}
+
+// printRoomSyncs lists synced folders and how each member stands, for /transfers
+func printRoomSyncs() {
+	roomSyncsMutex.Lock()
+	syncs := make([]*roomSync, 0, len(roomSyncs))
+	for _, rs := range roomSyncs {
+		syncs = append(syncs, rs)
+	}
+	roomSyncsMutex.Unlock()
+	if len(syncs) == 0 {
+		return
+	}
+	sort.Slice(syncs, func(i, j int) bool { return syncs[i].RoomId < syncs[j].RoomId })
+
+	fmt.Println(utils.HeaderColor("🔄 Room Syncs:"))
+	fmt.Println(utils.InfoColor("-----------------------------------"))
+	for _, rs := range syncs {
+		rs.mutex.Lock()
+		room := rs.RoomId
+		if rs.RoomName != "" {
+			room = fmt.Sprintf("%s (ID: %s)", rs.RoomName, rs.RoomId)
+		}
+		fmt.Printf("📁 %s ⇄ %s\n", utils.InfoColor(rs.Dir), utils.InfoColor(room))
+
+		lastChange := "none yet"
+		if !rs.lastChange.IsZero() {
+			lastChange = formatDuration(time.Since(rs.lastChange)) + " ago"
+		}
+		fmt.Printf("   Last change: %s | Updates sent: %d | received: %d | Conflicts: %d\n",
+			lastChange, rs.sent, rs.received, rs.conflicts)
+
+		ids := make([]string, 0, len(rs.members))
+		for userId := range rs.members {
+			ids = append(ids, userId)
+		}
+		sort.Strings(ids)
+		for _, userId := range ids {
+			fmt.Printf("   %s %s\n", utils.UserColor(rs.members[userId]+":"), rs.peerStatusLocked(userId))
+		}
+		if len(ids) == 0 {
+			fmt.Println(utils.InfoColor("   No other members online are syncing"))
+		}
+		if rs.lastError != "" {
+			fmt.Println(utils.WarningColor("   ⚠️  Last error:"), rs.lastError)
+		}
+		rs.mutex.Unlock()
+		fmt.Println(utils.InfoColor("   ---"))
+	}
+}
+
+// peerStatusLocked describes how userId's copy stands against ours
+func (rs *roomSync) peerStatusLocked(userId string) string {
+	peer, exists := rs.peers[userId]
+	switch {
+	case !exists:
+		return utils.InfoColor("waiting")
+	case peer.pushing:
+		return utils.SuccessColor("▶ sending")
+	case peer.receiving:
+		return utils.SuccessColor("▶ receiving")
+	case time.Now().Before(peer.retryAt):
+		return utils.WarningColor("⏸ last update refused, retrying later")
+	case rs.local != nil && sameStates(peer.Base, rs.local):
+		return utils.SuccessColor("✅ up to date")
+	default:
+		return utils.WarningColor("⏳ changes pending")
+	}
+}
@@ -0,0 +1,119 @@
+package connection
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	sessionsFile  string
+	sessionsMutex sync.Mutex
+)
+
+// DefaultSessionsFile is where session tokens are kept between runs
+func DefaultSessionsFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(partialDirName, "sessions")
+	}
+	return filepath.Join(home, partialDirName, "sessions")
+}
+
+// SetSessionsFile selects where session tokens are kept; empty disables saving them
+func SetSessionsFile(path string) {
+	sessionsFile = path
+}
+
+// savedSession is the token last issued by the server at address, with the
+// store path it was issued for
+type savedSession struct {
+	Token     string
+	StorePath string
+}
+
+// loadSession returns the session saved for address, if any
+func loadSession(address string) savedSession {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	sessions, err := readSessions()
+	if err != nil {
+		return savedSession{}
+	}
+	return sessions[address]
+}
+
+// saveSession remembers session for address; an empty token forgets it
+func saveSession(address string, session savedSession) error {
+	if sessionsFile == "" {
+		return nil
+	}
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	sessions, err := readSessions()
+	if err != nil {
+		return err
+	}
+	if session.Token == "" {
+		delete(sessions, address)
+	} else {
+		sessions[address] = session
+	}
+
+	addresses := make([]string, 0, len(sessions))
+	for address := range sessions {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+
+	var content strings.Builder
+	for _, address := range addresses {
+		fmt.Fprintf(&content, "%s %s %s\n", address, sessions[address].Token, sessions[address].StorePath)
+	}
+
+	// Tokens log in without a password, so only the owner may read them
+	if err := os.MkdirAll(filepath.Dir(sessionsFile), 0700); err != nil {
+		return err
+	}
+	tmp := sessionsFile + ".tmp"
+	if err := os.WriteFile(tmp, []byte(content.String()), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, sessionsFile)
+}
+
+// readSessions parses "address token storePath" lines; the store path may
+// contain spaces
+func readSessions() (map[string]savedSession, error) {
+	sessions := make(map[string]savedSession)
+	if sessionsFile == "" {
+		return sessions, nil
+	}
+	file, err := os.Open(sessionsFile)
+	if os.IsNotExist(err) {
+		return sessions, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.SplitN(strings.TrimSpace(scanner.Text()), " ", 3)
+		if len(fields) >= 2 && !strings.HasPrefix(fields[0], "#") {
+			session := savedSession{Token: fields[1]}
+			if len(fields) == 3 {
+				session.StorePath = fields[2]
+			}
+			sessions[fields[0]] = session
+		}
+	}
+	return sessions, scanner.Err()
+}
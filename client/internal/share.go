@@ -0,0 +1,103 @@
+package connection
+
+import (
+	"drizlink/helper"
+	"drizlink/protocol"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// shareRoot is the store path of this session. It is the only folder peers
+// can list or download from; the server's idea of it is never trusted.
+var shareRoot string
+
+var errOutsideShare = errors.New("path is outside the shared folder")
+
+// realShareRoot returns the share root as a clean absolute path with
+// symlinks resolved
+func realShareRoot() (string, error) {
+	if strings.TrimSpace(shareRoot) == "" {
+		return "", errors.New("no shared folder is set")
+	}
+	root, err := filepath.Abs(filepath.Clean(strings.TrimSpace(shareRoot)))
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(root)
+}
+
+// resolveSharePath turns a share-relative path from a peer into the local
+// file it names. Absolute paths, "..", symlinks leading out of the share and
+// unfinished transfers are all refused.
+func resolveSharePath(rel string) (string, error) {
+	if !helper.IsSharePath(rel) {
+		return "", errOutsideShare
+	}
+	root, err := realShareRoot()
+	if err != nil {
+		return "", err
+	}
+	target, err := filepath.EvalSymlinks(filepath.Join(root, filepath.FromSlash(rel)))
+	if err != nil {
+		return "", err
+	}
+	if !helper.IsWithin(root, target) {
+		return "", errOutsideShare
+	}
+	inside, _ := filepath.Rel(root, target)
+	for _, part := range strings.Split(inside, string(filepath.Separator)) {
+		if part == partialDirName {
+			return "", errors.New("unfinished transfers are not shared")
+		}
+	}
+	return target, nil
+}
+
+// listShare lists everything peers may download, with share-relative paths.
+// Symlinks are listed as what they point to, and only if that is inside the
+// share.
+func listShare() ([]protocol.DirEntry, error) {
+	root, err := realShareRoot()
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, errors.New("shared path is not a directory: " + root)
+	}
+
+	var entries []protocol.DirEntry
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == root {
+			return nil
+		}
+		// Unfinished incoming transfers are not shared
+		if info.IsDir() && info.Name() == partialDirName {
+			return filepath.SkipDir
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := helper.ResolveInside(root, path)
+			if err != nil {
+				return nil
+			}
+			info = target
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return nil
+		}
+		entries = append(entries, protocol.DirEntry{
+			Path:  filepath.ToSlash(rel),
+			Size:  info.Size(),
+			IsDir: info.IsDir(),
+		})
+		return nil
+	})
+	return entries, err
+}
@@ -0,0 +1,148 @@
+package connection
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"drizlink/helper"
+	"drizlink/utils"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// TLSOptions selects how the client decides to trust the server's certificate.
+// A CA or a pinned fingerprint wins; otherwise the first certificate seen for an
+// address is remembered in KnownServersFile and required from then on.
+type TLSOptions struct {
+	CAFile           string
+	Fingerprint      string
+	KnownServersFile string
+}
+
+var (
+	tlsOptions TLSOptions
+	caPool     *x509.CertPool
+
+	// knownServersMutex serializes trust-on-first-use between the control
+	// connection and data channels opened right after it
+	knownServersMutex sync.Mutex
+)
+
+// DefaultKnownServersFile is where trust-on-first-use fingerprints are kept
+func DefaultKnownServersFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(partialDirName, "known_servers")
+	}
+	return filepath.Join(home, partialDirName, "known_servers")
+}
+
+// ConfigureTLS sets how server certificates are verified
+func ConfigureTLS(options TLSOptions) error {
+	if options.CAFile != "" {
+		data, err := os.ReadFile(options.CAFile)
+		if err != nil {
+			return err
+		}
+		caPool = x509.NewCertPool()
+		if !caPool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificates found in %s", options.CAFile)
+		}
+	}
+	if options.KnownServersFile == "" {
+		options.KnownServersFile = DefaultKnownServersFile()
+	}
+	tlsOptions = options
+	return nil
+}
+
+// dialServer opens a TLS connection to the server, used for the control
+// connection and for relayed data channels alike
+func dialServer(address string) (net.Conn, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	switch {
+	case caPool != nil:
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = caPool
+		config.ServerName = host
+	case tlsOptions.Fingerprint != "":
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = helper.VerifyFingerprint(tlsOptions.Fingerprint)
+	default:
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			return trustOnFirstUse(address, state)
+		}
+	}
+	return tls.Dial("tcp", address, config)
+}
+
+// trustOnFirstUse accepts and remembers the first certificate an address
+// presents, and afterwards refuses any other
+func trustOnFirstUse(address string, state tls.ConnectionState) error {
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("server presented no certificate")
+	}
+	fingerprint := helper.CertificateFingerprint(state.PeerCertificates[0].Raw)
+
+	knownServersMutex.Lock()
+	defer knownServersMutex.Unlock()
+
+	known, err := readKnownServers(tlsOptions.KnownServersFile)
+	if err != nil {
+		return err
+	}
+	if pinned, exists := known[address]; exists {
+		if pinned != fingerprint {
+			return fmt.Errorf("certificate of %s changed (expected %s, got %s); if this is expected, remove its line from %s",
+				address, pinned, fingerprint, tlsOptions.KnownServersFile)
+		}
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(tlsOptions.KnownServersFile), 0700); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(tlsOptions.KnownServersFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := fmt.Fprintf(file, "%s %s\n", address, fingerprint); err != nil {
+		return err
+	}
+
+	fmt.Println(utils.WarningColor("🔐 First connection to "+address+", trusting its certificate:"), utils.CommandColor(fingerprint))
+	fmt.Println(utils.InfoColor("   Compare it with the fingerprint the server printed at startup"))
+	return nil
+}
+
+// readKnownServers parses "address fingerprint" lines
+func readKnownServers(path string) (map[string]string, error) {
+	known := make(map[string]string)
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return known, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && !strings.HasPrefix(fields[0], "#") {
+			known[fields[0]] = helper.NormalizeFingerprint(fields[1])
+		}
+	}
+	return known, scanner.Err()
+}
@@ -1,6 +1,7 @@
 package connection
 
 import (
+	"drizlink/helper"
 	"drizlink/utils"
 	"fmt"
 	"io"
@@ -27,6 +28,7 @@ const (
 	Paused
 	Completed
 	Failed
+	Interrupted
 )
 
 // String representation of TransferStatus
@@ -40,6 +42,8 @@ func (s TransferStatus) String() string {
 		return "Completed"
 	case Failed:
 		return "Failed"
+	case Interrupted:
+		return "Interrupted"
 	default:
 		return "Unknown"
 	}
@@ -63,6 +67,9 @@ type Transfer struct {
 	ProgressBar   *utils.ProgressBar
 	PauseLock     sync.Mutex
 	IsPaused      bool
+	// Sync and Mirror are how a folder was sent, so /resume sends it the same way
+	Sync          bool
+	Mirror        bool
 }
 
 // ActiveTransfers tracks all ongoing transfers
@@ -72,6 +79,19 @@ var (
 	transferIDCounter = 1
 )
 
+// checksumAlgorithm is the hash we ask recipients to verify our transfers with
+var checksumAlgorithm = helper.DefaultChecksumAlgorithm
+
+// SetChecksumAlgorithm picks the hash used for outgoing transfers
+func SetChecksumAlgorithm(name string) error {
+	algorithm, err := helper.GetChecksumAlgorithm(name)
+	if err != nil {
+		return err
+	}
+	checksumAlgorithm = algorithm.Name()
+	return nil
+}
+
 // GenerateTransferID creates a unique ID for a transfer
 func GenerateTransferID() string {
 	TransfersMutex.Lock()
@@ -298,18 +318,32 @@ func HandlePauseTransfer(transferID string) {
 		
 	fmt.Printf("  %s: %s / %s (%.1f%%)\n", 
 		utils.InfoColor("Progress"),
-		utils.InfoColor(formatSize(transfer.BytesComplete)),
-		utils.InfoColor(formatSize(transfer.Size)),
+		utils.InfoColor(helper.FormatSize(transfer.BytesComplete)),
+		utils.InfoColor(helper.FormatSize(transfer.Size)),
 		float64(transfer.BytesComplete) / float64(transfer.Size) * 100)
 }
 
 // HandleResumeTransfer handles the /resume command
-func HandleResumeTransfer(transferID string) {
+func HandleResumeTransfer(conn net.Conn, transferID string) {
 	transfer, exists := GetTransfer(transferID)
 	if !exists {
 		fmt.Println(utils.ErrorColor("❌ Transfer not found:"), utils.CommandColor(transferID))
 		return
 	}
+
+	// A transfer whose connection dropped is offered again; the receiver's
+	// journal tells us where to continue
+	if transfer.Status == Interrupted && transfer.Direction == "send" {
+		fmt.Printf("%s Resending transfer %s\n",
+			utils.SuccessColor("▶"),
+			utils.CommandColor(transferID))
+		if transfer.Type == FolderTransfer {
+			go sendFolder(conn, transfer.Recipient, transfer.Path, transferID, transfer.Sync, transfer.Mirror)
+		} else {
+			go sendFile(conn, transfer.Recipient, transfer.Path, transferID)
+		}
+		return
+	}
 	
 	if transfer.Status != Paused {
 		fmt.Printf("%s Transfer %s is not paused (current status: %s)\n", 
@@ -336,8 +370,8 @@ func HandleResumeTransfer(transferID string) {
 		
 	fmt.Printf("  %s: %s / %s (%.1f%%)\n", 
 		utils.InfoColor("Progress"),
-		utils.InfoColor(formatSize(transfer.BytesComplete)),
-		utils.InfoColor(formatSize(transfer.Size)),
+		utils.InfoColor(helper.FormatSize(transfer.BytesComplete)),
+		utils.InfoColor(helper.FormatSize(transfer.Size)),
 		float64(transfer.BytesComplete) / float64(transfer.Size) * 100)
 }
 
@@ -347,6 +381,7 @@ func HandleListTransfers() {
 	
 	if len(transfers) == 0 {
 		fmt.Println(utils.InfoColor("📡 No active transfers"))
+		printRoomSyncs()
 		return
 	}
 	
@@ -371,6 +406,9 @@ func HandleListTransfers() {
 		case Failed:
 			statusColor = utils.ErrorColor
 			statusIcon = "❌ "
+		case Interrupted:
+			statusColor = utils.WarningColor
+			statusIcon = "💾 "
 		}
 		
 		directionIcon := "📤 "
@@ -387,10 +425,10 @@ func HandleListTransfers() {
 		
 		fmt.Printf("   Type: %s | Size: %s | Progress: %.1f%% (%s/%s)\n", 
 			formatTransferType(transfer.Type),
-			formatSize(transfer.Size),
+			helper.FormatSize(transfer.Size),
 			progress,
-			formatSize(transfer.BytesComplete),
-			formatSize(transfer.Size))
+			helper.FormatSize(transfer.BytesComplete),
+			helper.FormatSize(transfer.Size))
 		
 		relationText := "From"
 		if transfer.Direction == "send" {
@@ -406,8 +444,9 @@ func HandleListTransfers() {
 
 	fmt.Println(utils.InfoColor("Commands:"))
 	fmt.Printf("  %s - Pause a transfer\n", utils.CommandColor("/pause <transferId>"))
-	fmt.Printf("  %s - Resume a paused transfer\n", utils.CommandColor("/resume <transferId>"))
+	fmt.Printf("  %s - Resume a paused or interrupted transfer\n", utils.CommandColor("/resume <transferId>"))
 	fmt.Println(utils.InfoColor("-----------------------------------"))
+	printRoomSyncs()
 }
 
 // Helper functions for formatting
@@ -424,42 +463,6 @@ func formatTransferType(t TransferType) string {
 	}
 }
 
-// formatSize formats bytes into a human-readable string
-func formatSize(bytes int64) string {
-	const (
-		_          = iota
-		KB float64 = 1 << (10 * iota)
-		MB
-		GB
-		TB
-	)
-	
-	var size float64
-	var unit string
-	
-	switch {
-	case bytes >= int64(TB):
-		size = float64(bytes) / TB
-		unit = "TB"
-	case bytes >= int64(GB):
-		size = float64(bytes) / GB
-		unit = "GB"
-	case bytes >= int64(MB):
-		size = float64(bytes) / MB
-		unit = "MB"
-	case bytes >= int64(KB):
-		size = float64(bytes) / KB
-		unit = "KB"
-	default:
-		size = float64(bytes)
-		unit = "bytes"
-	}
-	
-	if size >= 100 || unit == "bytes" {
-		return fmt.Sprintf("%.0f %s", size, unit)
-	}
-	return fmt.Sprintf("%.1f %s", size, unit)
-}
 
 // formatDuration formats a duration into a human-readable string
 func formatDuration(d time.Duration) string {
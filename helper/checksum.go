@@ -0,0 +1,148 @@
+package helper
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// DefaultChecksumAlgorithm is used when the sender does not pick one
+	DefaultChecksumAlgorithm = "sha256"
+
+	// LegacyChecksumAlgorithm is only kept so older transfers can still be verified
+	LegacyChecksumAlgorithm = "md5"
+)
+
+// ChecksumAlgorithm is a hash that transfers can be verified with
+type ChecksumAlgorithm interface {
+	// Name is the identifier carried in transfer requests, e.g. "sha256"
+	Name() string
+	// New returns a fresh hash.Hash for one checksum
+	New() hash.Hash
+	// Legacy reports whether the algorithm is only kept for compatibility
+	Legacy() bool
+}
+
+// stdAlgorithm adapts a standard library hash constructor to ChecksumAlgorithm
+type stdAlgorithm struct {
+	name    string
+	newHash func() hash.Hash
+	legacy  bool
+}
+
+func (a stdAlgorithm) Name() string   { return a.name }
+func (a stdAlgorithm) New() hash.Hash { return a.newHash() }
+func (a stdAlgorithm) Legacy() bool   { return a.legacy }
+
+var (
+	checksumAlgorithms = map[string]ChecksumAlgorithm{
+		"sha256": stdAlgorithm{name: "sha256", newHash: sha256.New},
+		"sha512": stdAlgorithm{name: "sha512", newHash: sha512.New},
+		"md5":    stdAlgorithm{name: "md5", newHash: md5.New, legacy: true},
+	}
+	checksumAlgorithmsMutex sync.RWMutex
+)
+
+// RegisterChecksumAlgorithm makes another algorithm available, replacing any
+// existing one with the same name
+func RegisterChecksumAlgorithm(algorithm ChecksumAlgorithm) {
+	checksumAlgorithmsMutex.Lock()
+	defer checksumAlgorithmsMutex.Unlock()
+	checksumAlgorithms[strings.ToLower(algorithm.Name())] = algorithm
+}
+
+// GetChecksumAlgorithm looks up an algorithm by name. An empty name means the
+// default, so the legacy MD5 is only ever used when named explicitly.
+func GetChecksumAlgorithm(name string) (ChecksumAlgorithm, error) {
+	if name == "" {
+		name = DefaultChecksumAlgorithm
+	}
+	checksumAlgorithmsMutex.RLock()
+	defer checksumAlgorithmsMutex.RUnlock()
+	algorithm, exists := checksumAlgorithms[strings.ToLower(name)]
+	if !exists {
+		return nil, fmt.Errorf("unsupported checksum algorithm %q", name)
+	}
+	return algorithm, nil
+}
+
+// ChecksumAlgorithms lists the names of all registered algorithms
+func ChecksumAlgorithms() []string {
+	checksumAlgorithmsMutex.RLock()
+	defer checksumAlgorithmsMutex.RUnlock()
+	names := make([]string, 0, len(checksumAlgorithms))
+	for name := range checksumAlgorithms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// StreamChecksum hashes bytes inline as they flow past, so computing a
+// checksum never needs its own pass over the data
+type StreamChecksum struct {
+	algorithm ChecksumAlgorithm
+	hash      hash.Hash
+}
+
+// NewStreamChecksum starts an inline checksum with the named algorithm
+func NewStreamChecksum(algorithm string) (*StreamChecksum, error) {
+	alg, err := GetChecksumAlgorithm(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	return &StreamChecksum{algorithm: alg, hash: alg.New()}, nil
+}
+
+// Write implements io.Writer, feeding p into the hash
+func (s *StreamChecksum) Write(p []byte) (int, error) {
+	return s.hash.Write(p)
+}
+
+// Reader returns a reader that hashes everything read through it from r
+func (s *StreamChecksum) Reader(r io.Reader) io.Reader {
+	return io.TeeReader(r, s)
+}
+
+// Algorithm is the name of the hash in use
+func (s *StreamChecksum) Algorithm() string {
+	return s.algorithm.Name()
+}
+
+// Sum returns the hex digest of everything hashed so far
+func (s *StreamChecksum) Sum() string {
+	return hex.EncodeToString(s.hash.Sum(nil))
+}
+
+// Fingerprint identifies a file or folder by name, sizes, modes and modification
+// times without reading any contents, so a resumed transfer can be matched with
+// its earlier attempt before its checksum is known
+func Fingerprint(path string) (string, error) {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\n", filepath.Base(path))
+	err := filepath.Walk(path, func(current string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(path, current)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(hash, "%s\x00%d\x00%o\x00%d\n", filepath.ToSlash(relPath), info.Size(), info.Mode(), info.ModTime().UnixNano())
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)[:16]), nil
+}
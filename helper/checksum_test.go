@@ -0,0 +1,78 @@
+package helper
+
+import (
+	"crypto/sha1"
+	"hash"
+	"testing"
+)
+
+// testAlgorithm is a ChecksumAlgorithm from outside the built-in set
+type testAlgorithm struct{}
+
+func (testAlgorithm) Name() string   { return "Test-SHA1" }
+func (testAlgorithm) New() hash.Hash { return sha1.New() }
+func (testAlgorithm) Legacy() bool   { return false }
+
+func TestGetChecksumAlgorithm(t *testing.T) {
+	tests := []struct {
+		name, want string
+		legacy     bool
+	}{
+		{"", DefaultChecksumAlgorithm, false},
+		{"sha256", "sha256", false},
+		{"SHA512", "sha512", false},
+		{"md5", LegacyChecksumAlgorithm, true},
+	}
+	for _, test := range tests {
+		algorithm, err := GetChecksumAlgorithm(test.name)
+		if err != nil {
+			t.Errorf("GetChecksumAlgorithm(%q): %v", test.name, err)
+			continue
+		}
+		if algorithm.Name() != test.want || algorithm.Legacy() != test.legacy {
+			t.Errorf("GetChecksumAlgorithm(%q) = %s (legacy %v), want %s (legacy %v)", test.name, algorithm.Name(), algorithm.Legacy(), test.want, test.legacy)
+		}
+	}
+
+	if _, err := GetChecksumAlgorithm("crc32"); err == nil {
+		t.Error("GetChecksumAlgorithm accepted an unregistered algorithm")
+	}
+}
+
+func TestRegisterChecksumAlgorithm(t *testing.T) {
+	if _, err := GetChecksumAlgorithm("test-sha1"); err == nil {
+		t.Fatal("test-sha1 is registered before the test registers it")
+	}
+	RegisterChecksumAlgorithm(testAlgorithm{})
+	defer func() {
+		checksumAlgorithmsMutex.Lock()
+		delete(checksumAlgorithms, "test-sha1")
+		checksumAlgorithmsMutex.Unlock()
+	}()
+
+	algorithm, err := GetChecksumAlgorithm("test-sha1")
+	if err != nil {
+		t.Fatalf("GetChecksumAlgorithm of the registered algorithm: %v", err)
+	}
+	if _, ok := algorithm.(testAlgorithm); !ok {
+		t.Errorf("GetChecksumAlgorithm = %T, want testAlgorithm", algorithm)
+	}
+
+	listed := false
+	for _, name := range ChecksumAlgorithms() {
+		listed = listed || name == "test-sha1"
+	}
+	if !listed {
+		t.Errorf("ChecksumAlgorithms() = %v, missing test-sha1", ChecksumAlgorithms())
+	}
+
+	// Checksums stream through the registered hash
+	sum, err := NewStreamChecksum("Test-SHA1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum.Write([]byte("abc"))
+	if got, want := sum.Sum(), "a9993e364706816aba3e25717850c26c9cd0d89d"; got != want {
+		t.Errorf("Sum = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,175 @@
+package helper
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// PayloadOverhead is how many bytes sealing adds to each plaintext
+const PayloadOverhead = 16
+
+// Nonce purposes keep chunk, trailer and manifest nonces apart under the same
+// key. SealManifestReply is the only purpose the recipient seals with.
+const (
+	SealChunk uint32 = iota
+	SealTrailer
+	SealManifest
+	SealManifestReply
+)
+
+// ChunkPurpose is the purpose chunks are sealed with in a given round: 0 for
+// the first pass, one more for each round of resends. A resent chunk is read
+// from disk again and may differ if the file changed, so every round gets
+// nonces of its own.
+func ChunkPurpose(round int) uint32 {
+	return SealChunk | uint32(round)<<16
+}
+
+// e2eInfo binds derived keys to this protocol so they are never reused elsewhere
+const e2eInfo = "drizlink e2e payload v2"
+
+// KeyPair is an ephemeral X25519 key pair. A client makes one per session,
+// whose fingerprint identifies it to others, and one per transfer, which is
+// dropped once the transfer's key is derived.
+type KeyPair struct {
+	private *ecdh.PrivateKey
+}
+
+// GenerateKeyPair creates a fresh X25519 key pair
+func GenerateKeyPair() (*KeyPair, error) {
+	private, err := ecdh.X25519().GenerateKey(crand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyPair{private: private}, nil
+}
+
+// PublicKey is the base64 encoded public half, as sent to the server
+func (k *KeyPair) PublicKey() string {
+	return base64.StdEncoding.EncodeToString(k.private.PublicKey().Bytes())
+}
+
+// ParsePublicKey checks that publicKey is a base64 encoded X25519 public key
+func ParsePublicKey(publicKey string) (*ecdh.PublicKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("malformed public key: %v", err)
+	}
+	return ecdh.X25519().NewPublicKey(raw)
+}
+
+// KeyFingerprint is a short, human comparable digest of a public key, e.g.
+// "3f2a 9c1e 77b0 d415 ..."
+func KeyFingerprint(publicKey string) string {
+	raw, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || publicKey == "" {
+		return "none"
+	}
+	sum := sha256.Sum256(raw)
+	digits := hex.EncodeToString(sum[:16])
+	groups := make([]string, 0, len(digits)/4)
+	for i := 0; i < len(digits); i += 4 {
+		groups = append(groups, digits[i:i+4])
+	}
+	return strings.Join(groups, " ")
+}
+
+// PayloadCipher seals one transfer's payload with AES-256-GCM
+type PayloadCipher struct {
+	aead cipher.AEAD
+}
+
+// PayloadCipher derives the key for one transfer from two exchanges: our
+// session key pair k with the peer's session key, which only the two peers can
+// compute, and transfer, a key pair made for this transfer alone, with the
+// peer's transfer key. Once both transfer key pairs are dropped, a leaked
+// session key no longer opens the transfer. salt must be unique per transfer
+// and known to both sides; sending tells whether we are the sender, so all
+// four keys bind the result to who is talking to whom.
+func (k *KeyPair) PayloadCipher(transfer *KeyPair, peerKey, peerTransferKey, salt string, sending bool) (*PayloadCipher, error) {
+	var secret []byte
+	for _, exchange := range []struct {
+		ours  *KeyPair
+		peers string
+	}{{k, peerKey}, {transfer, peerTransferKey}} {
+		peer, err := ParsePublicKey(exchange.peers)
+		if err != nil {
+			return nil, err
+		}
+		shared, err := exchange.ours.private.ECDH(peer)
+		if err != nil {
+			return nil, err
+		}
+		secret = append(secret, shared...)
+	}
+
+	keys := []string{k.PublicKey(), transfer.PublicKey(), peerKey, peerTransferKey}
+	if !sending {
+		keys = []string{peerKey, peerTransferKey, k.PublicKey(), transfer.PublicKey()}
+	}
+	info := e2eInfo + "\x00" + strings.Join(keys, "\x00")
+	key := hkdfSHA256(secret, []byte(salt), []byte(info), 32)
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &PayloadCipher{aead: aead}, nil
+}
+
+// Seal encrypts and authenticates plaintext as item index of the given purpose
+func (c *PayloadCipher) Seal(purpose uint32, index int64, plaintext []byte) []byte {
+	return c.aead.Seal(nil, payloadNonce(purpose, index), plaintext, nil)
+}
+
+// Open decrypts what Seal produced for the same purpose and index
+func (c *PayloadCipher) Open(purpose uint32, index int64, ciphertext []byte) ([]byte, error) {
+	plaintext, err := c.aead.Open(nil, payloadNonce(purpose, index), ciphertext, nil)
+	if err != nil {
+		return nil, errors.New("payload failed authentication")
+	}
+	return plaintext, nil
+}
+
+// payloadNonce is the 4-byte purpose, including the round for chunks, followed
+// by the 8-byte index. Each key is used for a single transfer and only sealed
+// again with the same purpose and index for identical plaintext, e.g. the
+// trailer sent once per round, so no nonce is reused for different data.
+func payloadNonce(purpose uint32, index int64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint32(nonce[:4], purpose)
+	binary.BigEndian.PutUint64(nonce[4:], uint64(index))
+	return nonce
+}
+
+// hkdfSHA256 is HKDF (RFC 5869) with SHA-256
+func hkdfSHA256(secret, salt, info []byte, length int) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	prk := extract.Sum(nil)
+
+	var out, block []byte
+	for counter := byte(1); len(out) < length; counter++ {
+		expand := hmac.New(sha256.New, prk)
+		expand.Write(block)
+		expand.Write(info)
+		expand.Write([]byte{counter})
+		block = expand.Sum(nil)
+		out = append(out, block...)
+	}
+	return out[:length]
+}
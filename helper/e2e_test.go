@@ -0,0 +1,84 @@
+package helper
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPayloadCipher(t *testing.T) {
+	keyPairs := make([]*KeyPair, 5)
+	for i := range keyPairs {
+		pair, err := GenerateKeyPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyPairs[i] = pair
+	}
+	sender, senderTransfer, recipient, recipientTransfer, otherTransfer := keyPairs[0], keyPairs[1], keyPairs[2], keyPairs[3], keyPairs[4]
+
+	sealer, err := sender.PayloadCipher(senderTransfer, recipient.PublicKey(), recipientTransfer.PublicKey(), "token", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opener, err := recipient.PayloadCipher(recipientTransfer, sender.PublicKey(), senderTransfer.PublicKey(), "token", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chunk := []byte("chunk contents")
+	sealed := sealer.Seal(ChunkPurpose(0), 7, chunk)
+	if opened, err := opener.Open(ChunkPurpose(0), 7, sealed); err != nil || !bytes.Equal(opened, chunk) {
+		t.Fatalf("Open = %q, %v; want %q", opened, err, chunk)
+	}
+
+	// A resend of the same chunk is sealed under a nonce of its own
+	resent := sealer.Seal(ChunkPurpose(1), 7, chunk)
+	if bytes.Equal(resent, sealed) {
+		t.Error("a resent chunk reused the nonce of the first pass")
+	}
+	for _, wrong := range []struct {
+		purpose uint32
+		index   int64
+	}{
+		{ChunkPurpose(0), 7},
+		{ChunkPurpose(2), 7},
+		{ChunkPurpose(1), 8},
+		{SealTrailer, 7},
+	} {
+		if _, err := opener.Open(wrong.purpose, wrong.index, resent); err == nil {
+			t.Errorf("Open(%#x, %d) accepted a chunk of round 1, index 7", wrong.purpose, wrong.index)
+		}
+	}
+	if _, err := opener.Open(ChunkPurpose(1), 7, resent); err != nil {
+		t.Errorf("Open of the resent chunk: %v", err)
+	}
+
+	// Another transfer's token or key pair gives another key, even between
+	// the same two session keys
+	others := []struct {
+		name     string
+		transfer *KeyPair
+		salt     string
+	}{
+		{"token", recipientTransfer, "other token"},
+		{"transfer key pair", otherTransfer, "token"},
+	}
+	for _, other := range others {
+		cipher, err := recipient.PayloadCipher(other.transfer, sender.PublicKey(), senderTransfer.PublicKey(), other.salt, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := cipher.Open(ChunkPurpose(0), 7, sealed); err == nil {
+			t.Errorf("a chunk opened under another transfer's %s", other.name)
+		}
+	}
+
+	// The roles are part of the key, so the recipient cannot pose as sender
+	reversed, err := recipient.PayloadCipher(recipientTransfer, sender.PublicKey(), senderTransfer.PublicKey(), "token", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reversed.Open(ChunkPurpose(0), 7, sealed); err == nil {
+		t.Error("a chunk opened with the roles swapped")
+	}
+}
@@ -1,60 +1,59 @@
 package helper
 
 import (
-	"archive/zip"
-	"bytes"
-	"crypto/md5"
+	crand "crypto/rand"
+	"encoding/base32"
 	"encoding/hex"
 	"fmt"
-	"io"
-	"math/rand"
 	"net"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"time"
 )
 
-// CalculateFileChecksum computes an MD5 hash of a file
-func CalculateFileChecksum(filePath string) (string, error) {
-	file, err := os.Open(filePath)
-	if err != nil {
-		return "", err
-	}
-	defer file.Close()
+// VerifyChecksum checks if two checksums match
+func VerifyChecksum(original, received string) bool {
+	return original == received
+}
 
-	hash := md5.New()
-	if _, err := io.Copy(hash, file); err != nil {
-		return "", err
-	}
+// IdLength is the number of base32 characters in user and room IDs (50 random bits)
+const IdLength = 10
+
+// idEncoding is lowercase base32 without padding, easy to read out and type
+var idEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
 
-	return hex.EncodeToString(hash.Sum(nil)), nil
+// GenerateUserId returns a random user ID. It is safe to call concurrently;
+// callers still check it against existing IDs before using it.
+func GenerateUserId() string {
+	return generateId()
 }
 
-// CalculateDataChecksum computes an MD5 hash from a reader without consuming it
-// Returns the checksum and a new reader that can be used normally
-func CalculateDataChecksum(reader io.Reader) (string, io.Reader, error) {
-	hash := md5.New()
-	data, err := io.ReadAll(reader)
-	if err != nil {
-		return "", nil, err
-	}
-	
-	hash.Write(data)
-	checksum := hex.EncodeToString(hash.Sum(nil))
-	
-	// Return a new reader with the same data
-	return checksum, bytes.NewReader(data), nil
+// GenerateRoomId returns a random room ID, like GenerateUserId
+func GenerateRoomId() string {
+	return generateId()
 }
 
-// VerifyChecksum checks if two checksums match
-func VerifyChecksum(original, received string) bool {
-	return original == received
+// GenerateMessageId returns a random ID for a direct message, like GenerateUserId
+func GenerateMessageId() string {
+	return generateId()
 }
 
-func GenerateUserId() string {
-	return strconv.Itoa(rand.Intn(10000000))
+func generateId() string {
+	buf := make([]byte, 7)
+	if _, err := crand.Read(buf); err != nil {
+		panic(fmt.Sprintf("crypto/rand failed: %v", err))
+	}
+	return idEncoding.EncodeToString(buf)[:IdLength]
+}
+
+// GenerateToken returns a random hex token suitable for one-time authorization
+func GenerateToken() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := crand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
 }
 
 // CheckServerAvailability checks if a server is running at the given address
@@ -90,122 +89,27 @@ func IsPortInUse(port string) bool {
 	return true
 }
 
-// CreateZipFromFolder creates a zip archive from a folder
-func CreateZipFromFolder(folderPath string, zipPath string) error {
-	zipFile, err := os.Create(zipPath)
+// ResolveInside follows the symlink at path and returns what it points to,
+// or an error if that lies outside root
+func ResolveInside(root, path string) (os.FileInfo, error) {
+	realRoot, err := filepath.EvalSymlinks(root)
 	if err != nil {
-		return fmt.Errorf("failed to create zip file: %v", err)
+		return nil, err
 	}
-	defer zipFile.Close()
-
-	archive := zip.NewWriter(zipFile)
-	defer archive.Close()
-
-	return filepath.Walk(folderPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-
-		// Get the relative path for the zip
-		relPath, err := filepath.Rel(folderPath, path)
-		if err != nil {
-			return err
-		}
-
-		// Skip if it's the root folder
-		if relPath == "." {
-			return nil
-		}
-
-		// Create zip header
-		header, err := zip.FileInfoHeader(info)
-		if err != nil {
-			return err
-		}
-
-		// Set relative path as name
-		header.Name = relPath
-
-		// Set compression
-		header.Method = zip.Deflate
-
-		writer, err := archive.CreateHeader(header)
-		if err != nil {
-			return err
-		}
-
-		// If it's a directory, just return
-		if info.IsDir() {
-			return nil
-		}
-
-		// Copy file contents
-		file, err := os.Open(path)
-		if err != nil {
-			return err
-		}
-		defer file.Close()
-
-		_, err = io.Copy(writer, file)
-		return err
-	})
-}
-
-// ExtractZip extracts a zip archive to the specified destination
-func ExtractZip(zipPath string, destPath string) error {
-	archive, err := zip.OpenReader(zipPath)
+	realRoot, err = filepath.Abs(realRoot)
 	if err != nil {
-		return fmt.Errorf("failed to open zip file: %v", err)
+		return nil, err
 	}
-	defer archive.Close()
-
-	for _, file := range archive.File {
-		filePath := filepath.Join(destPath, file.Name)
-
-		if file.FileInfo().IsDir() {
-			os.MkdirAll(filePath, os.ModePerm)
-			continue
-		}
-
-		// Ensure parent directory exists
-		if err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
-			return err
-		}
-
-		dstFile, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, file.Mode())
-		if err != nil {
-			return err
-		}
-
-		srcFile, err := file.Open()
-		if err != nil {
-			dstFile.Close()
-			return err
-		}
-
-		_, err = io.Copy(dstFile, srcFile)
-		srcFile.Close()
-		dstFile.Close()
-
-		if err != nil {
-			return err
-		}
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return nil, err
 	}
-
-	return nil
+	target, err = filepath.Abs(target)
+	if err != nil {
+		return nil, err
+	}
+	if !IsWithin(realRoot, target) {
+		return nil, fmt.Errorf("%s points outside %s", path, root)
+	}
+	return os.Stat(target)
 }
-
-// GetFolderSize returns the total size of a folder in bytes
-func GetFolderSize(folderPath string) (int64, error) {
-	var size int64
-	err := filepath.Walk(folderPath, func(_ string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if !info.IsDir() {
-			size += info.Size()
-		}
-		return nil
-	})
-	return size, err
-}
\ No newline at end of file
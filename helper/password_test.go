@@ -0,0 +1,71 @@
+package helper
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"testing"
+)
+
+// Known answers from RFC 7914 §11 and the RFC 6070 inputs run with SHA-256
+func TestPBKDF2SHA256(t *testing.T) {
+	tests := []struct {
+		password, salt string
+		iterations     int
+		want           string
+	}{
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		{"Password", "NaCl", 80000, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d"},
+		{"password", "salt", 1, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+		{"password", "salt", 2, "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43"},
+		{"password", "salt", 4096, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+		{"passwordPASSWORDpassword", "saltSALTsaltSALTsaltSALTsaltSALTsalt", 4096, "348c89dbcbd32b2f32d814b8116e84cf2b17347ebc1800181c4e2a1fb8dd53e1c635518c7dac47e9"},
+		{"pass\x00word", "sa\x00lt", 4096, "89b69d0516f829893c696226650a8687"},
+	}
+	for _, test := range tests {
+		want, _ := hex.DecodeString(test.want)
+		got := hex.EncodeToString(pbkdf2SHA256([]byte(test.password), []byte(test.salt), test.iterations, len(want)))
+		if got != test.want {
+			t.Errorf("pbkdf2SHA256(%q, %q, %d) = %s, want %s", test.password, test.salt, test.iterations, got, test.want)
+		}
+	}
+}
+
+func TestVerifyPassword(t *testing.T) {
+	encoded, err := HashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !VerifyPassword("correct horse", encoded) {
+		t.Error("VerifyPassword rejected the hashed password")
+	}
+	if VerifyPassword("correct horse ", encoded) {
+		t.Error("VerifyPassword accepted a different password")
+	}
+	if again, _ := HashPassword("correct horse"); again == encoded {
+		t.Error("HashPassword reused a salt")
+	}
+
+	// Hashes made with other parameters keep verifying
+	salt := []byte("salt")
+	key := pbkdf2SHA256([]byte("password"), salt, 2, 32)
+	legacy := fmt.Sprintf("pbkdf2-sha256$2$%s$%s", base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+	if !VerifyPassword("password", legacy) {
+		t.Error("VerifyPassword rejected a hash with 2 iterations")
+	}
+
+	for _, malformed := range []string{
+		"",
+		"password",
+		"pbkdf2-sha1$2$c2FsdA$rk0MlaNrRtMtCt_5KPBt0CowP47zwlHf1uLYWpVHTEM",
+		"pbkdf2-sha256$0$c2FsdA$" + base64.RawStdEncoding.EncodeToString(key),
+		"pbkdf2-sha256$-1$c2FsdA$" + base64.RawStdEncoding.EncodeToString(key),
+		"pbkdf2-sha256$2$!!$" + base64.RawStdEncoding.EncodeToString(key),
+		"pbkdf2-sha256$2$c2FsdA$!!",
+		legacy + "$extra",
+	} {
+		if VerifyPassword("password", malformed) {
+			t.Errorf("VerifyPassword accepted %q", malformed)
+		}
+	}
+}
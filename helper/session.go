@@ -0,0 +1,96 @@
+package helper
+
+import (
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"time"
+)
+
+// SessionLifetime is how long a session token can be used to reconnect
+const SessionLifetime = 30 * 24 * time.Hour
+
+// sessionTokenPrefix versions the token format
+const sessionTokenPrefix = "v1"
+
+// ErrInvalidSession is returned for tokens that are malformed, forged or expired
+var ErrInvalidSession = errors.New("invalid or expired session token")
+
+// SessionClaims is what a session token vouches for
+type SessionClaims struct {
+	UserId    string `json:"uid"`
+	Username  string `json:"name"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// SignSessionToken issues a token for claims, signed with HMAC-SHA256 under
+// key. The server keeps no record of it; the signature is the proof.
+func SignSessionToken(key []byte, claims SessionClaims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	signed := sessionTokenPrefix + "." + encoded
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signSession(key, signed)), nil
+}
+
+// VerifySessionToken checks a token's signature and expiry and returns its claims
+func VerifySessionToken(key []byte, token string, now time.Time) (SessionClaims, error) {
+	var claims SessionClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != sessionTokenPrefix {
+		return claims, ErrInvalidSession
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(signature, signSession(key, parts[0]+"."+parts[1])) {
+		return claims, ErrInvalidSession
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(payload, &claims) != nil {
+		return claims, ErrInvalidSession
+	}
+	if claims.UserId == "" || now.Unix() >= claims.ExpiresAt {
+		return claims, ErrInvalidSession
+	}
+	return claims, nil
+}
+
+func signSession(key []byte, signed string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(signed))
+	return mac.Sum(nil)
+}
+
+// LoadOrCreateSessionKey loads the session signing key in path, generating
+// and saving a random one first when the file does not exist, so tokens stay
+// valid across restarts. created reports whether that happened.
+func LoadOrCreateSessionKey(path string) (key []byte, created bool, err error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		key = make([]byte, 32)
+		if _, err := crand.Read(key); err != nil {
+			return nil, false, err
+		}
+		if err := os.WriteFile(path, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+			return nil, false, err
+		}
+		return key, true, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	key, err = hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) < 32 {
+		return nil, false, errors.New("session key file must hold at least 32 hex encoded bytes")
+	}
+	return key, false, nil
+}
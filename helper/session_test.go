@@ -0,0 +1,65 @@
+package helper
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionToken(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	now := time.Unix(1700000000, 0)
+	claims := SessionClaims{UserId: "k3x9q2m7ab", Username: "alice", IssuedAt: now.Unix(), ExpiresAt: now.Add(SessionLifetime).Unix()}
+
+	token, err := SignSessionToken(key, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := VerifySessionToken(key, token, now)
+	if err != nil {
+		t.Fatalf("VerifySessionToken of a fresh token: %v", err)
+	}
+	if got != claims {
+		t.Errorf("VerifySessionToken = %+v, want %+v", got, claims)
+	}
+
+	// Claims swapped in under the original signature
+	parts := strings.Split(token, ".")
+	forged := claims
+	forged.UserId = "zzzzzzzzzz"
+	payload, _ := json.Marshal(forged)
+	tampered := parts[0] + "." + base64.RawURLEncoding.EncodeToString(payload) + "." + parts[2]
+
+	signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	signature[0] ^= 1
+	flipped := parts[0] + "." + parts[1] + "." + base64.RawURLEncoding.EncodeToString(signature)
+
+	otherKey := []byte("fedcba9876543210fedcba9876543210")
+	rejected := []struct {
+		name, token string
+		key         []byte
+		now         time.Time
+	}{
+		{"tampered claims", tampered, key, now},
+		{"tampered signature", flipped, key, now},
+		{"other key", token, otherKey, now},
+		{"expired", token, key, time.Unix(claims.ExpiresAt, 0)},
+		{"long expired", token, key, now.Add(2 * SessionLifetime)},
+		{"other version", "v0" + strings.TrimPrefix(token, "v1"), key, now},
+		{"missing signature", parts[0] + "." + parts[1], key, now},
+		{"empty", "", key, now},
+	}
+	for _, test := range rejected {
+		if _, err := VerifySessionToken(test.key, test.token, test.now); !errors.Is(err, ErrInvalidSession) {
+			t.Errorf("%s: VerifySessionToken = %v, want ErrInvalidSession", test.name, err)
+		}
+	}
+
+	// Still valid one second before it expires
+	if _, err := VerifySessionToken(key, token, time.Unix(claims.ExpiresAt-1, 0)); err != nil {
+		t.Errorf("VerifySessionToken just before expiry: %v", err)
+	}
+}
@@ -0,0 +1,41 @@
+package helper
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// IsSharePath reports whether p is a well-formed path inside a shared folder
+// as it travels on the wire: relative, separated by forward slashes, and
+// never climbing out with "..". Whether it stays inside once symlinks are
+// followed can only be checked by the peer that owns the folder.
+func IsSharePath(p string) bool {
+	if p == "" || strings.ContainsAny(p, "\\\x00") || strings.HasPrefix(p, "/") {
+		return false
+	}
+	if filepath.IsAbs(p) || filepath.VolumeName(p) != "" {
+		return false
+	}
+	for _, part := range strings.Split(p, "/") {
+		if part == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// FileType is the lower case extension of name, dot included, that room
+// file policies are matched against; "" for names without one
+func FileType(name string) string {
+	return strings.ToLower(filepath.Ext(name))
+}
+
+// IsWithin reports whether path is root or lies below it. Both must be clean
+// absolute paths with symlinks already resolved.
+func IsWithin(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
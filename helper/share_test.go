@@ -0,0 +1,108 @@
+package helper
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsSharePath(t *testing.T) {
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"notes.txt", true},
+		{"docs/notes.txt", true},
+		{"docs/../notes.txt", false},
+		{"..", false},
+		{"../notes.txt", false},
+		{"docs/..", false},
+		{"..notes/file..txt", true},
+		{"/etc/passwd", false},
+		{"//server/share", false},
+		{`C:\Windows\win.ini`, false},
+		{"C:/Windows/win.ini", filepath.VolumeName("C:/") == ""},
+		{`docs\notes.txt`, false},
+		{`..\notes.txt`, false},
+		{"docs/\x00.txt", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		if got := IsSharePath(test.path); got != test.want {
+			t.Errorf("IsSharePath(%q) = %v, want %v", test.path, got, test.want)
+		}
+	}
+}
+
+func TestIsWithin(t *testing.T) {
+	root := filepath.Join(string(filepath.Separator), "srv", "share")
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{root, true},
+		{filepath.Join(root, "docs", "notes.txt"), true},
+		{filepath.Join(root, "..notes"), true},
+		{filepath.Dir(root), false},
+		{filepath.Join(filepath.Dir(root), "share2", "notes.txt"), false},
+		{filepath.Join(string(filepath.Separator), "etc", "passwd"), false},
+	}
+	for _, test := range tests {
+		if got := IsWithin(root, test.path); got != test.want {
+			t.Errorf("IsWithin(%q, %q) = %v, want %v", root, test.path, got, test.want)
+		}
+	}
+}
+
+func TestResolveInside(t *testing.T) {
+	base := t.TempDir()
+	root := filepath.Join(base, "share")
+	outside := filepath.Join(base, "outside")
+	for _, dir := range []string{filepath.Join(root, "docs"), outside} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{filepath.Join(root, "docs", "notes.txt"), filepath.Join(outside, "secret.txt")} {
+		if err := os.WriteFile(file, []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	links := []struct {
+		name, target string
+		inside       bool
+	}{
+		{"inside", filepath.Join(root, "docs", "notes.txt"), true},
+		{"relative", filepath.Join("docs", "notes.txt"), true},
+		{"folder", "docs", true},
+		{"absolute", filepath.Join(outside, "secret.txt"), false},
+		{"climbing", filepath.Join("..", "outside", "secret.txt"), false},
+		{"parent", "..", false},
+		{"sibling", filepath.Join("..", "share2"), false},
+		// Reaching outside through another link is caught as well
+		{"chained", filepath.Join("parent", "outside", "secret.txt"), false},
+	}
+	if err := os.Mkdir(filepath.Join(base, "share2"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, link := range links {
+		if err := os.Symlink(link.target, filepath.Join(root, link.name)); err != nil {
+			t.Skipf("symlinks unavailable: %v", err)
+		}
+	}
+
+	for _, link := range links {
+		_, err := ResolveInside(root, filepath.Join(root, link.name))
+		if link.inside && err != nil {
+			t.Errorf("ResolveInside(%s) = %v, want the target", link.name, err)
+		}
+		if !link.inside && err == nil {
+			t.Errorf("ResolveInside(%s) followed a link outside the share", link.name)
+		}
+	}
+
+	if _, err := ResolveInside(root, filepath.Join(root, "missing")); err == nil {
+		t.Error("ResolveInside of a missing path succeeded")
+	}
+}
@@ -0,0 +1,72 @@
+package helper
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	_          = iota
+	KB float64 = 1 << (10 * iota)
+	MB
+	GB
+	TB
+)
+
+// FormatSize formats bytes into a human-readable string
+func FormatSize(bytes int64) string {
+	var size float64
+	var unit string
+
+	switch {
+	case bytes >= int64(TB):
+		size = float64(bytes) / TB
+		unit = "TB"
+	case bytes >= int64(GB):
+		size = float64(bytes) / GB
+		unit = "GB"
+	case bytes >= int64(MB):
+		size = float64(bytes) / MB
+		unit = "MB"
+	case bytes >= int64(KB):
+		size = float64(bytes) / KB
+		unit = "KB"
+	default:
+		size = float64(bytes)
+		unit = "bytes"
+	}
+
+	if size >= 100 || unit == "bytes" {
+		return fmt.Sprintf("%.0f %s", size, unit)
+	}
+	return fmt.Sprintf("%.1f %s", size, unit)
+}
+
+// ParseSize reads a size such as "512", "20KB", "1.5 MB" or "2g". Units are
+// binary, as in FormatSize.
+func ParseSize(text string) (int64, error) {
+	text = strings.ToUpper(strings.TrimSpace(text))
+	text = strings.TrimSuffix(strings.TrimSuffix(text, "BYTES"), "B")
+
+	multiplier := 1.0
+	for suffix, unit := range map[string]float64{"K": KB, "M": MB, "G": GB, "T": TB} {
+		if strings.HasSuffix(text, suffix) {
+			text, multiplier = strings.TrimSuffix(text, suffix), unit
+			break
+		}
+	}
+
+	value, err := strconv.ParseFloat(strings.TrimSpace(text), 64)
+	if err != nil || !(value >= 0) {
+		return 0, errors.New("size must be a number, optionally followed by KB, MB, GB or TB")
+	}
+	// float64(math.MaxInt64) rounds up to 2^63, the first value that overflows
+	size := value * multiplier
+	if size >= math.MaxInt64 {
+		return 0, errors.New("size is too large")
+	}
+	return int64(size), nil
+}
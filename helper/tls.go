@@ -0,0 +1,161 @@
+package helper
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// SelfSignedValidity is how long an auto-generated certificate stays valid
+const SelfSignedValidity = 5 * 365 * 24 * time.Hour
+
+// GenerateSelfSignedCert creates a PEM encoded certificate and ECDSA key for
+// hosts, which may be host names or IP addresses
+func GenerateSelfSignedCert(hosts []string) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := crand.Int(crand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"DrizLink"}, CommonName: "DrizLink"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(SelfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if host != "" {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(crand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	return certPEM, keyPEM, nil
+}
+
+// NewSelfSignedCertificate returns an in-memory self-signed certificate, for
+// listeners whose identity is vouched for by a fingerprint rather than a CA
+func NewSelfSignedCertificate() (tls.Certificate, error) {
+	certPEM, keyPEM, err := GenerateSelfSignedCert(LocalHosts())
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// LoadOrCreateCertificate loads the key pair in certFile and keyFile. When
+// neither file exists a self-signed pair is generated and saved there first,
+// so the certificate and its fingerprint stay the same across restarts.
+// created reports whether that happened.
+func LoadOrCreateCertificate(certFile, keyFile string) (cert tls.Certificate, created bool, err error) {
+	_, certErr := os.Stat(certFile)
+	_, keyErr := os.Stat(keyFile)
+	if os.IsNotExist(certErr) && os.IsNotExist(keyErr) {
+		certPEM, keyPEM, err := GenerateSelfSignedCert(LocalHosts())
+		if err != nil {
+			return tls.Certificate{}, false, err
+		}
+		if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+			return tls.Certificate{}, false, err
+		}
+		if err := os.WriteFile(certFile, certPEM, 0644); err != nil {
+			return tls.Certificate{}, false, err
+		}
+		created = true
+	}
+
+	cert, err = tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return tls.Certificate{}, false, fmt.Errorf("loading TLS key pair: %v", err)
+	}
+	return cert, created, nil
+}
+
+// CertificateFingerprint is the hex SHA-256 of a DER encoded certificate
+func CertificateFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// LeafFingerprint is the fingerprint of the first certificate in cert
+func LeafFingerprint(cert tls.Certificate) string {
+	if len(cert.Certificate) == 0 {
+		return ""
+	}
+	return CertificateFingerprint(cert.Certificate[0])
+}
+
+// NormalizeFingerprint accepts fingerprints written with colons, spaces or
+// upper case, as most tools print them
+func NormalizeFingerprint(fingerprint string) string {
+	fingerprint = strings.ToLower(strings.TrimSpace(fingerprint))
+	fingerprint = strings.TrimPrefix(fingerprint, "sha256:")
+	return strings.NewReplacer(":", "", " ", "").Replace(fingerprint)
+}
+
+// VerifyFingerprint returns a tls.Config callback that only accepts a peer whose
+// leaf certificate has the given fingerprint
+func VerifyFingerprint(fingerprint string) func(tls.ConnectionState) error {
+	expected := NormalizeFingerprint(fingerprint)
+	return func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return errors.New("peer presented no certificate")
+		}
+		if actual := CertificateFingerprint(state.PeerCertificates[0].Raw); actual != expected {
+			return fmt.Errorf("certificate fingerprint %s does not match pinned %s", actual, expected)
+		}
+		return nil
+	}
+}
+
+// LocalHosts lists the names and addresses this machine can be reached by, for
+// the subject of a self-signed certificate
+func LocalHosts() []string {
+	hosts := []string{"localhost"}
+	if name, err := os.Hostname(); err == nil {
+		hosts = append(hosts, name)
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return hosts
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			hosts = append(hosts, ipNet.IP.String())
+		}
+	}
+	return hosts
+}
@@ -0,0 +1,71 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	// ChunkSize is how much payload one chunk carries. Each chunk travels in a
+	// single frame, so it must leave room for the chunk header under MaxFrameSize.
+	ChunkSize = 256 * 1024
+
+	// ChunkOverhead is how much larger than ChunkSize a chunk may grow once
+	// its data is sealed for end-to-end encryption
+	ChunkOverhead = 64
+
+	// chunkHeaderSize is an 8-byte big-endian chunk index followed by its SHA-256 digest
+	chunkHeaderSize = 8 + sha256.Size
+)
+
+// Chunk is one verified-or-not piece of a transfer payload
+type Chunk struct {
+	Index int64
+	Data  []byte
+	// Valid is false when Data does not match the digest it was sent with
+	Valid bool
+}
+
+// WriteChunk sends data as chunk index, together with its SHA-256 digest
+func WriteChunk(w io.Writer, index int64, data []byte) error {
+	if len(data) > ChunkSize+ChunkOverhead {
+		return fmt.Errorf("chunk of %d bytes exceeds chunk size", len(data))
+	}
+	payload := make([]byte, chunkHeaderSize+len(data))
+	binary.BigEndian.PutUint64(payload[:8], uint64(index))
+	digest := sha256.Sum256(data)
+	copy(payload[8:chunkHeaderSize], digest[:])
+	copy(payload[chunkHeaderSize:], data)
+	return WriteFrame(w, ChunkFrame, payload)
+}
+
+// ParseChunk decodes a chunk frame and checks its data against its digest
+func ParseChunk(frame Frame) (Chunk, error) {
+	if frame.Type != ChunkFrame || len(frame.Payload) < chunkHeaderSize {
+		return Chunk{}, fmt.Errorf("malformed chunk frame")
+	}
+	data := frame.Payload[chunkHeaderSize:]
+	digest := sha256.Sum256(data)
+	return Chunk{
+		Index: int64(binary.BigEndian.Uint64(frame.Payload[:8])),
+		Data:  data,
+		Valid: bytes.Equal(digest[:], frame.Payload[8:chunkHeaderSize]),
+	}, nil
+}
+
+// ChunkCount is the number of chunks a payload of size bytes is split into
+func ChunkCount(size int64) int64 {
+	return (size + ChunkSize - 1) / ChunkSize
+}
+
+// ChunkLength is the number of payload bytes in chunk index of a size-byte payload
+func ChunkLength(index, size int64) int64 {
+	length := size - index*ChunkSize
+	if length > ChunkSize {
+		length = ChunkSize
+	}
+	return length
+}
@@ -0,0 +1,74 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestChunkRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	data := bytes.Repeat([]byte("chunk"), 1000)
+	if err := WriteChunk(&buf, 42, data); err != nil {
+		t.Fatal(err)
+	}
+	frame, err := ReadFrame(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk, err := ParseChunk(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chunk.Index != 42 || !chunk.Valid || !bytes.Equal(chunk.Data, data) {
+		t.Errorf("ParseChunk = index %d, valid %v, %d bytes; want index 42, valid, %d bytes", chunk.Index, chunk.Valid, len(chunk.Data), len(data))
+	}
+
+	// Data changed on the way no longer matches its digest
+	frame.Payload[len(frame.Payload)-1] ^= 1
+	if chunk, err := ParseChunk(frame); err != nil || chunk.Valid {
+		t.Errorf("ParseChunk of corrupted data = valid %v, %v; want invalid", chunk.Valid, err)
+	}
+}
+
+func TestChunkLimits(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteChunk(&buf, 0, make([]byte, ChunkSize+ChunkOverhead)); err != nil {
+		t.Errorf("WriteChunk of a full sealed chunk: %v", err)
+	}
+	if err := WriteChunk(&buf, 0, make([]byte, ChunkSize+ChunkOverhead+1)); err == nil {
+		t.Error("WriteChunk accepted an oversize chunk")
+	}
+
+	for _, frame := range []Frame{
+		{ChunkFrame, make([]byte, chunkHeaderSize-1)},
+		{ControlFrame, make([]byte, chunkHeaderSize+1)},
+	} {
+		if _, err := ParseChunk(frame); err == nil {
+			t.Errorf("ParseChunk accepted a type %d frame of %d bytes", frame.Type, len(frame.Payload))
+		}
+	}
+}
+
+func TestChunkCount(t *testing.T) {
+	tests := []struct {
+		size, count, last int64
+	}{
+		{1, 1, 1},
+		{ChunkSize, 1, ChunkSize},
+		{ChunkSize + 1, 2, 1},
+		{3*ChunkSize - 5, 3, ChunkSize - 5},
+	}
+	for _, test := range tests {
+		count := ChunkCount(test.size)
+		if count != test.count {
+			t.Errorf("ChunkCount(%d) = %d, want %d", test.size, count, test.count)
+			continue
+		}
+		if last := ChunkLength(count-1, test.size); last != test.last {
+			t.Errorf("ChunkLength(%d, %d) = %d, want %d", count-1, test.size, last, test.last)
+		}
+	}
+	if count := ChunkCount(0); count != 0 {
+		t.Errorf("ChunkCount(0) = %d, want 0", count)
+	}
+}
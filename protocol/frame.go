@@ -0,0 +1,79 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// FrameType tells control messages apart from transfer payload on the wire
+type FrameType byte
+
+// Type 2 carried unchunked transfer payload and is no longer accepted
+const (
+	ControlFrame FrameType = 1
+	ChunkFrame   FrameType = 3
+)
+
+const (
+	// headerSize is one type byte followed by a 4-byte big-endian payload length
+	headerSize = 5
+
+	// MaxFrameSize bounds a single frame so a corrupt length prefix cannot
+	// make a peer allocate gigabytes
+	MaxFrameSize = 1 << 20
+)
+
+// ErrFrameTooLarge is returned when a frame header announces more than MaxFrameSize bytes
+var ErrFrameTooLarge = errors.New("frame exceeds maximum size")
+
+// Frame is a single length-prefixed unit read from a connection
+type Frame struct {
+	Type    FrameType
+	Payload []byte
+}
+
+// WriteFrame writes one frame with a single Write call, so concurrent writers
+// on the same net.Conn never interleave partial frames
+func WriteFrame(w io.Writer, frameType FrameType, payload []byte) error {
+	if len(payload) > MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+
+	buf := make([]byte, headerSize+len(payload))
+	buf[0] = byte(frameType)
+	binary.BigEndian.PutUint32(buf[1:headerSize], uint32(len(payload)))
+	copy(buf[headerSize:], payload)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadFrame reads exactly one frame, blocking until it has arrived in full
+func ReadFrame(r io.Reader) (Frame, error) {
+	var header [headerSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return Frame{}, err
+	}
+
+	frameType := FrameType(header[0])
+	if frameType != ControlFrame && frameType != ChunkFrame {
+		return Frame{}, fmt.Errorf("unknown frame type %d", header[0])
+	}
+
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > MaxFrameSize {
+		return Frame{}, ErrFrameTooLarge
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return Frame{}, err
+	}
+
+	return Frame{Type: frameType, Payload: payload}, nil
+}
@@ -0,0 +1,81 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	frames := []Frame{
+		{ControlFrame, []byte(`{"type":"ping"}`)},
+		{ChunkFrame, bytes.Repeat([]byte{0xab}, MaxFrameSize)},
+		{ControlFrame, []byte{}},
+	}
+	for _, frame := range frames {
+		if err := WriteFrame(&buf, frame.Type, frame.Payload); err != nil {
+			t.Fatalf("WriteFrame(%d, %d bytes): %v", frame.Type, len(frame.Payload), err)
+		}
+	}
+	for _, want := range frames {
+		got, err := ReadFrame(&buf)
+		if err != nil {
+			t.Fatalf("ReadFrame: %v", err)
+		}
+		if got.Type != want.Type || !bytes.Equal(got.Payload, want.Payload) {
+			t.Errorf("ReadFrame = type %d with %d bytes, want type %d with %d bytes", got.Type, len(got.Payload), want.Type, len(want.Payload))
+		}
+	}
+	if _, err := ReadFrame(&buf); err != io.EOF {
+		t.Errorf("ReadFrame past the last frame = %v, want io.EOF", err)
+	}
+}
+
+func TestFrameTooLarge(t *testing.T) {
+	if err := WriteFrame(io.Discard, ChunkFrame, make([]byte, MaxFrameSize+1)); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("WriteFrame of an oversize payload = %v, want ErrFrameTooLarge", err)
+	}
+
+	// A header announcing too much is refused before anything is allocated
+	for _, size := range []uint32{MaxFrameSize + 1, 1<<32 - 1} {
+		header := []byte{byte(ChunkFrame), 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(header[1:], size)
+		if _, err := ReadFrame(bytes.NewReader(header)); !errors.Is(err, ErrFrameTooLarge) {
+			t.Errorf("ReadFrame of a %d-byte header = %v, want ErrFrameTooLarge", size, err)
+		}
+	}
+}
+
+func TestFrameMalformed(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteFrame(&buf, ControlFrame, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	whole := buf.Bytes()
+
+	tests := []struct {
+		name string
+		wire []byte
+		want error
+	}{
+		{"truncated header", whole[:3], io.ErrUnexpectedEOF},
+		{"truncated payload", whole[:len(whole)-1], io.ErrUnexpectedEOF},
+		{"header only", whole[:headerSize], io.ErrUnexpectedEOF},
+	}
+	for _, test := range tests {
+		if _, err := ReadFrame(bytes.NewReader(test.wire)); !errors.Is(err, test.want) {
+			t.Errorf("%s: ReadFrame = %v, want %v", test.name, err, test.want)
+		}
+	}
+
+	// Unknown types, including the retired unchunked data frame, are refused
+	for _, frameType := range []byte{0, 2, 4, 0xff} {
+		wire := append([]byte{frameType}, whole[1:]...)
+		if _, err := ReadFrame(bytes.NewReader(wire)); err == nil {
+			t.Errorf("ReadFrame accepted frame type %d", frameType)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Version is the wire protocol version. Bump it whenever the framing or the
+// message schema changes in a way older peers cannot understand.
+const Version = 18
+
+// HandshakeTimeout bounds how long either side waits for the other's hello
+const HandshakeTimeout = 10 * time.Second
+
+// legacyClientNotice is written unframed to clients that predate the handshake,
+// which print whatever raw text they receive
+const legacyClientNotice = "❌ Unsupported protocol version: this server requires a newer DrizLink client\n"
+
+var (
+	// ErrUnsupportedVersion is returned when the peer speaks a different protocol version
+	ErrUnsupportedVersion = errors.New("unsupported protocol version")
+
+	// ErrInvalidToken is returned when a data channel presents an unknown or expired transfer token
+	ErrInvalidToken = errors.New("invalid transfer token")
+)
+
+// ClientHandshake announces our protocol version and waits for the server to accept it
+func ClientHandshake(conn net.Conn) error {
+	return clientHandshake(conn, Message{Type: MsgHello, Version: Version})
+}
+
+// AttachDataChannel turns conn into the data side of a transfer. The server
+// only welcomes it if token is a live one-time transfer token.
+func AttachDataChannel(conn net.Conn, token string) error {
+	return clientHandshake(conn, Message{Type: MsgAttach, Version: Version, Token: token})
+}
+
+func clientHandshake(conn net.Conn, hello Message) error {
+	conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	if err := WriteMessage(conn, hello); err != nil {
+		return fmt.Errorf("sending hello: %v", err)
+	}
+
+	reply, err := ReadMessage(conn)
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return fmt.Errorf("%w: server did not answer the handshake (it may be running an older DrizLink version)", ErrUnsupportedVersion)
+		}
+		return fmt.Errorf("reading handshake reply: %v", err)
+	}
+
+	switch reply.Type {
+	case MsgWelcome:
+		return nil
+	case MsgError:
+		if reply.Code == CodeUnsupportedVersion {
+			return fmt.Errorf("%w: %s", ErrUnsupportedVersion, reply.Text)
+		}
+		if reply.Code == CodeInvalidToken {
+			return fmt.Errorf("%w: %s", ErrInvalidToken, reply.Text)
+		}
+		return errors.New(reply.Text)
+	default:
+		return fmt.Errorf("unexpected handshake reply: %s", reply.Type)
+	}
+}
+
+// ServerHandshake waits for a client's hello and checks its protocol version.
+// Control connections are welcomed straight away; data channel attach requests
+// are returned unanswered so the caller can validate the token first.
+func ServerHandshake(conn net.Conn) (Message, error) {
+	conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	hello, err := ReadMessage(conn)
+	if err != nil {
+		var netErr net.Error
+		if !errors.As(err, &netErr) {
+			// Anything that does not even parse as a frame comes from a client
+			// built before framing existed
+			conn.Write([]byte(legacyClientNotice))
+		}
+		return Message{}, fmt.Errorf("reading hello: %v", err)
+	}
+
+	if hello.Type != MsgHello && hello.Type != MsgAttach {
+		WriteMessage(conn, Message{Type: MsgError, Code: CodeBadRequest, Text: "expected hello"})
+		return Message{}, fmt.Errorf("expected hello, got %s", hello.Type)
+	}
+
+	if hello.Version != Version {
+		WriteMessage(conn, Message{
+			Type:    MsgError,
+			Code:    CodeUnsupportedVersion,
+			Version: Version,
+			Text:    fmt.Sprintf("server speaks protocol version %d, client speaks version %d", Version, hello.Version),
+		})
+		return Message{}, fmt.Errorf("%w: client version %d", ErrUnsupportedVersion, hello.Version)
+	}
+
+	if hello.Type == MsgAttach {
+		return hello, nil
+	}
+	return hello, WriteMessage(conn, Message{Type: MsgWelcome, Version: Version})
+}
@@ -0,0 +1,358 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// MessageType identifies what a control message means
+type MessageType uint8
+
+const (
+	MsgHello MessageType = iota + 1
+	MsgWelcome
+	MsgError
+	MsgLogin
+	MsgReconnect
+	MsgExit
+	MsgPing
+	MsgPong
+	MsgChat
+	MsgNotice
+	MsgStatus
+	MsgUserList
+	MsgCreateRoom
+	MsgJoinRoom
+	MsgLeaveRoom
+	MsgSelectRoom
+	MsgListRooms
+	MsgRoomInfo
+	MsgFileRequest
+	MsgFileResponse
+	MsgFolderRequest
+	MsgFolderResponse
+	MsgLookupRequest
+	MsgDirListing
+	MsgLookupResponse
+	MsgDownloadRequest
+	MsgAttach
+	MsgTransferReady
+	MsgTransferRejected
+	MsgPeerAnnounce
+	MsgRelayReady
+	MsgTransferAccept
+	MsgTransferDecline
+	MsgResumeFrom
+	MsgChunksDone
+	MsgChunkRetry
+	MsgKeyAnnounce
+	MsgRegister
+	MsgSession
+	MsgHistoryRequest
+	MsgHistory
+	MsgDirect
+	MsgReceipt
+	MsgInvite
+	MsgKick
+	MsgBan
+	MsgUnban
+	MsgSetRole
+	MsgTransferOwner
+	MsgRoomAccess
+	MsgRoomPolicy
+	MsgFolderManifest
+	MsgRoomMembers
+)
+
+// String representation of MessageType
+func (t MessageType) String() string {
+	switch t {
+	case MsgHello:
+		return "Hello"
+	case MsgWelcome:
+		return "Welcome"
+	case MsgError:
+		return "Error"
+	case MsgLogin:
+		return "Login"
+	case MsgReconnect:
+		return "Reconnect"
+	case MsgExit:
+		return "Exit"
+	case MsgPing:
+		return "Ping"
+	case MsgPong:
+		return "Pong"
+	case MsgChat:
+		return "Chat"
+	case MsgNotice:
+		return "Notice"
+	case MsgStatus:
+		return "Status"
+	case MsgUserList:
+		return "UserList"
+	case MsgCreateRoom:
+		return "CreateRoom"
+	case MsgJoinRoom:
+		return "JoinRoom"
+	case MsgLeaveRoom:
+		return "LeaveRoom"
+	case MsgSelectRoom:
+		return "SelectRoom"
+	case MsgListRooms:
+		return "ListRooms"
+	case MsgRoomInfo:
+		return "RoomInfo"
+	case MsgFileRequest:
+		return "FileRequest"
+	case MsgFileResponse:
+		return "FileResponse"
+	case MsgFolderRequest:
+		return "FolderRequest"
+	case MsgFolderResponse:
+		return "FolderResponse"
+	case MsgLookupRequest:
+		return "LookupRequest"
+	case MsgDirListing:
+		return "DirListing"
+	case MsgLookupResponse:
+		return "LookupResponse"
+	case MsgDownloadRequest:
+		return "DownloadRequest"
+	case MsgAttach:
+		return "Attach"
+	case MsgTransferReady:
+		return "TransferReady"
+	case MsgTransferRejected:
+		return "TransferRejected"
+	case MsgPeerAnnounce:
+		return "PeerAnnounce"
+	case MsgRelayReady:
+		return "RelayReady"
+	case MsgTransferAccept:
+		return "TransferAccept"
+	case MsgTransferDecline:
+		return "TransferDecline"
+	case MsgResumeFrom:
+		return "ResumeFrom"
+	case MsgChunksDone:
+		return "ChunksDone"
+	case MsgChunkRetry:
+		return "ChunkRetry"
+	case MsgKeyAnnounce:
+		return "KeyAnnounce"
+	case MsgRegister:
+		return "Register"
+	case MsgSession:
+		return "Session"
+	case MsgHistoryRequest:
+		return "HistoryRequest"
+	case MsgHistory:
+		return "History"
+	case MsgDirect:
+		return "Direct"
+	case MsgReceipt:
+		return "Receipt"
+	case MsgInvite:
+		return "Invite"
+	case MsgKick:
+		return "Kick"
+	case MsgBan:
+		return "Ban"
+	case MsgUnban:
+		return "Unban"
+	case MsgSetRole:
+		return "SetRole"
+	case MsgTransferOwner:
+		return "TransferOwner"
+	case MsgRoomAccess:
+		return "RoomAccess"
+	case MsgRoomPolicy:
+		return "RoomPolicy"
+	case MsgFolderManifest:
+		return "FolderManifest"
+	case MsgRoomMembers:
+		return "RoomMembers"
+	default:
+		return fmt.Sprintf("Unknown(%d)", uint8(t))
+	}
+}
+
+// NoticeLevel tells the client how to present a server notice
+type NoticeLevel uint8
+
+const (
+	NoticeInfo NoticeLevel = iota
+	NoticeSuccess
+	NoticeWarning
+	NoticeError
+)
+
+// Error codes carried in MsgError
+const (
+	CodeUnsupportedVersion = "unsupported_version"
+	CodeBadRequest         = "bad_request"
+	CodeInvalidToken       = "invalid_token"
+	CodeAuthFailed         = "auth_failed"
+	CodeUsernameTaken      = "username_taken"
+	CodeInvalidSession     = "invalid_session"
+)
+
+// Delivery states carried in MsgReceipt
+const (
+	ReceiptQueued    = "queued"
+	ReceiptDelivered = "delivered"
+)
+
+// Sync states carried in MsgRoomMembers requests: a client syncing a room
+// announces it with every request, and withdraws when it stops
+const (
+	SyncActive  = "syncing"
+	SyncStopped = "stopped"
+)
+
+// Message is the envelope for every control message. Only the fields that
+// make sense for a given Type are set; the rest are omitted on the wire.
+type Message struct {
+	Type            MessageType   `json:"type"`
+	Version         int           `json:"version,omitempty"`
+	Code            string        `json:"code,omitempty"`
+	Level           NoticeLevel   `json:"level,omitempty"`
+	Text            string        `json:"text,omitempty"`
+	Time            string        `json:"time,omitempty"`
+	Seq             int64         `json:"seq,omitempty"`
+	MessageId       string        `json:"messageId,omitempty"`
+	Status          string        `json:"status,omitempty"`
+	Role            string        `json:"role,omitempty"`
+	Access          string        `json:"access,omitempty"`
+	Setting         string        `json:"setting,omitempty"`
+	Value           string        `json:"value,omitempty"`
+	UserId          string        `json:"userId,omitempty"`
+	Username        string        `json:"username,omitempty"`
+	StorePath       string        `json:"storePath,omitempty"`
+	Password        string        `json:"password,omitempty"`
+	From            string        `json:"from,omitempty"`
+	Target          string        `json:"target,omitempty"`
+	RoomId          string        `json:"roomId,omitempty"`
+	RoomName        string        `json:"roomName,omitempty"`
+	Participants    []string      `json:"participants,omitempty"`
+	Path            string        `json:"path,omitempty"`
+	Token           string        `json:"token,omitempty"`
+	PeerPort        int           `json:"peerPort,omitempty"`
+	PeerAddr        string        `json:"peerAddr,omitempty"`
+	PeerToken       string        `json:"peerToken,omitempty"`
+	PeerFingerprint string        `json:"peerFingerprint,omitempty"`
+	PublicKey       string        `json:"publicKey,omitempty"`
+	Offset          int64         `json:"offset,omitempty"`
+	Before          int64         `json:"before,omitempty"`
+	Limit           int           `json:"limit,omitempty"`
+	Chunks          []int64       `json:"chunks,omitempty"`
+	Transfer        *TransferInfo `json:"transfer,omitempty"`
+	Users           []UserInfo    `json:"users,omitempty"`
+	Entries         []DirEntry    `json:"entries,omitempty"`
+	History         []ChatEntry   `json:"history,omitempty"`
+}
+
+// TransferInfo describes a file or folder payload that follows as data frames
+type TransferInfo struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	// Checksum is computed while the payload streams and travels as a trailer
+	// in MsgChunksDone rather than in the request
+	Checksum string `json:"checksum,omitempty"`
+	// ChecksumAlgorithm names the hash Checksum is computed with, e.g. "sha256"
+	ChecksumAlgorithm string `json:"checksumAlgorithm,omitempty"`
+	// Fingerprint identifies the source by metadata so interrupted transfers
+	// of the same content can be resumed
+	Fingerprint string `json:"fingerprint,omitempty"`
+	// Sync asks the recipient to update its copy of a folder, receiving only
+	// the files it is missing or that differ
+	Sync bool `json:"sync,omitempty"`
+	// Mirror, together with Sync, also deletes files the sender no longer has
+	Mirror bool `json:"mirror,omitempty"`
+	// Room marks a /sync update of the folder the recipient syncs with this
+	// room; such transfers are bound by that room rather than the active one
+	Room string `json:"room,omitempty"`
+	// Extensions lists the file types a folder holds, see helper.FileType, so
+	// the server can apply room file policies without seeing the manifest. The
+	// recipient refuses a manifest with files of any other type.
+	Extensions []string `json:"extensions,omitempty"`
+	// TransferKey is the public half of an X25519 key pair made for this
+	// transfer alone: the sender's in an offer, the recipient's in
+	// MsgTransferReady
+	TransferKey string `json:"transferKey,omitempty"`
+}
+
+// UserInfo is one line of the /status listing
+type UserInfo struct {
+	UserId   string `json:"userId"`
+	Username string `json:"username"`
+	RoomName string `json:"roomName,omitempty"`
+}
+
+// ChatEntry is one stored room message, numbered from 1 in the order the
+// room received them
+type ChatEntry struct {
+	Seq      int64  `json:"seq"`
+	From     string `json:"from"`
+	Username string `json:"username"`
+	Text     string `json:"text"`
+	Time     string `json:"time"`
+}
+
+// DirEntry is one file or folder in a shared directory listing or in the
+// manifest of a folder transfer
+type DirEntry struct {
+	Path       string `json:"path"`
+	Size       int64  `json:"size"`
+	IsDir      bool   `json:"isDir,omitempty"`
+	Executable bool   `json:"executable,omitempty"`
+	// ModTime is in Unix nanoseconds and Hash a hex SHA-256 of the contents;
+	// manifests carry them so unchanged files need not be sent again
+	ModTime int64  `json:"modTime,omitempty"`
+	Hash    string `json:"hash,omitempty"`
+	// Deleted marks an entry a room sync no longer has; it carries no data
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+// WriteMessage encodes msg and sends it as a single control frame
+func WriteMessage(w io.Writer, msg Message) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return WriteFrame(w, ControlFrame, payload)
+}
+
+// ReadMessage returns the next control message. Stray data and chunk frames
+// that are not consumed by a reader are dropped.
+func ReadMessage(r io.Reader) (Message, error) {
+	for {
+		frame, err := ReadFrame(r)
+		if err != nil {
+			return Message{}, err
+		}
+		if frame.Type == ControlFrame {
+			return DecodeMessage(frame.Payload)
+		}
+	}
+}
+
+// DecodeMessage parses the payload of a control frame
+func DecodeMessage(payload []byte) (Message, error) {
+	var msg Message
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		return Message{}, fmt.Errorf("malformed control message: %v", err)
+	}
+	if msg.Type == 0 {
+		return Message{}, fmt.Errorf("control message without a type")
+	}
+	return msg, nil
+}
+
+// Notice builds a MsgNotice with the given level and text
+func Notice(level NoticeLevel, text string) Message {
+	return Message{Type: MsgNotice, Level: level, Text: text}
+}
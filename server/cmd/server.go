@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/tls"
 	helper "drizlink/helper"
 	"drizlink/server/interfaces"
 	connection "drizlink/server/internal"
@@ -38,10 +39,45 @@ func listenForUDPBroadcast(port string) {
 	}
 }
 
+// Self-signed key pair kept next to the server so its fingerprint survives restarts
+const (
+	selfSignedCertFile = "drizlink-cert.pem"
+	selfSignedKeyFile  = "drizlink-key.pem"
+)
+
+// loadCertificate loads the configured key pair, or a self-signed one when none is configured
+func loadCertificate(certFile, keyFile string) (tls.Certificate, error) {
+	if certFile != "" {
+		return tls.LoadX509KeyPair(certFile, keyFile)
+	}
+	cert, created, err := helper.LoadOrCreateCertificate(selfSignedCertFile, selfSignedKeyFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if created {
+		fmt.Println(utils.WarningColor("⚠️  No -tls-cert given, generated a self-signed certificate in " + selfSignedCertFile))
+	} else {
+		fmt.Println(utils.InfoColor("🔒 Using self-signed certificate " + selfSignedCertFile))
+	}
+	return cert, nil
+}
+
 func main() {
 	port := flag.String("port", "8080", "Port to run the server on")
+	certFile := flag.String("tls-cert", "", "TLS certificate file (PEM); a self-signed one is generated when omitted")
+	keyFile := flag.String("tls-key", "", "TLS private key file (PEM) matching -tls-cert")
+	dataFile := flag.String("data", "drizlink-data.json", "File accounts, users and rooms are kept in across restarts")
+	historyReplay := flag.Int("history-replay", connection.DefaultHistoryPage, "Recent room messages sent to members who join or reconnect (0 disables)")
+	queueLimit := flag.Int("queue-limit", connection.DefaultQueueLimit, "Messages kept per user while they are offline; the oldest are dropped beyond this (0 disables queueing)")
+	queueMaxAge := flag.Duration("queue-max-age", connection.DefaultQueueMaxAge, "How long messages wait for an offline user before they expire (0 keeps them until delivered)")
+	sessionKeyFile := flag.String("session-key", "drizlink-session.key", "File holding the key session tokens are signed with; generated when missing")
 	flag.Parse()
 
+	if (*certFile == "") != (*keyFile == "") {
+		fmt.Println(utils.ErrorColor("❌ Error: -tls-cert and -tls-key must be given together"))
+		return
+	}
+
 	// Ensure port starts with a colon for address format
 	formattedPort := *port
 	if !strings.HasPrefix(formattedPort, ":") {
@@ -56,14 +92,52 @@ func main() {
 	}
 
 	utils.PrintBanner()
+
+	cert, err := loadCertificate(*certFile, *keyFile)
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error loading TLS certificate:"), err)
+		return
+	}
+	fmt.Println(utils.InfoColor("🔒 TLS certificate fingerprint (SHA-256):"), utils.CommandColor(helper.LeafFingerprint(cert)))
+
+	store, err := connection.NewFileStore(*dataFile)
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error opening data file:"), err)
+		return
+	}
+	state, err := store.LoadState()
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error loading server state:"), err)
+		return
+	}
+
+	sessionKey, created, err := helper.LoadOrCreateSessionKey(*sessionKeyFile)
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error loading session key:"), err)
+		return
+	}
+	if created {
+		fmt.Println(utils.InfoColor("🔑 Generated session signing key in " + *sessionKeyFile))
+	}
+
 	fmt.Println(utils.InfoColor("Starting server on port " + *port + "..."))
 
 	server := interfaces.Server{
-		Address:     formattedPort,
-		Connections: make(map[string]*interfaces.User),
-		IpAddresses: make(map[string]*interfaces.User),
-		Messages:    make(chan interfaces.Message),
+		Address:       formattedPort,
+		TLS:           &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12},
+		Store:         store,
+		Connections:   make(map[string]*interfaces.User),
+		SessionKey:    sessionKey,
+		HistoryReplay: *historyReplay,
+		QueueLimit:    *queueLimit,
+		QueueMaxAge:   *queueMaxAge,
+		Rooms:         make(map[string]*interfaces.Room),
+		Transfers:     make(map[string]*interfaces.Transfer),
+		Offers:        make(map[string]*interfaces.Transfer),
+		Messages:      make(chan interfaces.Message),
 	}
+	connection.RestoreState(&server, state)
+	fmt.Println(utils.InfoColor(fmt.Sprintf("📦 Loaded %d users and %d rooms from %s", len(state.Users), len(state.Rooms), *dataFile)))
 
 	go connection.StartHeartBeat(100*time.Second, &server)
 	go listenForUDPBroadcast(*port)
@@ -1,25 +1,42 @@
 package interfaces
 
 import (
+	"crypto/tls"
+	"drizlink/protocol"
+	"errors"
 	"net"
 	"sync"
+	"time"
 )
 
 type Server struct {
 	Address     string
+	TLS         *tls.Config
+	Store       Storage
 	Connections map[string]*User
-	IpAddresses map[string]*User
+	SessionKey  []byte
 	Rooms       map[string]*Room
+	Transfers   map[string]*Transfer
+	Offers      map[string]*Transfer
 	Messages    chan Message
 	Mutex       sync.Mutex
+	// HistoryReplay is how many recent messages members get when they join
+	// a room or come back to their active room
+	HistoryReplay int
+	// QueueLimit and QueueMaxAge bound what is kept for offline users; a
+	// QueueLimit of 0 disables queueing
+	QueueLimit  int
+	QueueMaxAge time.Duration
 }
 
+// Message is one room chat message as kept in the room's history log
 type Message struct {
-	SenderId       string
-	SenderUsername string
-	Content        string
-	Timestamp      string
-	RoomId         string
+	Seq            int64  `json:"seq"`
+	SenderId       string `json:"senderId"`
+	SenderUsername string `json:"senderUsername"`
+	Content        string `json:"content"`
+	Timestamp      string `json:"timestamp"`
+	RoomId         string `json:"roomId"`
 }
 
 type User struct {
@@ -30,14 +47,172 @@ type User struct {
 	IsOnline      bool
 	IpAddress     string
 	CurrentRoom   string
+	PeerAddr      string
+	// PeerFingerprint pins the certificate of the user's peer listener
+	PeerFingerprint string
+	// PublicKey is the user's end-to-end encryption key; the server only passes it on
+	PublicKey string
+	// SessionToken is the signed token last issued to the user's client
+	SessionToken string
+	// SyncRooms are the rooms the user's client announced it syncs with /sync,
+	// for its current connection only
+	SyncRooms map[string]bool
 }
 
+// Account is a registered identity. Only a hash of the password is kept.
+type Account struct {
+	UserId       string    `json:"userId"`
+	Username     string    `json:"username"`
+	PasswordHash string    `json:"passwordHash"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+var (
+	ErrAccountNotFound = errors.New("account not found")
+	ErrAccountExists   = errors.New("account already exists")
+	ErrUserIdTaken     = errors.New("user ID already in use")
+)
+
+// AccountStore keeps accounts by username. Create must reject a duplicate
+// username with ErrAccountExists and a duplicate UserId with ErrUserIdTaken.
+// Implementations must be safe for concurrent use.
+type AccountStore interface {
+	Get(username string) (*Account, error)
+	Create(account *Account) error
+}
+
+// Storage persists the server between restarts. Accounts are written as they
+// are created; the rest of the state is saved as a whole after every change.
+type Storage interface {
+	AccountStore
+	LoadState() (*State, error)
+	SaveState(state *State) error
+	HistoryStore
+	QueueStore
+}
+
+// QueuedMessage is a message held for a user who was offline when it was sent
+type QueuedMessage struct {
+	QueuedAt time.Time        `json:"queuedAt"`
+	Message  protocol.Message `json:"message"`
+}
+
+// QueueStore holds messages for offline users until they reconnect
+type QueueStore interface {
+	// Enqueue adds message to the user's queue, dropping the oldest entries
+	// beyond limit
+	Enqueue(userId string, message QueuedMessage, limit int) error
+	// TakeQueued removes and returns the user's queue, oldest first
+	TakeQueued(userId string) ([]QueuedMessage, error)
+}
+
+// HistoryStore keeps an append-only chat log per room
+type HistoryStore interface {
+	// AppendHistory numbers message with the room's next Seq and stores it
+	AppendHistory(message *Message) error
+	// LoadHistory returns up to limit messages of a room older than Seq
+	// before, oldest first; before <= 0 means the newest messages
+	LoadHistory(roomId string, before int64, limit int) ([]Message, error)
+	// DeleteHistory drops a room's log once the room is gone
+	DeleteHistory(roomId string) error
+}
+
+// State is what survives a restart besides accounts: known users, their
+// settings, and rooms with their members
+type State struct {
+	Users []UserRecord `json:"users"`
+	Rooms []RoomRecord `json:"rooms"`
+}
+
+// UserRecord is the persistent part of a User
+type UserRecord struct {
+	UserId        string `json:"userId"`
+	Username      string `json:"username"`
+	StoreFilePath string `json:"storeFilePath,omitempty"`
+	CurrentRoom   string `json:"currentRoom,omitempty"`
+}
+
+// RoomRecord is the persistent part of a Room; Members, Invited and Banned
+// are user IDs
+type RoomRecord struct {
+	RoomId       string              `json:"roomId"`
+	RoomName     string              `json:"roomName"`
+	Creator      string              `json:"creator"`
+	CreatedAt    string              `json:"createdAt"`
+	Members      []string            `json:"members"`
+	Roles        map[string]RoomRole `json:"roles,omitempty"`
+	Access       RoomAccess          `json:"access,omitempty"`
+	PasswordHash string              `json:"passwordHash,omitempty"`
+	Invited      []string            `json:"invited,omitempty"`
+	Banned       []string            `json:"banned,omitempty"`
+	Policy       FilePolicy          `json:"policy"`
+}
+
+// FilePolicy limits file sharing in a room. The zero value lets every member
+// send and browse files of any size and type.
+type FilePolicy struct {
+	// SendRole is the lowest role that may send files and folders
+	SendRole RoomRole `json:"sendRole,omitempty"`
+	// BrowseRole is the lowest role that may look up and download others' files
+	BrowseRole RoomRole `json:"browseRole,omitempty"`
+	// MaxFileSize is in bytes; 0 means no limit
+	MaxFileSize int64 `json:"maxFileSize,omitempty"`
+	// AllowedExtensions, if set, are the only file types accepted, and
+	// DeniedExtensions are always refused. Both are lower case with the dot.
+	AllowedExtensions []string `json:"allowedExtensions,omitempty"`
+	DeniedExtensions  []string `json:"deniedExtensions,omitempty"`
+}
+
+// RoomRole is what a member may do in a room
+type RoomRole string
+
+const (
+	// RoleOwner manages access and moderators; every room has exactly one
+	RoleOwner RoomRole = "owner"
+	// RoleModerator may invite, kick and ban plain members
+	RoleModerator RoomRole = "moderator"
+	// RoleMember is everyone else and is not stored in Room.Roles
+	RoleMember RoomRole = "member"
+)
+
+// RoomAccess decides who may join a room without being added by a moderator
+type RoomAccess string
+
+const (
+	AccessOpen     RoomAccess = "open"
+	AccessInvite   RoomAccess = "invite"
+	AccessPassword RoomAccess = "password"
+)
+
 type Room struct {
 	RoomId      string
 	RoomName    string
 	Creator     string
 	Participants map[string]*User
-	Messages    chan Message
 	CreatedAt   string
+	// Roles holds owner and moderators by user ID
+	Roles       map[string]RoomRole
+	Access      RoomAccess
+	PasswordHash string
+	// Invited users may join once regardless of Access; Banned never may
+	Invited     map[string]bool
+	Banned      map[string]bool
+	Policy      FilePolicy
 	Mutex       sync.Mutex
 }
+
+// Transfer is a payload brokered between two peers. It starts as an offer the
+// recipient must accept. The sender then tries the recipient directly with
+// PeerToken; the relay tokens are the fallback and each side of the relay gets
+// its own one-time token.
+type Transfer struct {
+	TransferId    string
+	Sender        *User
+	Recipient     *User
+	SendToken     string
+	ReceiveToken  string
+	PeerToken     string
+	SenderConn    net.Conn
+	RecipientConn net.Conn
+	CreatedAt     time.Time
+}
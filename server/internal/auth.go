@@ -0,0 +1,238 @@
+package connection
+
+import (
+	"drizlink/helper"
+	"drizlink/protocol"
+	"drizlink/server/interfaces"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// MaxAuthAttempts is how many failed logins a connection gets before it is closed
+const MaxAuthAttempts = 5
+
+// MinPasswordLength is the shortest password accepted at registration
+const MinPasswordLength = 8
+
+// MaxUsernameLength keeps usernames readable in listings and prompts
+const MaxUsernameLength = 32
+
+// authError is a failed authentication attempt the client may retry
+type authError struct {
+	code string
+	text string
+}
+
+func (e *authError) Error() string {
+	return e.text
+}
+
+var errAuthFailed = &authError{protocol.CodeAuthFailed, "invalid username or password"}
+
+// dummyPasswordHash is verified against for unknown usernames, so a failed
+// login takes as long whether or not the account exists
+var (
+	dummyPasswordHash     string
+	dummyPasswordHashOnce sync.Once
+)
+
+// Authenticate runs the login exchange on a new control connection. It returns
+// the user the connection now belongs to and whether that user was already
+// known to the server, e.g. from a previous session.
+func Authenticate(conn net.Conn, server *interfaces.Server, ip string) (*interfaces.User, bool, error) {
+	for attempt := 1; attempt <= MaxAuthAttempts; attempt++ {
+		msg, err := protocol.ReadMessage(conn)
+		if err != nil {
+			return nil, false, err
+		}
+
+		var user *interfaces.User
+		var known bool
+		switch msg.Type {
+		case protocol.MsgRegister:
+			var account *interfaces.Account
+			if account, err = register(server, msg.Username, msg.Password); err == nil {
+				user, known, err = bindSession(server, account, conn, ip, msg.StorePath)
+			}
+		case protocol.MsgLogin:
+			var account *interfaces.Account
+			if account, err = login(server, msg.Username, msg.Password); err == nil {
+				user, known, err = bindSession(server, account, conn, ip, msg.StorePath)
+			}
+		case protocol.MsgReconnect:
+			user, known, err = resumeSession(server, msg.Token, conn, ip, msg.StorePath)
+		default:
+			err = &authError{protocol.CodeBadRequest, "expected login, registration or reconnect"}
+		}
+
+		var failed *authError
+		if errors.As(err, &failed) {
+			fmt.Printf("Authentication from %s failed: %s\n", ip, failed.text)
+			if writeErr := protocol.WriteMessage(conn, protocol.Message{Type: protocol.MsgError, Code: failed.code, Text: failed.text}); writeErr != nil {
+				return nil, false, writeErr
+			}
+			continue
+		}
+		if err != nil {
+			protocol.WriteMessage(conn, protocol.Message{Type: protocol.MsgError, Text: "authentication unavailable, try again later"})
+			return nil, false, err
+		}
+
+		server.Mutex.Lock()
+		session := protocol.Message{
+			Type:     protocol.MsgSession,
+			UserId:   user.UserId,
+			Username: user.Username,
+			Token:    user.SessionToken,
+			RoomId:   user.CurrentRoom,
+		}
+		if room, exists := server.Rooms[user.CurrentRoom]; exists {
+			session.RoomName = room.RoomName
+		}
+		server.Mutex.Unlock()
+		if err := protocol.WriteMessage(conn, session); err != nil {
+			return nil, false, err
+		}
+		return user, known, nil
+	}
+	return nil, false, fmt.Errorf("too many failed authentication attempts")
+}
+
+// register creates an account, hashing the password before it is stored
+func register(server *interfaces.Server, username, password string) (*interfaces.Account, error) {
+	if err := validateUsername(username); err != nil {
+		return nil, err
+	}
+	if len(password) < MinPasswordLength {
+		return nil, &authError{protocol.CodeBadRequest, fmt.Sprintf("password must be at least %d characters", MinPasswordLength)}
+	}
+
+	hash, err := helper.HashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+	account := &interfaces.Account{
+		Username:     username,
+		PasswordHash: hash,
+		CreatedAt:    time.Now(),
+	}
+	// IDs are random, so retry the rare one that is already taken
+	for {
+		account.UserId = helper.GenerateUserId()
+		err = server.Store.Create(account)
+		if !errors.Is(err, interfaces.ErrUserIdTaken) {
+			break
+		}
+	}
+	if errors.Is(err, interfaces.ErrAccountExists) {
+		return nil, &authError{protocol.CodeUsernameTaken, "username " + username + " is already taken"}
+	}
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("Registered account %s (ID: %s)\n", account.Username, account.UserId)
+	return account, nil
+}
+
+// login checks a username and password against the account store
+func login(server *interfaces.Server, username, password string) (*interfaces.Account, error) {
+	account, err := server.Store.Get(username)
+	if errors.Is(err, interfaces.ErrAccountNotFound) {
+		dummyPasswordHashOnce.Do(func() {
+			dummyPasswordHash, _ = helper.HashPassword("drizlink")
+		})
+		helper.VerifyPassword(password, dummyPasswordHash)
+		return nil, errAuthFailed
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !helper.VerifyPassword(password, account.PasswordHash) {
+		return nil, errAuthFailed
+	}
+	return account, nil
+}
+
+// bindSession attaches conn to the account's user, creating it when the server
+// has not seen it since starting. An existing user keeps its rooms and active
+// room, and a session still open elsewhere is taken over.
+func bindSession(server *interfaces.Server, account *interfaces.Account, conn net.Conn, ip, storePath string) (*interfaces.User, bool, error) {
+	now := time.Now()
+	token, err := helper.SignSessionToken(server.SessionKey, helper.SessionClaims{
+		UserId:    account.UserId,
+		Username:  account.Username,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(helper.SessionLifetime).Unix(),
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	server.Mutex.Lock()
+	defer server.Mutex.Unlock()
+
+	user, known := server.Connections[account.UserId]
+	if !known {
+		user = &interfaces.User{UserId: account.UserId}
+		server.Connections[user.UserId] = user
+	}
+	user.Username = account.Username
+	if storePath != "" {
+		user.StoreFilePath = storePath
+	}
+
+	if user.Conn != nil && user.Conn != conn {
+		_ = sendNotice(user.Conn, protocol.NoticeWarning, "⚠️  You logged in from another connection, closing this one")
+		user.Conn.Close()
+	}
+	user.SessionToken = token
+	user.Conn = conn
+	user.IpAddress = ip
+	// Messages keep queueing until catchUp has delivered the backlog
+	user.IsOnline = false
+	// The new connection announces its room syncs, key and peer listener
+	// afresh; until then none of the old connection's are handed out
+	user.SyncRooms = nil
+	user.PublicKey = ""
+	user.PeerAddr = ""
+	user.PeerFingerprint = ""
+	saveStateLocked(server)
+	return user, known, nil
+}
+
+// resumeSession reattaches a user by the signed token issued at login. The
+// token is not tied to an address, so clients that changed networks resume
+// where they left off.
+func resumeSession(server *interfaces.Server, token string, conn net.Conn, ip, storePath string) (*interfaces.User, bool, error) {
+	claims, err := helper.VerifySessionToken(server.SessionKey, token, time.Now())
+	if err != nil {
+		return nil, false, &authError{protocol.CodeInvalidSession, "session expired, please log in again"}
+	}
+	account, err := server.Store.Get(claims.Username)
+	if errors.Is(err, interfaces.ErrAccountNotFound) || (err == nil && account.UserId != claims.UserId) {
+		return nil, false, &authError{protocol.CodeInvalidSession, "account no longer exists, please log in again"}
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return bindSession(server, account, conn, ip, storePath)
+}
+
+// validateUsername rejects names that would break command parsing or listings
+func validateUsername(username string) error {
+	if username == "" {
+		return &authError{protocol.CodeBadRequest, "username must not be empty"}
+	}
+	if len(username) > MaxUsernameLength {
+		return &authError{protocol.CodeBadRequest, fmt.Sprintf("username must be at most %d characters", MaxUsernameLength)}
+	}
+	if strings.IndexFunc(username, func(r rune) bool { return unicode.IsSpace(r) || !unicode.IsPrint(r) }) >= 0 {
+		return &authError{protocol.CodeBadRequest, "username must not contain spaces"}
+	}
+	return nil
+}
@@ -1,7 +1,9 @@
 package connection
 
 import (
+	"crypto/tls"
 	"drizlink/helper"
+	"drizlink/protocol"
 	"drizlink/server/interfaces"
 	"fmt"
 	"net"
@@ -24,7 +26,8 @@ func Close(conn net.Conn) {
 }
 
 func Start(server *interfaces.Server) {
-	listen, err := net.Listen("tcp", server.Address)
+	// Control connections and relayed payloads share the listener, so TLS covers both
+	listen, err := tls.Listen("tcp", server.Address, server.TLS)
 	if err != nil {
 		fmt.Println("error in listen")
 		panic(err)
@@ -46,288 +49,366 @@ func Start(server *interfaces.Server) {
 
 func HandleConnection(conn net.Conn, server *interfaces.Server) {
 	ipAddr := conn.RemoteAddr().String()
-	ip := strings.Split(ipAddr, ":")[0]
+	// SplitHostPort also takes the brackets off IPv6 addresses
+	ip, _, err := net.SplitHostPort(ipAddr)
+	if err != nil {
+		ip = ipAddr
+	}
 	fmt.Println("New connection from", ip)
-	if existingUser := server.IpAddresses[ip]; existingUser != nil {
-		fmt.Println("Connection already exists for IP:", ip)
-		// Send reconnection signal with existing user data
-		reconnectMsg := fmt.Sprintf("/RECONNECT %s %s", existingUser.Username, existingUser.StoreFilePath)
-		_, err := conn.Write([]byte(reconnectMsg))
-		if err != nil {
-			fmt.Println("Error sending reconnect signal:", err)
-			return
-		}
-
-		// Update connection and online status
-		server.Mutex.Lock()
-		existingUser.Conn = conn
-		existingUser.IsOnline = true
-		server.Mutex.Unlock()
 
-		// Encrypt and broadcast welcome back message
-		welcomeMsg := fmt.Sprintf("User %s has rejoined the chat", existingUser.Username)
-		BroadcastGlobalMessage(welcomeMsg, server, existingUser)
-
-		// Start handling messages for the reconnected user
-		handleUserMessages(conn, existingUser, server)
+	// Agree on the protocol version before anything else is exchanged
+	hello, err := protocol.ServerHandshake(conn)
+	if err != nil {
+		fmt.Printf("Handshake with %s failed: %v\n", ip, err)
+		conn.Close()
 		return
 	}
 
-	buffer := make([]byte, 1024)
-	n, err := conn.Read(buffer)
-	if err != nil {
-		fmt.Println("error in read username")
+	// Transfer payloads arrive on their own connections
+	if hello.Type == protocol.MsgAttach {
+		HandleDataChannel(conn, server, hello)
 		return
 	}
-	username := string(buffer[:n])
 
-	n, err = conn.Read(buffer)
+	// Identify the user by account or session token, never by address alone
+	user, known, err := Authenticate(conn, server, ip)
 	if err != nil {
-		fmt.Println("error in read storeFilePath")
+		fmt.Printf("Authentication from %s ended: %v\n", ip, err)
+		conn.Close()
 		return
 	}
-	storeFilePath := string(buffer[:n])
-
-	userId := helper.GenerateUserId()
-
-	user := &interfaces.User{
-		UserId:        userId,
-		Username:      username,
-		StoreFilePath: storeFilePath,
-		Conn:          conn,
-		IsOnline:      true,
-		IpAddress:     ip,
-	}
 
 	server.Mutex.Lock()
-	server.Connections[user.UserId] = user
-	server.IpAddresses[ip] = user
-
 	// Initialize rooms map if not exists
 	if server.Rooms == nil {
 		server.Rooms = make(map[string]*interfaces.Room)
 	}
 	server.Mutex.Unlock()
 
-	welcomeMsg := fmt.Sprintf("User %s has joined the chat", username)
-	BroadcastGlobalMessage(welcomeMsg, server, user)
+	if known {
+		BroadcastNotice(fmt.Sprintf("🔄 User %s has rejoined the chat", user.Username), server, user)
+		fmt.Printf("User reconnected: %s (ID: %s)\n", user.Username, user.UserId)
+	} else {
+		BroadcastNotice(fmt.Sprintf("👋 User %s has joined the chat", user.Username), server, user)
+		fmt.Printf("New user connected: %s (ID: %s)\n", user.Username, user.UserId)
+	}
 
-	fmt.Printf("New user connected: %s (ID: %s)\n", username, userId)
+	// Pick up the conversation and hand over what was missed; the user only
+	// goes online once that is done
+	catchUp(server, user)
 
-	// Start handling messages for the new user
+	// Start handling messages for the user
 	handleUserMessages(conn, user, server)
 }
 
+// moderationCommands names the client command behind each moderation
+// message, for usage errors
+var moderationCommands = map[protocol.MessageType]string{
+	protocol.MsgInvite:        "/invite",
+	protocol.MsgKick:          "/kick",
+	protocol.MsgBan:           "/ban",
+	protocol.MsgUnban:         "/unban",
+	protocol.MsgTransferOwner: "/transferowner",
+}
+
 func handleUserMessages(conn net.Conn, user *interfaces.User, server *interfaces.Server) {
 	for {
-		buffer := make([]byte, 1024)
-		n, err := conn.Read(buffer)
+		msg, err := protocol.ReadMessage(conn)
 		if err != nil {
 			fmt.Printf("User disconnected: %s\n", user.Username)
-			server.Mutex.Lock()
-			user.IsOnline = false
-			server.Mutex.Unlock()
-			offlineMsg := fmt.Sprintf("User %s is now offline", user.Username)
-			BroadcastGlobalMessage(offlineMsg, server, user)
+			markOffline(conn, user, server)
 			return
 		}
 
-		messageContent := string(buffer[:n])
-
-		switch {
-		case messageContent == "/exit":
-			server.Mutex.Lock()
-			user.IsOnline = false
-			server.Mutex.Unlock()
-			offlineMsg := fmt.Sprintf("User %s is now offline", user.Username)
-			BroadcastGlobalMessage(offlineMsg, server, user)
+		switch msg.Type {
+		case protocol.MsgExit:
+			markOffline(conn, user, server)
 			return
-		case strings.HasPrefix(messageContent, "/createroom"):
-			args := strings.Fields(messageContent)
-			if len(args) < 3 {
-				_, err = conn.Write([]byte("❌ Invalid arguments. Use: /createroom <roomName> <userId1> [userId2] ...\n"))
+		case protocol.MsgCreateRoom:
+			if msg.RoomName == "" || len(msg.Participants) == 0 {
+				err = sendNotice(conn, protocol.NoticeError, "❌ Invalid arguments. Use: /createroom <roomName> <userId1> [userId2] ...")
 				if err != nil {
 					fmt.Println("Error sending create room error:", err)
 				}
 				continue
 			}
-			roomName := args[1]
-			participantIds := args[2:]
-			HandleCreateRoom(server, user, roomName, participantIds)
+			HandleCreateRoom(server, user, msg.RoomName, msg.Participants)
 			continue
-		case strings.HasPrefix(messageContent, "/joinroom"):
-			args := strings.Fields(messageContent)
-			if len(args) != 2 {
-				_, err = conn.Write([]byte("❌ Invalid arguments. Use: /joinroom <roomId>\n"))
+		case protocol.MsgJoinRoom:
+			if msg.RoomId == "" {
+				err = sendNotice(conn, protocol.NoticeError, "❌ Invalid arguments. Use: /joinroom <roomId>")
 				if err != nil {
 					fmt.Println("Error sending join room error:", err)
 				}
 				continue
 			}
-			roomId := args[1]
-			HandleJoinRoom(server, user, roomId)
+			HandleJoinRoom(server, user, msg.RoomId, msg.Password)
 			continue
-		case strings.HasPrefix(messageContent, "/leaveroom"):
-			args := strings.Fields(messageContent)
-			if len(args) != 2 {
-				_, err = conn.Write([]byte("❌ Invalid arguments. Use: /leaveroom <roomId>\n"))
+		case protocol.MsgLeaveRoom:
+			if msg.RoomId == "" {
+				err = sendNotice(conn, protocol.NoticeError, "❌ Invalid arguments. Use: /leaveroom <roomId>")
 				if err != nil {
 					fmt.Println("Error sending leave room error:", err)
 				}
 				continue
 			}
-			roomId := args[1]
-			HandleLeaveRoom(server, user, roomId)
+			HandleLeaveRoom(server, user, msg.RoomId)
 			continue
-		case strings.HasPrefix(messageContent, "/selectroom"):
-			args := strings.Fields(messageContent)
-			if len(args) != 2 {
-				_, err = conn.Write([]byte("❌ Invalid arguments. Use: /selectroom <roomId>\n"))
+		case protocol.MsgSelectRoom:
+			if msg.RoomId == "" {
+				err = sendNotice(conn, protocol.NoticeError, "❌ Invalid arguments. Use: /selectroom <roomId>")
 				if err != nil {
 					fmt.Println("Error sending select room error:", err)
 				}
 				continue
 			}
-			roomId := args[1]
-			HandleSelectRoom(server, user, roomId)
+			HandleSelectRoom(server, user, msg.RoomId)
 			continue
-		case strings.HasPrefix(messageContent, "/listrooms"):
-			HandleListRooms(server, user)
+		case protocol.MsgInvite, protocol.MsgKick, protocol.MsgBan, protocol.MsgUnban, protocol.MsgTransferOwner:
+			if msg.RoomId == "" || msg.Target == "" {
+				err = sendNotice(conn, protocol.NoticeError, fmt.Sprintf("❌ Invalid arguments. Use: %s <roomId> <user>", moderationCommands[msg.Type]))
+				if err != nil {
+					fmt.Println("Error sending moderation error:", err)
+				}
+				continue
+			}
+			switch msg.Type {
+			case protocol.MsgInvite:
+				HandleInvite(server, user, msg.RoomId, msg.Target)
+			case protocol.MsgKick:
+				HandleKick(server, user, msg.RoomId, msg.Target, false)
+			case protocol.MsgBan:
+				HandleKick(server, user, msg.RoomId, msg.Target, true)
+			case protocol.MsgUnban:
+				HandleUnban(server, user, msg.RoomId, msg.Target)
+			case protocol.MsgTransferOwner:
+				HandleTransferOwnership(server, user, msg.RoomId, msg.Target)
+			}
 			continue
-		case strings.HasPrefix(messageContent, "/roominfo"):
-			args := strings.Fields(messageContent)
-			if len(args) != 2 {
-				_, err = conn.Write([]byte("❌ Invalid arguments. Use: /roominfo <roomId>\n"))
+		case protocol.MsgSetRole:
+			if msg.RoomId == "" || msg.Target == "" || msg.Role == "" {
+				err = sendNotice(conn, protocol.NoticeError, "❌ Invalid arguments. Use: /role <roomId> <user> <moderator|member>")
 				if err != nil {
-					fmt.Println("Error sending room info error:", err)
+					fmt.Println("Error sending set role error:", err)
 				}
 				continue
 			}
-			roomId := args[1]
-			HandleRoomInfo(server, user, roomId)
-			return
-		case strings.HasPrefix(messageContent, "/FILE_REQUEST"):
-			args := strings.SplitN(messageContent, " ", 5) // Updated to include checksum
-			if len(args) < 4 {
-				fmt.Println("Invalid arguments. Use: /FILE_REQUEST <userId> <filename> <fileSize> [checksum]")
+			HandleSetRole(server, user, msg.RoomId, msg.Target, interfaces.RoomRole(msg.Role))
+			continue
+		case protocol.MsgRoomAccess:
+			if msg.RoomId == "" || msg.Access == "" {
+				err = sendNotice(conn, protocol.NoticeError, "❌ Invalid arguments. Use: /roomaccess <roomId> <open|invite|password> [password]")
+				if err != nil {
+					fmt.Println("Error sending room access error:", err)
+				}
 				continue
 			}
-			recipientId := args[1]
-			fileName := args[2]
-			fileSizeStr := strings.TrimSpace(args[3])
-			fileSize, err := strconv.ParseInt(fileSizeStr, 10, 64)
-
-			// Include checksum in filename if provided
-			if len(args) == 5 {
-				checksum := strings.TrimSpace(args[4])
-				fileName = fileName + "|" + checksum
+			HandleRoomAccess(server, user, msg.RoomId, interfaces.RoomAccess(msg.Access), msg.Password)
+			continue
+		case protocol.MsgRoomPolicy:
+			if msg.RoomId == "" || msg.Setting == "" || msg.Value == "" {
+				err = sendNotice(conn, protocol.NoticeError, "❌ Invalid arguments. Use: /roompolicy <roomId> <send|browse|maxsize|allow|deny> <value>")
+				if err != nil {
+					fmt.Println("Error sending room policy error:", err)
+				}
+				continue
 			}
-
-			if err != nil {
-				fmt.Println("Invalid fileSize. Use: /FILE_REQUEST <userId> <filename> <fileSize> [checksum]")
+			HandleRoomPolicy(server, user, msg.RoomId, msg.Setting, msg.Value)
+			continue
+		case protocol.MsgListRooms:
+			HandleListRooms(server, user)
+			continue
+		case protocol.MsgHistoryRequest:
+			if msg.RoomId == "" || msg.Limit < 0 || msg.Before < 0 {
+				err = sendNotice(conn, protocol.NoticeError, "❌ Invalid arguments. Use: /history <roomId> [n]")
+				if err != nil {
+					fmt.Println("Error sending history error:", err)
+				}
 				continue
 			}
-
-			HandleFileTransfer(server, conn, recipientId, fileName, fileSize)
+			HandleHistoryRequest(server, user, msg.RoomId, msg.Before, msg.Limit)
 			continue
-		case strings.HasPrefix(messageContent, "/FOLDER_REQUEST"):
-			args := strings.SplitN(messageContent, " ", 5) // Updated to include checksum
-			if len(args) < 4 {
-				fmt.Println("Invalid arguments. Use: /FOLDER_REQUEST <userId> <folderName> <folderSize> [checksum]")
+		case protocol.MsgRoomInfo:
+			if msg.RoomId == "" {
+				err = sendNotice(conn, protocol.NoticeError, "❌ Invalid arguments. Use: /roominfo <roomId>")
+				if err != nil {
+					fmt.Println("Error sending room info error:", err)
+				}
 				continue
 			}
-			recipientId := args[1]
-			folderName := args[2]
-			folderSizeStr := strings.TrimSpace(args[3])
-			folderSize, err := strconv.ParseInt(folderSizeStr, 10, 64)
-
-			// Include checksum in foldername if provided
-			if len(args) == 5 {
-				checksum := strings.TrimSpace(args[4])
-				folderName = folderName + "|" + checksum
+			HandleRoomInfo(server, user, msg.RoomId)
+			continue
+		case protocol.MsgRoomMembers:
+			if msg.RoomId == "" {
+				fmt.Println("Invalid room members request from", user.Username)
+				continue
 			}
-
-			if err != nil {
-				fmt.Println("Invalid folderSize. Use: /FOLDER_REQUEST <userId> <folderName> <folderSize> [checksum]")
+			HandleRoomMembers(server, user, msg.RoomId, msg.Status)
+			continue
+		case protocol.MsgFileRequest:
+			if msg.Target == "" || msg.Transfer == nil || msg.Transfer.Size < 0 {
+				fmt.Println("Invalid file request from", user.Username)
 				continue
 			}
-
-			HandleFolderTransfer(server, conn, recipientId, folderName, folderSize)
+			HandleFileTransfer(server, user, msg.Target, *msg.Transfer)
 			continue
-		case messageContent == "PONG\n":
+		case protocol.MsgFolderRequest:
+			if msg.Target == "" || msg.Transfer == nil || msg.Transfer.Size < 0 {
+				fmt.Println("Invalid folder request from", user.Username)
+				continue
+			}
+			HandleFolderTransfer(server, user, msg.Target, *msg.Transfer)
 			continue
-		case strings.HasPrefix(messageContent, "/status"):
-			_, err = conn.Write([]byte("USERS:\n"))
-			if err != nil {
-				fmt.Println("Error sending user list header:", err)
+		case protocol.MsgPong:
+			continue
+		case protocol.MsgTransferAccept, protocol.MsgTransferDecline:
+			HandleTransferAnswer(server, user, msg)
+			continue
+		case protocol.MsgPeerAnnounce:
+			// Peers are reached on the address the server sees them from
+			if msg.PeerPort <= 0 || msg.PeerPort > 65535 {
+				fmt.Printf("Ignoring invalid peer port from %s: %d\n", user.Username, msg.PeerPort)
 				continue
 			}
 			server.Mutex.Lock()
+			user.PeerAddr = net.JoinHostPort(user.IpAddress, strconv.Itoa(msg.PeerPort))
+			user.PeerFingerprint = msg.PeerFingerprint
+			server.Mutex.Unlock()
+			fmt.Printf("User %s accepts direct transfers on %s\n", user.Username, user.PeerAddr)
+			continue
+		case protocol.MsgKeyAnnounce:
+			// Payloads are encrypted between peers; the server never sees the keys they derive
+			if _, err := helper.ParsePublicKey(msg.PublicKey); err != nil {
+				fmt.Printf("Ignoring invalid public key from %s: %v\n", user.Username, err)
+				continue
+			}
+			server.Mutex.Lock()
+			user.PublicKey = msg.PublicKey
+			server.Mutex.Unlock()
+			fmt.Printf("User %s announced encryption key %s\n", user.Username, helper.KeyFingerprint(msg.PublicKey))
+			continue
+		case protocol.MsgStatus:
+			var users []protocol.UserInfo
+			server.Mutex.Lock()
 			for _, user := range server.Connections {
 				if user.IsOnline {
-					roomStatus := "No room"
+					info := protocol.UserInfo{UserId: user.UserId, Username: user.Username}
 					if user.CurrentRoom != "" {
 						if room, exists := server.Rooms[user.CurrentRoom]; exists {
-							roomStatus = fmt.Sprintf("In room: %s", room.RoomName)
+							info.RoomName = room.RoomName
 						}
 					}
-					statusMsg := fmt.Sprintf("%s [ID: %s] - %s\n", user.Username, user.UserId, roomStatus)
-					_, err = conn.Write([]byte(statusMsg))
-					if err != nil {
-						fmt.Println("Error sending user list:", err)
-						continue
-					}
+					users = append(users, info)
 				}
 			}
 			server.Mutex.Unlock()
+			err = protocol.WriteMessage(conn, protocol.Message{Type: protocol.MsgUserList, Users: users})
+			if err != nil {
+				fmt.Println("Error sending user list:", err)
+			}
 			continue
-		case strings.HasPrefix(messageContent, "/LOOK"):
-			args := strings.SplitN(messageContent, " ", 2)
-			if len(args) != 2 {
-				fmt.Println("Invalid arguments. Use: /LOOK <userId>")
+		case protocol.MsgLookupRequest:
+			if msg.Target == "" {
+				fmt.Println("Invalid lookup request from", user.Username)
 				continue
 			}
-			recipientId := strings.TrimSpace(args[1])
-			HandleLookupRequest(server, conn, recipientId)
+			HandleLookupRequest(server, user, msg.Target)
 			continue
-		case strings.HasPrefix(messageContent, "/DIR_LISTING"):
-			args := strings.SplitN(messageContent, " ", 3)
-			if len(args) != 3 {
-				fmt.Println("Invalid arguments. Use: /DIR_LISTING <userId> <files>")
+		case protocol.MsgDirListing:
+			if msg.Target == "" {
+				fmt.Println("Invalid directory listing from", user.Username)
 				continue
 			}
-			userId := strings.TrimSpace(args[1])
-			files := strings.TrimSpace(args[2])
-			HandleLookupResponse(server, conn, userId, strings.Split(files, " "))
+			HandleLookupResponse(server, user, msg.Target, msg.Entries)
 			continue
-		case strings.HasPrefix(messageContent, "/DOWNLOAD_REQUEST"):
-			args := strings.SplitN(messageContent, " ", 3)
-			if len(args) != 3 {
-				fmt.Println("Invalid arguments. Use: /DOWNLOAD_REQUEST <userId> <filename>")
+		case protocol.MsgDownloadRequest:
+			if msg.Target == "" || msg.Path == "" {
+				fmt.Println("Invalid download request from", user.Username)
 				continue
 			}
-			senderId := strings.TrimSpace(args[1])
-			recipientId := user.UserId
-			filePath := strings.TrimSpace(args[2])
-			HandleDownloadRequest(server, conn, senderId, recipientId, filePath)
+			HandleDownloadRequest(server, user, msg.Target, msg.Path)
 			continue
-		default:
+		case protocol.MsgDirect:
+			if msg.Target == "" || msg.Text == "" || len(msg.MessageId) > MaxMessageIdLength {
+				err = sendNotice(conn, protocol.NoticeError, "❌ Invalid arguments. Use: /msg <user> <text>")
+				if err != nil {
+					fmt.Println("Error sending direct message error:", err)
+				}
+				continue
+			}
+			HandleDirectMessage(server, user, msg.Target, msg.Text, msg.MessageId)
+			continue
+		case protocol.MsgChat:
 			// Send message to current room or globally if no room selected
 			if user.CurrentRoom != "" {
-				BroadcastRoomMessage(messageContent, server, user, user.CurrentRoom)
+				BroadcastRoomMessage(msg.Text, server, user, user.CurrentRoom)
 			} else {
-				BroadcastGlobalMessage(messageContent, server, user)
+				BroadcastGlobalMessage(msg.Text, server, user)
 			}
+		default:
+			fmt.Printf("Unexpected %s message from %s\n", msg.Type, user.Username)
 		}
 	}
 }
 
+// markOffline records that conn went away, unless the user has since
+// logged in again on another connection
+func markOffline(conn net.Conn, user *interfaces.User, server *interfaces.Server) {
+	server.Mutex.Lock()
+	if user.Conn != conn {
+		server.Mutex.Unlock()
+		return
+	}
+	user.IsOnline = false
+	server.Mutex.Unlock()
+	offlineMsg := fmt.Sprintf("👋 User %s is now offline", user.Username)
+	BroadcastNotice(offlineMsg, server, user)
+}
+
+// findUserLocked resolves ref, either a user ID or a username, to a user the
+// server knows. IDs win if a username happens to look like one. The caller
+// holds server.Mutex.
+func findUserLocked(server *interfaces.Server, ref string) *interfaces.User {
+	if user, exists := server.Connections[ref]; exists {
+		return user
+	}
+	for _, user := range server.Connections {
+		if strings.EqualFold(user.Username, ref) {
+			return user
+		}
+	}
+	return nil
+}
+
+// sendNotice writes a user-facing status line to conn
+func sendNotice(conn net.Conn, level protocol.NoticeLevel, text string) error {
+	return protocol.WriteMessage(conn, protocol.Notice(level, text))
+}
+
 func BroadcastGlobalMessage(content string, server *interfaces.Server, sender *interfaces.User) {
 	server.Mutex.Lock()
 	defer server.Mutex.Unlock()
+	chat := protocol.Message{Type: protocol.MsgChat, From: sender.UserId, Username: sender.Username, Text: content}
 	for _, recipient := range server.Connections {
 		if recipient.IsOnline && recipient != sender {
-			_, _ = recipient.Conn.Write([]byte(fmt.Sprintf("%s: %s\n", sender.Username, content)))
+			_ = protocol.WriteMessage(recipient.Conn, chat)
+		}
+	}
+}
+
+// BroadcastNotice tells every other online user about a presence change of subject
+func BroadcastNotice(content string, server *interfaces.Server, subject *interfaces.User) {
+	server.Mutex.Lock()
+	defer server.Mutex.Unlock()
+	broadcastNoticeLocked(content, server, subject)
+}
+
+// broadcastNoticeLocked is BroadcastNotice for callers that already hold server.Mutex
+func broadcastNoticeLocked(content string, server *interfaces.Server, subject *interfaces.User) {
+	notice := protocol.Notice(protocol.NoticeWarning, content)
+	for _, recipient := range server.Connections {
+		if recipient.IsOnline && recipient != subject {
+			_ = protocol.WriteMessage(recipient.Conn, notice)
 		}
 	}
 }
@@ -338,16 +419,31 @@ func BroadcastRoomMessage(content string, server *interfaces.Server, sender *int
 
 	room, exists := server.Rooms[roomId]
 	if !exists {
-		_, _ = sender.Conn.Write([]byte("❌ Room not found\n"))
+		_ = sendNotice(sender.Conn, protocol.NoticeError, "❌ Room not found")
 		return
 	}
 
 	room.Mutex.Lock()
 	defer room.Mutex.Unlock()
 
+	seq := recordRoomMessage(server, room, sender, content)
+
+	chat := protocol.Message{
+		Type:     protocol.MsgChat,
+		From:     sender.UserId,
+		Username: sender.Username,
+		RoomId:   room.RoomId,
+		RoomName: room.RoomName,
+		Text:     content,
+		Seq:      seq,
+	}
 	for _, participant := range room.Participants {
-		if participant.IsOnline && participant != sender {
-			_, _ = participant.Conn.Write([]byte(fmt.Sprintf("[%s] %s: %s\n", room.RoomName, sender.Username, content)))
+		if participant == sender {
+			continue
+		}
+		// Members who are away, or whose connection just failed, get it later
+		if !participant.IsOnline || protocol.WriteMessage(participant.Conn, chat) != nil {
+			queueMessageLocked(server, participant, chat)
 		}
 	}
 }
@@ -359,11 +455,11 @@ func StartHeartBeat(interval time.Duration, server *interfaces.Server) {
 			server.Mutex.Lock()
 			for _, user := range server.Connections {
 				if user.IsOnline {
-					_, err := user.Conn.Write([]byte("PING\n"))
+					err := protocol.WriteMessage(user.Conn, protocol.Message{Type: protocol.MsgPing})
 					if err != nil {
 						fmt.Printf("User disconnected: %s\n", user.Username)
 						user.IsOnline = false
-						BroadcastGlobalMessage(fmt.Sprintf("User %s is now offline", user.Username), server, user)
+						broadcastNoticeLocked(fmt.Sprintf("👋 User %s is now offline", user.Username), server, user)
 					}
 				}
 			}
@@ -0,0 +1,76 @@
+package connection
+
+import (
+	"drizlink/helper"
+	"drizlink/protocol"
+	"drizlink/server/interfaces"
+	"fmt"
+)
+
+// MaxMessageIdLength bounds the client-chosen ID of a direct message
+const MaxMessageIdLength = 32
+
+// HandleDirectMessage routes a private message from sender to the user named
+// by target. Online recipients get it right away; offline ones find it
+// queued when they log in. Either way the sender gets a receipt.
+func HandleDirectMessage(server *interfaces.Server, sender *interfaces.User, target, text, messageId string) {
+	server.Mutex.Lock()
+	defer server.Mutex.Unlock()
+
+	recipient := findUserLocked(server, target)
+	if recipient == nil {
+		_ = sendNotice(sender.Conn, protocol.NoticeError, fmt.Sprintf("❌ User %s not found", target))
+		return
+	}
+	if recipient == sender {
+		_ = sendNotice(sender.Conn, protocol.NoticeError, "❌ You cannot send a direct message to yourself")
+		return
+	}
+	if messageId == "" {
+		messageId = helper.GenerateMessageId()
+	}
+
+	direct := protocol.Message{
+		Type:      protocol.MsgDirect,
+		From:      sender.UserId,
+		Username:  sender.Username,
+		Target:    recipient.UserId,
+		Text:      text,
+		MessageId: messageId,
+	}
+	if recipient.IsOnline && protocol.WriteMessage(recipient.Conn, direct) == nil {
+		sendReceiptLocked(server, sender, recipient, messageId, protocol.ReceiptDelivered)
+		return
+	}
+	if !queueMessageLocked(server, recipient, direct) {
+		_ = sendNotice(sender.Conn, protocol.NoticeError, fmt.Sprintf("❌ %s is offline and messages cannot be queued on this server", recipient.Username))
+		return
+	}
+	sendReceiptLocked(server, sender, recipient, messageId, protocol.ReceiptQueued)
+}
+
+// directDeliveredLocked tells the sender of a queued direct message that it
+// has now reached its recipient. The caller holds server.Mutex.
+func directDeliveredLocked(server *interfaces.Server, direct protocol.Message, recipient *interfaces.User) {
+	sender, exists := server.Connections[direct.From]
+	if !exists {
+		return
+	}
+	sendReceiptLocked(server, sender, recipient, direct.MessageId, protocol.ReceiptDelivered)
+}
+
+// sendReceiptLocked reports the delivery state of a direct message to its
+// sender, queueing the receipt if the sender has gone offline meanwhile. The
+// caller holds server.Mutex.
+func sendReceiptLocked(server *interfaces.Server, sender, recipient *interfaces.User, messageId, status string) {
+	receipt := protocol.Message{
+		Type:      protocol.MsgReceipt,
+		Target:    recipient.UserId,
+		Username:  recipient.Username,
+		MessageId: messageId,
+		Status:    status,
+	}
+	if !sender.IsOnline || protocol.WriteMessage(sender.Conn, receipt) != nil {
+		queueMessageLocked(server, sender, receipt)
+	}
+}
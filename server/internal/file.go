@@ -1,76 +1,56 @@
 package connection
 
 import (
+	"drizlink/helper"
+	"drizlink/protocol"
 	"drizlink/server/interfaces"
 	"fmt"
-	"io"
-	"net"
-	"strings"
 )
 
-func HandleFileTransfer(server *interfaces.Server, conn net.Conn, recipientId, fileName string, fileSize int64) {
-	// Get sender information
-	var sender *interfaces.User
-	for _, user := range server.Connections {
-		if user.Conn == conn {
-			sender = user
-			break
-		}
-	}
-	
-	if sender == nil {
-		fmt.Println("Error: Could not identify sender")
-		return
-	}
-	
-	// Extract checksum if present
-	checksum := ""
-	fileNameWithChecksum := fileName
-	
-	parts := strings.SplitN(fileName, "|", 2)
-	if len(parts) == 2 {
-		fileName = parts[0]
-		checksum = parts[1]
-		fmt.Println("Original checksum:", checksum)
-	}
-	
-	recipient, exists := server.Connections[recipientId]
-	if exists && recipient.IsOnline {
-		// Check if both users are in the same room (if sender has a current room)
-		if sender.CurrentRoom != "" {
-			room, roomExists := server.Rooms[sender.CurrentRoom]
-			if roomExists {
-				room.Mutex.Lock()
-				_, senderInRoom := room.Participants[sender.UserId]
-				_, recipientInRoom := room.Participants[recipientId]
-				room.Mutex.Unlock()
-				
-				if !senderInRoom || !recipientInRoom {
-					_, err := sender.Conn.Write([]byte("❌ Both users must be in the same room for file transfer\n"))
-					if err != nil {
-						fmt.Printf("Error sending room restriction message: %v\n", err)
-					}
-					return
-				}
+func HandleFileTransfer(server *interfaces.Server, sender *interfaces.User, recipientId string, transfer protocol.TransferInfo) {
+	server.Mutex.Lock()
+	recipient := findUserLocked(server, recipientId)
+	server.Mutex.Unlock()
+	if recipient != nil && recipient.IsOnline {
+		// Every room the two share applies its file policy before the recipient
+		// sees an offer
+		rooms, refusal := boundRooms(server, sender, recipient, "", "file transfer")
+		for _, room := range rooms {
+			if refusal != "" {
+				break
 			}
+			refusal = sendRefusal(room, sender, transfer, false)
 		}
-		
-		// Include checksum in response if available
-		_, err := recipient.Conn.Write([]byte(fmt.Sprintf("/FILE_RESPONSE %s %s %d %s", 
-		    recipientId, fileNameWithChecksum, fileSize, recipient.StoreFilePath)))
-		if err != nil {
-			fmt.Printf("Error sending file response to %s: %v\n", recipientId, err)
+		if refusal != "" {
+			rejectTransfer(sender.Conn, transfer.Id, refusal)
+			return
 		}
-		n, err := io.CopyN(recipient.Conn, conn, fileSize)
+
+		offer, err := OfferTransfer(server, sender, recipient, transfer.Id)
 		if err != nil {
-			fmt.Printf("Error receiving file from %s: %v\n", recipientId, err)
+			fmt.Printf("Error offering transfer %s: %v\n", transfer.Id, err)
+			rejectTransfer(sender.Conn, transfer.Id, "❌ Server could not start the transfer")
+			return
 		}
-		fmt.Printf("Transferred %d bytes from %s\n", n, recipientId)
+
+		// The recipient decides whether to take the file; nothing moves until it accepts
+		err = protocol.WriteMessage(recipient.Conn, protocol.Message{
+			Type:      protocol.MsgFileResponse,
+			From:      sender.UserId,
+			Username:  sender.Username,
+			PeerToken: offer.PeerToken,
+			PublicKey: sender.PublicKey,
+			Transfer:  &transfer,
+		})
 		if err != nil {
-			fmt.Printf("Error sending file to %s: %v\n", recipientId, err)
+			fmt.Printf("Error sending file offer to %s: %v\n", recipientId, err)
+			WithdrawOffer(server, offer)
+			rejectTransfer(sender.Conn, transfer.Id, "❌ Could not reach the recipient")
+			return
 		}
 	} else {
 		fmt.Printf("User %s not found or offline\n", recipientId)
+		rejectTransfer(sender.Conn, transfer.Id, fmt.Sprintf("❌ User %s not found or offline", recipientId))
 	}
 }
 
@@ -90,29 +70,17 @@ func SendFile(server *interfaces.Server, senderId, recipientId, filePath string)
 		return
 	}
 
-	_, err := sender.Conn.Write([]byte(fmt.Sprintf("/sendfile %s %s\n", recipientId, filePath)))
+	err := protocol.WriteMessage(sender.Conn, protocol.Message{Type: protocol.MsgDownloadRequest, From: recipientId, Path: filePath})
 	if err != nil {
 		fmt.Printf("Error sending file to %s: %v\n", recipientId, err)
 	}
 }
 
-func HandleDownloadRequest(server *interfaces.Server, conn net.Conn, senderId, recipientId, filePath string) {
-	// Get requester information
-	var requester *interfaces.User
-	for _, user := range server.Connections {
-		if user.Conn == conn {
-			requester = user
-			break
-		}
-	}
-	
-	if requester == nil {
-		fmt.Println("Error: Could not identify requester")
-		return
-	}
-	
-	sender, exists := server.Connections[senderId]
-	if !exists {
+func HandleDownloadRequest(server *interfaces.Server, requester *interfaces.User, senderId, filePath string) {
+	server.Mutex.Lock()
+	sender := findUserLocked(server, senderId)
+	server.Mutex.Unlock()
+	if sender == nil {
 		fmt.Printf("User %s not found\n", senderId)
 		return
 	}
@@ -121,27 +89,34 @@ func HandleDownloadRequest(server *interfaces.Server, conn net.Conn, senderId, r
 		fmt.Printf("User %s is not online\n", senderId)
 		return
 	}
+
+	// Peers only serve paths inside their shared folder; turn away anything
+	// that plainly points elsewhere before bothering them
+	if !helper.IsSharePath(filePath) {
+		err := sendNotice(requester.Conn, protocol.NoticeError, "❌ Download paths are relative to the user's shared folder, as shown by /lookup")
+		if err != nil {
+			fmt.Printf("Error sending download path error: %v\n", err)
+		}
+		return
+	}
 	
-	// Check if both users are in the same room (if requester has a current room)
-	if requester.CurrentRoom != "" {
-		room, roomExists := server.Rooms[requester.CurrentRoom]
-		if roomExists {
-			room.Mutex.Lock()
-			_, requesterInRoom := room.Participants[requester.UserId]
-			_, senderInRoom := room.Participants[senderId]
-			room.Mutex.Unlock()
-			
-			if !requesterInRoom || !senderInRoom {
-				_, err := requester.Conn.Write([]byte("❌ Both users must be in the same room for file download\n"))
-				if err != nil {
-					fmt.Printf("Error sending room restriction message: %v\n", err)
-				}
-				return
-			}
+	// Every room the two share applies its browse role and file types
+	rooms, refusal := boundRooms(server, requester, sender, "", "file download")
+	for _, room := range rooms {
+		if refusal != "" {
+			break
 		}
+		refusal = downloadRefusal(room, requester, filePath)
+	}
+	if refusal != "" {
+		err := sendNotice(requester.Conn, protocol.NoticeError, refusal)
+		if err != nil {
+			fmt.Printf("Error sending room policy message: %v\n", err)
+		}
+		return
 	}
 
-	_, err := sender.Conn.Write([]byte(fmt.Sprintf("/DOWNLOAD_REQUEST %s %s\n", recipientId, filePath)))
+	err := protocol.WriteMessage(sender.Conn, protocol.Message{Type: protocol.MsgDownloadRequest, From: requester.UserId, Path: filePath})
 	if err != nil {
 		fmt.Printf("Error sending file request to %s: %v\n", senderId, err)
 	}
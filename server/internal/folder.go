@@ -1,88 +1,65 @@
 package connection
 
 import (
+	"drizlink/protocol"
 	"drizlink/server/interfaces"
 	"fmt"
-	"io"
-	"net"
-	"strings"
 )
 
-func HandleFolderTransfer(server *interfaces.Server, conn net.Conn, recipientId, folderName string, folderSize int64) {
-	// Get sender information
-	var sender *interfaces.User
-	for _, user := range server.Connections {
-		if user.Conn == conn {
-			sender = user
-			break
-		}
-	}
-	
-	if sender == nil {
-		fmt.Println("Error: Could not identify sender")
-		return
-	}
-	
-	recipient, exists := server.Connections[recipientId]
-	if exists && recipient.IsOnline {
-		// Check if both users are in the same room (if sender has a current room)
-		if sender.CurrentRoom != "" {
-			room, roomExists := server.Rooms[sender.CurrentRoom]
-			if roomExists {
-				room.Mutex.Lock()
-				_, senderInRoom := room.Participants[sender.UserId]
-				_, recipientInRoom := room.Participants[recipientId]
-				room.Mutex.Unlock()
-				
-				if !senderInRoom || !recipientInRoom {
-					_, err := sender.Conn.Write([]byte("❌ Both users must be in the same room for folder transfer\n"))
-					if err != nil {
-						fmt.Printf("Error sending room restriction message: %v\n", err)
-					}
-					return
-				}
+func HandleFolderTransfer(server *interfaces.Server, sender *interfaces.User, recipientId string, transfer protocol.TransferInfo) {
+	server.Mutex.Lock()
+	recipient := findUserLocked(server, recipientId)
+	server.Mutex.Unlock()
+	if recipient != nil && recipient.IsOnline {
+		// Every room the two share applies its file policy before the recipient
+		// sees an offer. A room sync must also be between members of its room.
+		rooms, refusal := boundRooms(server, sender, recipient, transfer.Room, "folder transfer")
+		for _, room := range rooms {
+			if refusal != "" {
+				break
 			}
+			refusal = sendRefusal(room, sender, transfer, true)
 		}
-		
-		// Send folder transfer response to recipient
-		_, err := recipient.Conn.Write([]byte(fmt.Sprintf("/FOLDER_RESPONSE %s %s %d %s", recipientId, folderName, folderSize, recipient.StoreFilePath)))
+		if refusal != "" {
+			rejectTransfer(sender.Conn, transfer.Id, refusal)
+			return
+		}
+
+		offer, err := OfferTransfer(server, sender, recipient, transfer.Id)
 		if err != nil {
-			fmt.Printf("Error sending folder response to %s: %v\n", recipientId, err)
+			fmt.Printf("Error offering transfer %s: %v\n", transfer.Id, err)
+			rejectTransfer(sender.Conn, transfer.Id, "❌ Server could not start the transfer")
 			return
 		}
 
-		// Forward the zipped folder data from sender to recipient
-		n, err := io.CopyN(recipient.Conn, conn, folderSize)
+		// The recipient decides whether to take the folder; nothing moves until it accepts
+		err = protocol.WriteMessage(recipient.Conn, protocol.Message{
+			Type:      protocol.MsgFolderResponse,
+			From:      sender.UserId,
+			Username:  sender.Username,
+			PeerToken: offer.PeerToken,
+			PublicKey: sender.PublicKey,
+			Transfer:  &transfer,
+		})
 		if err != nil {
-			fmt.Printf("Error transferring folder data: %v\n", err)
+			fmt.Printf("Error sending folder offer to %s: %v\n", recipientId, err)
+			WithdrawOffer(server, offer)
+			rejectTransfer(sender.Conn, transfer.Id, "❌ Could not reach the recipient")
 			return
 		}
-		fmt.Printf("Transferred %d bytes of folder data\n", n)
 	} else {
 		fmt.Printf("User %s not found or offline\n", recipientId)
+		rejectTransfer(sender.Conn, transfer.Id, fmt.Sprintf("❌ User %s not found or offline", recipientId))
 	}
 }
 
-func HandleLookupRequest(server *interfaces.Server, conn net.Conn, userId string) {
-	// Get requester information
-	var requester *interfaces.User
-	for _, user := range server.Connections {
-		if user.Conn == conn {
-			requester = user
-			break
-		}
-	}
-	
-	if requester == nil {
-		fmt.Println("Error: Could not identify requester")
-		return
-	}
-	
-	recipient, exists := server.Connections[userId]
-	fmt.Printf("StoreFilePath: %s\n", recipient.StoreFilePath)
-	if !exists {
+func HandleLookupRequest(server *interfaces.Server, requester *interfaces.User, userId string) {
+	server.Mutex.Lock()
+	recipient := findUserLocked(server, userId)
+	server.Mutex.Unlock()
+	if recipient == nil {
 		fmt.Printf("User %s not found\n", userId)
-		_, err := conn.Write([]byte(fmt.Sprintf("User %s not found\n", userId)))
+		err := sendNotice(requester.Conn, protocol.NoticeError, fmt.Sprintf("User %s not found", userId))
 		if err != nil {
 			fmt.Printf("Error sending lookup response: %v\n", err)
 		}
@@ -91,38 +68,35 @@ func HandleLookupRequest(server *interfaces.Server, conn net.Conn, userId string
 
 	if !recipient.IsOnline {
 		fmt.Printf("User %s is not online\n", userId)
-		_, err := conn.Write([]byte(fmt.Sprintf("User %s is not online\n", userId)))
+		err := sendNotice(requester.Conn, protocol.NoticeError, fmt.Sprintf("User %s is not online", userId))
 		if err != nil {
 			fmt.Printf("Error sending lookup response: %v\n", err)
 		}
 		return
 	}
 	
-	// Check if both users are in the same room (if requester has a current room)
-	if requester.CurrentRoom != "" {
-		room, roomExists := server.Rooms[requester.CurrentRoom]
-		if roomExists {
-			room.Mutex.Lock()
-			_, requesterInRoom := room.Participants[requester.UserId]
-			_, recipientInRoom := room.Participants[userId]
-			room.Mutex.Unlock()
-			
-			if !requesterInRoom || !recipientInRoom {
-				_, err := requester.Conn.Write([]byte("❌ Both users must be in the same room for file lookup\n"))
-				if err != nil {
-					fmt.Printf("Error sending room restriction message: %v\n", err)
-				}
-				return
-			}
+	// Every room the two share applies its browse role
+	rooms, refusal := boundRooms(server, requester, recipient, "", "file lookup")
+	for _, room := range rooms {
+		if refusal != "" {
+			break
 		}
+		refusal = browseRefusal(room, requester)
+	}
+	if refusal != "" {
+		err := sendNotice(requester.Conn, protocol.NoticeError, refusal)
+		if err != nil {
+			fmt.Printf("Error sending room policy message: %v\n", err)
+		}
+		return
 	}
 
-	// Send the lookup request to the recipient's connection
-	fmt.Printf("StoreFilePath: %s\n", recipient.StoreFilePath)
-	_, err := recipient.Conn.Write([]byte(fmt.Sprintf("/LOOK_REQUEST %s %s\n", userId, recipient.StoreFilePath)))
+	// Send the lookup request to the recipient's connection, tagged with the
+	// requester so the listing can be routed back
+	err := protocol.WriteMessage(recipient.Conn, protocol.Message{Type: protocol.MsgLookupRequest, From: requester.UserId})
 	if err != nil {
 		fmt.Printf("Error sending lookup request to recipient: %v\n", err)
-		_, respErr := conn.Write([]byte(fmt.Sprintf("Error looking up user %s's directory\n", userId)))
+		respErr := sendNotice(requester.Conn, protocol.NoticeError, fmt.Sprintf("Error looking up user %s's directory", userId))
 		if respErr != nil {
 			fmt.Printf("Error sending error response: %v\n", respErr)
 		}
@@ -132,8 +106,16 @@ func HandleLookupRequest(server *interfaces.Server, conn net.Conn, userId string
 	fmt.Printf("Lookup request sent to user %s\n", userId)
 }
 
-func HandleLookupResponse(server *interfaces.Server, conn net.Conn, userId string, files []string) {
-	_, err := conn.Write([]byte(fmt.Sprintf("LOOK_RESPONSE %s %s\n", userId, strings.Join(files, " "))))
+func HandleLookupResponse(server *interfaces.Server, owner *interfaces.User, requesterId string, entries []protocol.DirEntry) {
+	server.Mutex.Lock()
+	requester, exists := server.Connections[requesterId]
+	server.Mutex.Unlock()
+	if !exists || !requester.IsOnline {
+		fmt.Printf("User %s not found or offline\n", requesterId)
+		return
+	}
+
+	err := protocol.WriteMessage(requester.Conn, protocol.Message{Type: protocol.MsgLookupResponse, From: owner.UserId, Entries: entries})
 	if err != nil {
 		fmt.Printf("Error sending lookup response: %v\n", err)
 		return
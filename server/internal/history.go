@@ -0,0 +1,104 @@
+package connection
+
+import (
+	"drizlink/protocol"
+	"drizlink/server/interfaces"
+	"fmt"
+	"time"
+)
+
+// DefaultHistoryPage is how many messages /history shows when no count is given
+const DefaultHistoryPage = 20
+
+// MaxHistoryPage bounds a single /history page
+const MaxHistoryPage = 100
+
+// recordRoomMessage appends a chat line to the room's history log and
+// returns its sequence number, or 0 if it was not saved
+func recordRoomMessage(server *interfaces.Server, room *interfaces.Room, sender *interfaces.User, content string) int64 {
+	if server.Store == nil {
+		return 0
+	}
+	message := &interfaces.Message{
+		SenderId:       sender.UserId,
+		SenderUsername: sender.Username,
+		Content:        content,
+		Timestamp:      time.Now().Format(time.RFC3339),
+		RoomId:         room.RoomId,
+	}
+	if err := server.Store.AppendHistory(message); err != nil {
+		fmt.Printf("Error saving message in room %s: %v\n", room.RoomId, err)
+		return 0
+	}
+	return message.Seq
+}
+
+// HandleHistoryRequest sends a member a page of a room's history, older than
+// before when paging back
+func HandleHistoryRequest(server *interfaces.Server, user *interfaces.User, roomId string, before int64, limit int) {
+	server.Mutex.Lock()
+	room, exists := server.Rooms[roomId]
+	inRoom := false
+	if exists {
+		_, inRoom = room.Participants[user.UserId]
+	}
+	server.Mutex.Unlock()
+
+	if !exists {
+		_ = sendNotice(user.Conn, protocol.NoticeError, "❌ Room not found")
+		return
+	}
+	if !inRoom {
+		_ = sendNotice(user.Conn, protocol.NoticeError, "❌ You are not a participant in this room")
+		return
+	}
+
+	if limit <= 0 {
+		limit = DefaultHistoryPage
+	}
+	if limit > MaxHistoryPage {
+		limit = MaxHistoryPage
+	}
+	if err := sendHistory(server, user, room, before, limit); err != nil {
+		fmt.Printf("Error sending history of room %s to %s: %v\n", roomId, user.Username, err)
+	}
+}
+
+// sendRecentHistory replays the newest messages of a room, older than before
+// if set, to a member who just joined or came back
+func sendRecentHistory(server *interfaces.Server, user *interfaces.User, room *interfaces.Room, before int64) {
+	if server.HistoryReplay <= 0 {
+		return
+	}
+	if err := sendHistory(server, user, room, before, server.HistoryReplay); err != nil {
+		fmt.Printf("Error replaying history of room %s to %s: %v\n", room.RoomId, user.Username, err)
+	}
+}
+
+func sendHistory(server *interfaces.Server, user *interfaces.User, room *interfaces.Room, before int64, limit int) error {
+	if server.Store == nil {
+		return nil
+	}
+	messages, err := server.Store.LoadHistory(room.RoomId, before, limit)
+	if err != nil {
+		return err
+	}
+
+	entries := make([]protocol.ChatEntry, 0, len(messages))
+	for _, message := range messages {
+		entries = append(entries, protocol.ChatEntry{
+			Seq:      message.Seq,
+			From:     message.SenderId,
+			Username: message.SenderUsername,
+			Text:     message.Content,
+			Time:     message.Timestamp,
+		})
+	}
+	return protocol.WriteMessage(user.Conn, protocol.Message{
+		Type:     protocol.MsgHistory,
+		RoomId:   room.RoomId,
+		RoomName: room.RoomName,
+		Before:   before,
+		History:  entries,
+	})
+}
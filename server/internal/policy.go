@@ -0,0 +1,258 @@
+package connection
+
+import (
+	"drizlink/helper"
+	"drizlink/protocol"
+	"drizlink/server/interfaces"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// boundRooms returns the rooms whose file policies bind a request between
+// user and peer: every room they share, so that picking another room or none
+// sidesteps no policy. syncRoom names the room a /sync update is for; other
+// requests are made in user's active room. Both users must be in that room,
+// otherwise refusal explains why.
+func boundRooms(server *interfaces.Server, user, peer *interfaces.User, syncRoom, action string) (rooms []*interfaces.Room, refusal string) {
+	server.Mutex.Lock()
+	defer server.Mutex.Unlock()
+
+	roomId := user.CurrentRoom
+	if syncRoom != "" {
+		roomId = syncRoom
+		if _, exists := server.Rooms[roomId]; !exists {
+			return nil, "❌ Room not found"
+		}
+	}
+
+	for _, room := range server.Rooms {
+		room.Mutex.Lock()
+		_, userInRoom := room.Participants[user.UserId]
+		_, peerInRoom := room.Participants[peer.UserId]
+		room.Mutex.Unlock()
+
+		if userInRoom && peerInRoom {
+			rooms = append(rooms, room)
+		} else if room.RoomId == roomId {
+			return nil, fmt.Sprintf("❌ Both users must be in the same room for %s", action)
+		}
+	}
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].RoomName < rooms[j].RoomName })
+	return rooms, ""
+}
+
+// sendRefusal explains why sender may not send transfer in room, or returns
+// "" if the room's file policy allows it. A folder's file list travels
+// encrypted between the peers, so its file types are checked as its offer
+// declares them; the recipient holds the manifest to that declaration.
+func sendRefusal(room *interfaces.Room, sender *interfaces.User, transfer protocol.TransferInfo, folder bool) string {
+	room.Mutex.Lock()
+	defer room.Mutex.Unlock()
+
+	policy := room.Policy
+	if !hasRole(room, sender.UserId, policy.SendRole) {
+		return fmt.Sprintf("❌ Only %s may send files in room '%s'", roleGroup(policy.SendRole), room.RoomName)
+	}
+	if policy.MaxFileSize > 0 && transfer.Size > policy.MaxFileSize {
+		return fmt.Sprintf("❌ %s is %s; room '%s' accepts files up to %s", transfer.Name, helper.FormatSize(transfer.Size), room.RoomName, helper.FormatSize(policy.MaxFileSize))
+	}
+	if !folder {
+		return extensionRefusal(room, helper.FileType(transfer.Name))
+	}
+	for _, fileType := range transfer.Extensions {
+		if refusal := extensionRefusal(room, fileType); refusal != "" {
+			return strings.Replace(refusal, "❌ ", fmt.Sprintf("❌ Folder %s: ", transfer.Name), 1)
+		}
+	}
+	return ""
+}
+
+// browseRefusal explains why user may not look up or download files of
+// others in room, or returns "" if they may
+func browseRefusal(room *interfaces.Room, user *interfaces.User) string {
+	room.Mutex.Lock()
+	defer room.Mutex.Unlock()
+
+	if !hasRole(room, user.UserId, room.Policy.BrowseRole) {
+		return fmt.Sprintf("❌ Only %s may browse and download files in room '%s'", roleGroup(room.Policy.BrowseRole), room.RoomName)
+	}
+	return ""
+}
+
+// downloadRefusal is browseRefusal plus the room's file types, checked
+// against the requested path before the file's owner is asked for it. Its
+// size is checked once the owner offers it.
+func downloadRefusal(room *interfaces.Room, user *interfaces.User, path string) string {
+	if refusal := browseRefusal(room, user); refusal != "" {
+		return refusal
+	}
+	room.Mutex.Lock()
+	defer room.Mutex.Unlock()
+	return extensionRefusal(room, helper.FileType(path))
+}
+
+// extensionRefusal checks the file type ext, see helper.FileType, against
+// the room's allowed and denied file types. The caller holds room.Mutex.
+func extensionRefusal(room *interfaces.Room, ext string) string {
+	shown := ext
+	if shown == "" {
+		shown = "Files without an extension"
+	} else {
+		shown += " files"
+	}
+	for _, denied := range room.Policy.DeniedExtensions {
+		if ext == denied {
+			return fmt.Sprintf("❌ %s are not allowed in room '%s'", shown, room.RoomName)
+		}
+	}
+	if len(room.Policy.AllowedExtensions) == 0 {
+		return ""
+	}
+	for _, allowed := range room.Policy.AllowedExtensions {
+		if ext == allowed {
+			return ""
+		}
+	}
+	return fmt.Sprintf("❌ %s are not allowed in room '%s'; it accepts only %s", shown, room.RoomName, strings.Join(room.Policy.AllowedExtensions, ", "))
+}
+
+// HandleRoomPolicy lets the owner change one setting of a room's file policy
+func HandleRoomPolicy(server *interfaces.Server, actor *interfaces.User, roomId, setting, value string) {
+	server.Mutex.Lock()
+	defer server.Mutex.Unlock()
+
+	room := moderatedRoomLocked(server, actor, roomId, interfaces.RoleOwner)
+	if room == nil {
+		return
+	}
+
+	room.Mutex.Lock()
+	defer room.Mutex.Unlock()
+
+	policy := room.Policy
+	value = strings.TrimSpace(value)
+	switch setting {
+	case "send", "browse":
+		role := interfaces.RoomRole(strings.ToLower(value))
+		if roleRank(role) == 0 {
+			_ = sendNotice(actor.Conn, protocol.NoticeError, "❌ Role must be member, moderator or owner")
+			return
+		}
+		if role == interfaces.RoleMember {
+			role = ""
+		}
+		if setting == "send" {
+			policy.SendRole = role
+		} else {
+			policy.BrowseRole = role
+		}
+	case "maxsize":
+		if strings.EqualFold(value, "none") {
+			policy.MaxFileSize = 0
+			break
+		}
+		size, err := helper.ParseSize(value)
+		if err != nil {
+			_ = sendNotice(actor.Conn, protocol.NoticeError, "❌ Invalid size: "+err.Error())
+			return
+		}
+		policy.MaxFileSize = size
+	case "allow", "deny":
+		extensions, err := parseExtensions(value)
+		if err != nil {
+			_ = sendNotice(actor.Conn, protocol.NoticeError, "❌ "+err.Error())
+			return
+		}
+		if setting == "allow" {
+			policy.AllowedExtensions = extensions
+		} else {
+			policy.DeniedExtensions = extensions
+		}
+	default:
+		_ = sendNotice(actor.Conn, protocol.NoticeError, "❌ Setting must be send, browse, maxsize, allow or deny")
+		return
+	}
+
+	room.Policy = policy
+	saveStateLocked(server)
+
+	notifyRoomLocked(room, nil, protocol.NoticeInfo, fmt.Sprintf("📁 File policy of room '%s' changed by %s:\n%s", room.RoomName, actor.Username, describePolicy(policy)))
+	fmt.Printf("User %s set %s=%s in room '%s' (ID: %s)\n", actor.Username, setting, value, room.RoomName, room.RoomId)
+}
+
+// parseExtensions reads a comma separated list such as "pdf, .PNG". "none"
+// or "any" clears the list.
+func parseExtensions(value string) ([]string, error) {
+	if strings.EqualFold(value, "none") || strings.EqualFold(value, "any") {
+		return nil, nil
+	}
+	seen := make(map[string]bool)
+	var extensions []string
+	for _, field := range strings.Split(value, ",") {
+		ext := strings.ToLower(strings.TrimSpace(field))
+		if ext == "" {
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		if ext == "." || strings.ContainsAny(ext[1:], `./\ `) {
+			return nil, fmt.Errorf("invalid file extension %q", field)
+		}
+		if !seen[ext] {
+			seen[ext] = true
+			extensions = append(extensions, ext)
+		}
+	}
+	if len(extensions) == 0 {
+		return nil, fmt.Errorf("no file extensions given; use none to clear the list")
+	}
+	sort.Strings(extensions)
+	return extensions, nil
+}
+
+// describePolicy lists a file policy for /roominfo and change notices
+func describePolicy(policy interfaces.FilePolicy) string {
+	maxSize := "no limit"
+	if policy.MaxFileSize > 0 {
+		maxSize = helper.FormatSize(policy.MaxFileSize)
+	}
+	allowed := "any"
+	if len(policy.AllowedExtensions) > 0 {
+		allowed = strings.Join(policy.AllowedExtensions, ", ")
+	}
+	denied := "none"
+	if len(policy.DeniedExtensions) > 0 {
+		denied = strings.Join(policy.DeniedExtensions, ", ")
+	}
+
+	var lines strings.Builder
+	lines.WriteString(fmt.Sprintf("    📤 Send: %s\n", roleGroup(policy.SendRole)))
+	lines.WriteString(fmt.Sprintf("    🔍 Browse and download: %s\n", roleGroup(policy.BrowseRole)))
+	lines.WriteString(fmt.Sprintf("    📏 Max file size: %s\n", maxSize))
+	lines.WriteString(fmt.Sprintf("    ✅ Allowed types: %s\n", allowed))
+	lines.WriteString(fmt.Sprintf("    🚫 Denied types: %s", denied))
+	return lines.String()
+}
+
+// hasRole reports whether userId holds at least minRole in room; an empty
+// minRole means any member. The caller holds room.Mutex.
+func hasRole(room *interfaces.Room, userId string, minRole interfaces.RoomRole) bool {
+	if minRole == "" {
+		minRole = interfaces.RoleMember
+	}
+	return roleRank(roleOfLocked(room, userId)) >= roleRank(minRole)
+}
+
+// roleGroup names everyone holding at least minRole
+func roleGroup(minRole interfaces.RoomRole) string {
+	switch minRole {
+	case interfaces.RoleOwner:
+		return "the owner"
+	case interfaces.RoleModerator:
+		return "moderators and the owner"
+	default:
+		return "all members"
+	}
+}
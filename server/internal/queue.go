@@ -0,0 +1,102 @@
+package connection
+
+import (
+	"drizlink/protocol"
+	"drizlink/server/interfaces"
+	"fmt"
+	"time"
+)
+
+// DefaultQueueLimit is how many messages are kept for each offline user
+const DefaultQueueLimit = 500
+
+// DefaultQueueMaxAge is how long a message waits for an offline user
+const DefaultQueueMaxAge = 7 * 24 * time.Hour
+
+// queueMessageLocked holds msg for a user who could not be reached and
+// reports whether it was kept. The caller holds server.Mutex.
+func queueMessageLocked(server *interfaces.Server, recipient *interfaces.User, msg protocol.Message) bool {
+	if server.Store == nil || server.QueueLimit <= 0 {
+		return false
+	}
+	queued := interfaces.QueuedMessage{QueuedAt: time.Now(), Message: msg}
+	if err := server.Store.Enqueue(recipient.UserId, queued, server.QueueLimit); err != nil {
+		fmt.Printf("Error queueing message for %s: %v\n", recipient.Username, err)
+		return false
+	}
+	return true
+}
+
+// catchUp brings a user who just logged in up to date: recent history of
+// their active room first, then everything queued while they were away, in
+// the order it was sent. Only then is the user marked online. Until that
+// point new messages are queued, and the queue is drained and the user put
+// online under one hold of server.Mutex, so nothing overtakes the backlog.
+func catchUp(server *interfaces.Server, user *interfaces.User) {
+	server.Mutex.Lock()
+	defer server.Mutex.Unlock()
+	defer func() { user.IsOnline = true }()
+
+	queued, expired := takeQueuedLocked(server, user)
+
+	if room, exists := server.Rooms[user.CurrentRoom]; exists {
+		// Stop the replay where the missed messages begin so nothing shows twice
+		var before int64
+		for _, entry := range queued {
+			if entry.Message.RoomId == room.RoomId && entry.Message.Seq > 0 {
+				before = entry.Message.Seq
+				break
+			}
+		}
+		sendRecentHistory(server, user, room, before)
+	}
+
+	if expired > 0 {
+		_ = sendNotice(user.Conn, protocol.NoticeWarning, fmt.Sprintf("⌛ %d messages sent while you were offline have expired", expired))
+	}
+	if len(queued) == 0 {
+		return
+	}
+	_ = sendNotice(user.Conn, protocol.NoticeInfo, fmt.Sprintf("📬 %d messages arrived while you were offline:", len(queued)))
+	for i, entry := range queued {
+		msg := entry.Message
+		msg.Time = entry.QueuedAt.Format(time.RFC3339)
+		if err := protocol.WriteMessage(user.Conn, msg); err != nil {
+			// Keep whatever could not be delivered for the next login
+			fmt.Printf("Error delivering queued messages to %s: %v\n", user.Username, err)
+			for _, rest := range queued[i:] {
+				_ = server.Store.Enqueue(user.UserId, rest, server.QueueLimit)
+			}
+			return
+		}
+		if msg.Type == protocol.MsgDirect {
+			directDeliveredLocked(server, msg, user)
+		}
+	}
+	fmt.Printf("Delivered %d queued messages to %s\n", len(queued), user.Username)
+}
+
+// takeQueuedLocked empties the user's queue, dropping messages older than
+// server.QueueMaxAge. The caller holds server.Mutex.
+func takeQueuedLocked(server *interfaces.Server, user *interfaces.User) ([]interfaces.QueuedMessage, int) {
+	if server.Store == nil {
+		return nil, 0
+	}
+	queued, err := server.Store.TakeQueued(user.UserId)
+	if err != nil {
+		fmt.Printf("Error loading queued messages for %s: %v\n", user.Username, err)
+		return nil, 0
+	}
+	if server.QueueMaxAge <= 0 {
+		return queued, 0
+	}
+
+	cutoff := time.Now().Add(-server.QueueMaxAge)
+	fresh := queued[:0]
+	for _, entry := range queued {
+		if entry.QueuedAt.After(cutoff) {
+			fresh = append(fresh, entry)
+		}
+	}
+	return fresh, len(queued) - len(fresh)
+}
@@ -1,18 +1,23 @@
 package connection
 
 import (
+	"drizlink/helper"
+	"drizlink/protocol"
 	"drizlink/server/interfaces"
 	"fmt"
-	"strconv"
+	"strings"
 	"time"
 )
 
-var roomIdCounter = 1
-
-func generateRoomId() string {
-	id := strconv.Itoa(roomIdCounter)
-	roomIdCounter++
-	return id
+// generateRoomIdLocked returns a random room ID not used by any existing
+// room. The caller holds server.Mutex.
+func generateRoomIdLocked(server *interfaces.Server) string {
+	for {
+		id := helper.GenerateRoomId()
+		if _, taken := server.Rooms[id]; !taken {
+			return id
+		}
+	}
 }
 
 func HandleCreateRoom(server *interfaces.Server, creator *interfaces.User, roomName string, participantIds []string) {
@@ -24,10 +29,10 @@ func HandleCreateRoom(server *interfaces.Server, creator *interfaces.User, roomN
 	participants[creator.UserId] = creator // Add creator to participants
 
 	for _, participantId := range participantIds {
-		if participant, exists := server.Connections[participantId]; exists && participant.IsOnline {
-			participants[participantId] = participant
+		if participant := findUserLocked(server, participantId); participant != nil && participant.IsOnline {
+			participants[participant.UserId] = participant
 		} else {
-			_, err := creator.Conn.Write([]byte(fmt.Sprintf("❌ User %s not found or offline\n", participantId)))
+			err := sendNotice(creator.Conn, protocol.NoticeError, fmt.Sprintf("❌ User %s not found or offline", participantId))
 			if err != nil {
 				fmt.Println("Error sending create room error:", err)
 			}
@@ -36,22 +41,26 @@ func HandleCreateRoom(server *interfaces.Server, creator *interfaces.User, roomN
 	}
 
 	// Create room
-	roomId := generateRoomId()
+	roomId := generateRoomIdLocked(server)
 	room := &interfaces.Room{
 		RoomId:       roomId,
 		RoomName:     roomName,
 		Creator:      creator.UserId,
 		Participants: participants,
-		Messages:     make(chan interfaces.Message, 100),
 		CreatedAt:    time.Now().Format("2006-01-02 15:04:05"),
+		Roles:        map[string]interfaces.RoomRole{creator.UserId: interfaces.RoleOwner},
+		Access:       interfaces.AccessOpen,
+		Invited:      make(map[string]bool),
+		Banned:       make(map[string]bool),
 	}
 
 	server.Rooms[roomId] = room
+	saveStateLocked(server)
 
 	// Notify all participants about room creation
 	for _, participant := range participants {
-		message := fmt.Sprintf("🏠 Room '%s' (ID: %s) created by %s. You have been added to the room.\n", roomName, roomId, creator.Username)
-		_, err := participant.Conn.Write([]byte(message))
+		message := fmt.Sprintf("🏠 Room '%s' (ID: %s) created by %s. You have been added to the room.", roomName, roomId, creator.Username)
+		err := sendNotice(participant.Conn, protocol.NoticeSuccess, message)
 		if err != nil {
 			fmt.Printf("Error notifying participant %s: %v\n", participant.Username, err)
 		}
@@ -60,13 +69,15 @@ func HandleCreateRoom(server *interfaces.Server, creator *interfaces.User, roomN
 	fmt.Printf("Room '%s' (ID: %s) created by %s with %d participants\n", roomName, roomId, creator.Username, len(participants))
 }
 
-func HandleJoinRoom(server *interfaces.Server, user *interfaces.User, roomId string) {
+func HandleJoinRoom(server *interfaces.Server, user *interfaces.User, roomId, password string) {
+	checkedHash, passwordOK := checkRoomPassword(server, roomId, password)
+
 	server.Mutex.Lock()
 	defer server.Mutex.Unlock()
 
 	room, exists := server.Rooms[roomId]
 	if !exists {
-		_, err := user.Conn.Write([]byte("❌ Room not found\n"))
+		err := sendNotice(user.Conn, protocol.NoticeError, "❌ Room not found")
 		if err != nil {
 			fmt.Println("Error sending join room error:", err)
 		}
@@ -78,18 +89,32 @@ func HandleJoinRoom(server *interfaces.Server, user *interfaces.User, roomId str
 
 	// Check if user is already in room
 	if _, alreadyIn := room.Participants[user.UserId]; alreadyIn {
-		_, err := user.Conn.Write([]byte("⚠️ You are already in this room\n"))
+		err := sendNotice(user.Conn, protocol.NoticeWarning, "⚠️ You are already in this room")
 		if err != nil {
 			fmt.Println("Error sending join room warning:", err)
 		}
 		return
 	}
 
-	// Add user to room
+	// Bans, invitations and the room password decide who gets in
+	if room.PasswordHash != checkedHash {
+		passwordOK = false
+	}
+	if refusal := joinRefusalLocked(room, user, password, passwordOK); refusal != "" {
+		err := sendNotice(user.Conn, protocol.NoticeError, refusal)
+		if err != nil {
+			fmt.Println("Error sending join room error:", err)
+		}
+		return
+	}
+
+	// Add user to room; an invitation is used up by joining
 	room.Participants[user.UserId] = user
+	delete(room.Invited, user.UserId)
+	saveStateLocked(server)
 
 	// Notify user
-	_, err := user.Conn.Write([]byte(fmt.Sprintf("✅ Successfully joined room '%s' (ID: %s)\n", room.RoomName, roomId)))
+	err := sendNotice(user.Conn, protocol.NoticeSuccess, fmt.Sprintf("✅ Successfully joined room '%s' (ID: %s)", room.RoomName, roomId))
 	if err != nil {
 		fmt.Println("Error sending join confirmation:", err)
 	}
@@ -97,14 +122,17 @@ func HandleJoinRoom(server *interfaces.Server, user *interfaces.User, roomId str
 	// Notify other participants
 	for _, participant := range room.Participants {
 		if participant != user && participant.IsOnline {
-			message := fmt.Sprintf("👋 %s joined room '%s'\n", user.Username, room.RoomName)
-			_, err := participant.Conn.Write([]byte(message))
+			message := fmt.Sprintf("👋 %s joined room '%s'", user.Username, room.RoomName)
+			err := sendNotice(participant.Conn, protocol.NoticeInfo, message)
 			if err != nil {
 				fmt.Printf("Error notifying participant %s: %v\n", participant.Username, err)
 			}
 		}
 	}
 
+	// Catch the new member up on the conversation
+	sendRecentHistory(server, user, room, 0)
+
 	fmt.Printf("User %s joined room '%s' (ID: %s)\n", user.Username, room.RoomName, roomId)
 }
 
@@ -114,7 +142,7 @@ func HandleLeaveRoom(server *interfaces.Server, user *interfaces.User, roomId st
 
 	room, exists := server.Rooms[roomId]
 	if !exists {
-		_, err := user.Conn.Write([]byte("❌ Room not found\n"))
+		err := sendNotice(user.Conn, protocol.NoticeError, "❌ Room not found")
 		if err != nil {
 			fmt.Println("Error sending leave room error:", err)
 		}
@@ -126,7 +154,7 @@ func HandleLeaveRoom(server *interfaces.Server, user *interfaces.User, roomId st
 
 	// Check if user is in room
 	if _, inRoom := room.Participants[user.UserId]; !inRoom {
-		_, err := user.Conn.Write([]byte("⚠️ You are not in this room\n"))
+		err := sendNotice(user.Conn, protocol.NoticeWarning, "⚠️ You are not in this room")
 		if err != nil {
 			fmt.Println("Error sending leave room warning:", err)
 		}
@@ -135,6 +163,8 @@ func HandleLeaveRoom(server *interfaces.Server, user *interfaces.User, roomId st
 
 	// Remove user from room
 	delete(room.Participants, user.UserId)
+	wasOwner := room.Roles[user.UserId] == interfaces.RoleOwner
+	delete(room.Roles, user.UserId)
 
 	// Clear current room if this was the selected room
 	if user.CurrentRoom == roomId {
@@ -142,7 +172,7 @@ func HandleLeaveRoom(server *interfaces.Server, user *interfaces.User, roomId st
 	}
 
 	// Notify user
-	_, err := user.Conn.Write([]byte(fmt.Sprintf("✅ Successfully left room '%s' (ID: %s)\n", room.RoomName, roomId)))
+	err := sendNotice(user.Conn, protocol.NoticeSuccess, fmt.Sprintf("✅ Successfully left room '%s' (ID: %s)", room.RoomName, roomId))
 	if err != nil {
 		fmt.Println("Error sending leave confirmation:", err)
 	}
@@ -150,19 +180,32 @@ func HandleLeaveRoom(server *interfaces.Server, user *interfaces.User, roomId st
 	// Notify other participants
 	for _, participant := range room.Participants {
 		if participant.IsOnline {
-			message := fmt.Sprintf("👋 %s left room '%s'\n", user.Username, room.RoomName)
-			_, err := participant.Conn.Write([]byte(message))
+			message := fmt.Sprintf("👋 %s left room '%s'", user.Username, room.RoomName)
+			err := sendNotice(participant.Conn, protocol.NoticeInfo, message)
 			if err != nil {
 				fmt.Printf("Error notifying participant %s: %v\n", participant.Username, err)
 			}
 		}
 	}
 
+	// Someone has to look after the room once its owner is gone
+	if wasOwner {
+		if owner := passOwnershipLocked(room); owner != nil {
+			notifyRoomLocked(room, nil, protocol.NoticeInfo, fmt.Sprintf("👑 %s is now the owner of room '%s'", owner.Username, room.RoomName))
+		}
+	}
+
 	// Delete room if empty
 	if len(room.Participants) == 0 {
 		delete(server.Rooms, roomId)
+		if server.Store != nil {
+			if err := server.Store.DeleteHistory(roomId); err != nil {
+				fmt.Printf("Error deleting history of room %s: %v\n", roomId, err)
+			}
+		}
 		fmt.Printf("Room '%s' (ID: %s) deleted - no participants remaining\n", room.RoomName, roomId)
 	}
+	saveStateLocked(server)
 
 	fmt.Printf("User %s left room '%s' (ID: %s)\n", user.Username, room.RoomName, roomId)
 }
@@ -173,7 +216,7 @@ func HandleSelectRoom(server *interfaces.Server, user *interfaces.User, roomId s
 
 	room, exists := server.Rooms[roomId]
 	if !exists {
-		_, err := user.Conn.Write([]byte("❌ Room not found\n"))
+		err := sendNotice(user.Conn, protocol.NoticeError, "❌ Room not found")
 		if err != nil {
 			fmt.Println("Error sending select room error:", err)
 		}
@@ -185,7 +228,7 @@ func HandleSelectRoom(server *interfaces.Server, user *interfaces.User, roomId s
 
 	// Check if user is in room
 	if _, inRoom := room.Participants[user.UserId]; !inRoom {
-		_, err := user.Conn.Write([]byte("❌ You are not a participant in this room\n"))
+		err := sendNotice(user.Conn, protocol.NoticeError, "❌ You are not a participant in this room")
 		if err != nil {
 			fmt.Println("Error sending select room error:", err)
 		}
@@ -194,9 +237,10 @@ func HandleSelectRoom(server *interfaces.Server, user *interfaces.User, roomId s
 
 	// Set current room
 	user.CurrentRoom = roomId
+	saveStateLocked(server)
 
 	// Notify user
-	_, err := user.Conn.Write([]byte(fmt.Sprintf("✅ Selected room '%s' (ID: %s) as active room\n", room.RoomName, roomId)))
+	err := sendNotice(user.Conn, protocol.NoticeSuccess, fmt.Sprintf("✅ Selected room '%s' (ID: %s) as active room", room.RoomName, roomId))
 	if err != nil {
 		fmt.Println("Error sending select confirmation:", err)
 	}
@@ -208,18 +252,11 @@ func HandleListRooms(server *interfaces.Server, user *interfaces.User) {
 	server.Mutex.Lock()
 	defer server.Mutex.Unlock()
 
-	_, err := user.Conn.Write([]byte("🏠 Available Rooms:\n"))
-	if err != nil {
-		fmt.Println("Error sending room list header:", err)
-		return
-	}
+	var roomList strings.Builder
+	roomList.WriteString("🏠 Available Rooms:")
 
 	if len(server.Rooms) == 0 {
-		_, err := user.Conn.Write([]byte("No rooms available\n"))
-		if err != nil {
-			fmt.Println("Error sending no rooms message:", err)
-		}
-		return
+		roomList.WriteString("\nNo rooms available")
 	}
 
 	for _, room := range server.Rooms {
@@ -235,14 +272,20 @@ func HandleListRooms(server *interfaces.Server, user *interfaces.User) {
 			activeIndicator = " [ACTIVE]"
 		}
 		
-		roomInfo := fmt.Sprintf("  🏠 %s (ID: %s) - %d participants%s%s\n", 
-			room.RoomName, room.RoomId, participantCount, isParticipant, activeIndicator)
-		_, err := user.Conn.Write([]byte(roomInfo))
-		if err != nil {
-			fmt.Printf("Error sending room info: %v\n", err)
+		access := ""
+		if room.Access != interfaces.AccessOpen {
+			access = " - " + accessLabel(room.Access)
 		}
+
+		roomList.WriteString(fmt.Sprintf("\n  🏠 %s (ID: %s) - %d participants%s%s%s", 
+			room.RoomName, room.RoomId, participantCount, access, isParticipant, activeIndicator))
 		room.Mutex.Unlock()
 	}
+
+	err := sendNotice(user.Conn, protocol.NoticeInfo, roomList.String())
+	if err != nil {
+		fmt.Println("Error sending room list:", err)
+	}
 }
 
 func HandleRoomInfo(server *interfaces.Server, user *interfaces.User, roomId string) {
@@ -251,7 +294,7 @@ func HandleRoomInfo(server *interfaces.Server, user *interfaces.User, roomId str
 
 	room, exists := server.Rooms[roomId]
 	if !exists {
-		_, err := user.Conn.Write([]byte("❌ Room not found\n"))
+		err := sendNotice(user.Conn, protocol.NoticeError, "❌ Room not found")
 		if err != nil {
 			fmt.Println("Error sending room info error:", err)
 		}
@@ -261,56 +304,471 @@ func HandleRoomInfo(server *interfaces.Server, user *interfaces.User, roomId str
 	room.Mutex.Lock()
 	defer room.Mutex.Unlock()
 
-	// Send room details
-	_, err := user.Conn.Write([]byte(fmt.Sprintf("🏠 Room Information:\n")))
+	creatorName := "Unknown"
+	if creator, exists := server.Connections[room.Creator]; exists {
+		creatorName = creator.Username
+	}
+	ownerName := "Unknown"
+	if owner := roomOwnerLocked(room); owner != nil {
+		ownerName = owner.Username
+	}
+
+	// Send room details as a single notice
+	var info strings.Builder
+	info.WriteString("🏠 Room Information:\n")
+	info.WriteString(fmt.Sprintf("  Name: %s\n", room.RoomName))
+	info.WriteString(fmt.Sprintf("  ID: %s\n", room.RoomId))
+	info.WriteString(fmt.Sprintf("  Creator: %s\n", creatorName))
+	info.WriteString(fmt.Sprintf("  Owner: %s\n", ownerName))
+	info.WriteString(fmt.Sprintf("  Access: %s\n", accessLabel(room.Access)))
+	info.WriteString(fmt.Sprintf("  Created: %s\n", room.CreatedAt))
+	info.WriteString(fmt.Sprintf("  File policy:\n%s\n", describePolicy(room.Policy)))
+	info.WriteString(fmt.Sprintf("  Participants (%d):", len(room.Participants)))
+
+	for _, participant := range room.Participants {
+		status := "Offline"
+		if participant.IsOnline {
+			status = "Online"
+		}
+		info.WriteString(fmt.Sprintf("\n    👤 %s (ID: %s) - %s, %s", participant.Username, participant.UserId, roleOfLocked(room, participant.UserId), status))
+		info.WriteString(fmt.Sprintf("\n       🔑 Key: %s", helper.KeyFingerprint(participant.PublicKey)))
+	}
+
+	// Only those who can lift a ban need to see who is banned
+	if roleRank(roleOfLocked(room, user.UserId)) >= roleRank(interfaces.RoleModerator) && len(room.Banned) > 0 {
+		info.WriteString(fmt.Sprintf("\n  Banned (%d):", len(room.Banned)))
+		for userId := range room.Banned {
+			name := userId
+			if banned, exists := server.Connections[userId]; exists {
+				name = banned.Username
+			}
+			info.WriteString(fmt.Sprintf("\n    🚫 %s (ID: %s)", name, userId))
+		}
+	}
+
+	err := sendNotice(user.Conn, protocol.NoticeInfo, info.String())
 	if err != nil {
-		fmt.Println("Error sending room info header:", err)
+		fmt.Println("Error sending room info:", err)
+	}
+}
+
+// HandleRoomMembers records whether user's client syncs a room. A syncing
+// client is told which other online participants sync it too, the only ones
+// it sends updates to; one that stopped gets no answer.
+func HandleRoomMembers(server *interfaces.Server, user *interfaces.User, roomId, status string) {
+	server.Mutex.Lock()
+	if status == protocol.SyncStopped {
+		delete(user.SyncRooms, roomId)
+		server.Mutex.Unlock()
 		return
 	}
 
-	_, err = user.Conn.Write([]byte(fmt.Sprintf("  Name: %s\n", room.RoomName)))
-	if err != nil {
-		fmt.Println("Error sending room name:", err)
+	reply := protocol.Message{Type: protocol.MsgRoomMembers, RoomId: roomId}
+	room, exists := server.Rooms[roomId]
+	if !exists {
+		reply.Text = "❌ Room not found"
+	} else {
+		room.Mutex.Lock()
+		if _, inRoom := room.Participants[user.UserId]; !inRoom {
+			reply.Text = "❌ You are not a participant in this room"
+		} else {
+			if user.SyncRooms == nil {
+				user.SyncRooms = make(map[string]bool)
+			}
+			user.SyncRooms[roomId] = true
+			reply.RoomName = room.RoomName
+			for _, participant := range room.Participants {
+				if participant.IsOnline && participant.SyncRooms[roomId] && participant.UserId != user.UserId {
+					reply.Users = append(reply.Users, protocol.UserInfo{UserId: participant.UserId, Username: participant.Username})
+				}
+			}
+		}
+		room.Mutex.Unlock()
+	}
+	server.Mutex.Unlock()
+
+	if err := protocol.WriteMessage(user.Conn, reply); err != nil {
+		fmt.Println("Error sending room members:", err)
+	}
+}
+
+// HandleInvite lets a moderator invite target into a room. The invitation
+// admits target once, whatever the room's access mode.
+func HandleInvite(server *interfaces.Server, actor *interfaces.User, roomId, target string) {
+	server.Mutex.Lock()
+	defer server.Mutex.Unlock()
+
+	room, invitee := moderationTargetLocked(server, actor, roomId, target, interfaces.RoleModerator)
+	if room == nil {
 		return
 	}
 
-	_, err = user.Conn.Write([]byte(fmt.Sprintf("  ID: %s\n", room.RoomId)))
-	if err != nil {
-		fmt.Println("Error sending room ID:", err)
+	room.Mutex.Lock()
+	defer room.Mutex.Unlock()
+
+	if _, inRoom := room.Participants[invitee.UserId]; inRoom {
+		_ = sendNotice(actor.Conn, protocol.NoticeWarning, fmt.Sprintf("⚠️ %s is already in this room", invitee.Username))
+		return
+	}
+	if room.Banned[invitee.UserId] {
+		_ = sendNotice(actor.Conn, protocol.NoticeError, fmt.Sprintf("❌ %s is banned from this room; /unban them first", invitee.Username))
 		return
 	}
 
-	creatorName := "Unknown"
-	if creator, exists := server.Connections[room.Creator]; exists {
-		creatorName = creator.Username
+	room.Invited[invitee.UserId] = true
+	saveStateLocked(server)
+
+	_ = sendNotice(actor.Conn, protocol.NoticeSuccess, fmt.Sprintf("✉️ Invited %s to room '%s'", invitee.Username, room.RoomName))
+	notifyUserLocked(server, invitee, protocol.NoticeInfo, fmt.Sprintf("✉️ %s invited you to room '%s' (ID: %s). Use /joinroom %s to join", actor.Username, room.RoomName, room.RoomId, room.RoomId))
+	fmt.Printf("User %s invited %s to room '%s' (ID: %s)\n", actor.Username, invitee.Username, room.RoomName, room.RoomId)
+}
+
+// HandleKick removes target from a room. A ban also keeps them from coming
+// back, and may be placed on users who are not in the room. Moderators can
+// only remove members ranked below themselves.
+func HandleKick(server *interfaces.Server, actor *interfaces.User, roomId, target string, ban bool) {
+	server.Mutex.Lock()
+	defer server.Mutex.Unlock()
+
+	room, subject := moderationTargetLocked(server, actor, roomId, target, interfaces.RoleModerator)
+	if room == nil {
+		return
 	}
-	_, err = user.Conn.Write([]byte(fmt.Sprintf("  Creator: %s\n", creatorName)))
-	if err != nil {
-		fmt.Println("Error sending room creator:", err)
+
+	room.Mutex.Lock()
+	defer room.Mutex.Unlock()
+
+	action := "kicked"
+	if ban {
+		action = "banned"
+	}
+	_, inRoom := room.Participants[subject.UserId]
+	if !inRoom && !ban {
+		_ = sendNotice(actor.Conn, protocol.NoticeWarning, fmt.Sprintf("⚠️ %s is not in this room", subject.Username))
+		return
+	}
+	if ban && room.Banned[subject.UserId] {
+		_ = sendNotice(actor.Conn, protocol.NoticeWarning, fmt.Sprintf("⚠️ %s is already banned from this room", subject.Username))
+		return
+	}
+	if inRoom && roleRank(roleOfLocked(room, actor.UserId)) <= roleRank(roleOfLocked(room, subject.UserId)) {
+		_ = sendNotice(actor.Conn, protocol.NoticeError, fmt.Sprintf("❌ You cannot remove %s, who is a %s", subject.Username, roleOfLocked(room, subject.UserId)))
 		return
 	}
 
-	_, err = user.Conn.Write([]byte(fmt.Sprintf("  Created: %s\n", room.CreatedAt)))
-	if err != nil {
-		fmt.Println("Error sending room creation time:", err)
+	if inRoom {
+		delete(room.Participants, subject.UserId)
+		delete(room.Roles, subject.UserId)
+		if subject.CurrentRoom == room.RoomId {
+			subject.CurrentRoom = ""
+		}
+	}
+	delete(room.Invited, subject.UserId)
+	if ban {
+		room.Banned[subject.UserId] = true
+	}
+	saveStateLocked(server)
+
+	_ = sendNotice(actor.Conn, protocol.NoticeSuccess, fmt.Sprintf("✅ %s was %s from room '%s'", subject.Username, action, room.RoomName))
+	notifyUserLocked(server, subject, protocol.NoticeWarning, fmt.Sprintf("🚫 You were %s from room '%s' by %s", action, room.RoomName, actor.Username))
+	if inRoom {
+		notifyRoomLocked(room, actor, protocol.NoticeInfo, fmt.Sprintf("🚫 %s was %s from room '%s' by %s", subject.Username, action, room.RoomName, actor.Username))
+	}
+	fmt.Printf("User %s %s %s from room '%s' (ID: %s)\n", actor.Username, action, subject.Username, room.RoomName, room.RoomId)
+}
+
+// HandleUnban lifts a ban so target may join again
+func HandleUnban(server *interfaces.Server, actor *interfaces.User, roomId, target string) {
+	server.Mutex.Lock()
+	defer server.Mutex.Unlock()
+
+	room, subject := moderationTargetLocked(server, actor, roomId, target, interfaces.RoleModerator)
+	if room == nil {
 		return
 	}
 
-	_, err = user.Conn.Write([]byte(fmt.Sprintf("  Participants (%d):\n", len(room.Participants))))
-	if err != nil {
-		fmt.Println("Error sending participants header:", err)
+	room.Mutex.Lock()
+	defer room.Mutex.Unlock()
+
+	if !room.Banned[subject.UserId] {
+		_ = sendNotice(actor.Conn, protocol.NoticeWarning, fmt.Sprintf("⚠️ %s is not banned from this room", subject.Username))
 		return
 	}
+	delete(room.Banned, subject.UserId)
+	saveStateLocked(server)
 
-	for _, participant := range room.Participants {
-		status := "Offline"
-		if participant.IsOnline {
-			status = "Online"
+	_ = sendNotice(actor.Conn, protocol.NoticeSuccess, fmt.Sprintf("✅ %s may join room '%s' again", subject.Username, room.RoomName))
+	notifyUserLocked(server, subject, protocol.NoticeInfo, fmt.Sprintf("✅ Your ban from room '%s' was lifted by %s", room.RoomName, actor.Username))
+	fmt.Printf("User %s unbanned %s from room '%s' (ID: %s)\n", actor.Username, subject.Username, room.RoomName, room.RoomId)
+}
+
+// HandleSetRole lets the owner make a member a moderator or back
+func HandleSetRole(server *interfaces.Server, actor *interfaces.User, roomId, target string, role interfaces.RoomRole) {
+	server.Mutex.Lock()
+	defer server.Mutex.Unlock()
+
+	room, subject := moderationTargetLocked(server, actor, roomId, target, interfaces.RoleOwner)
+	if room == nil {
+		return
+	}
+
+	room.Mutex.Lock()
+	defer room.Mutex.Unlock()
+
+	if _, inRoom := room.Participants[subject.UserId]; !inRoom {
+		_ = sendNotice(actor.Conn, protocol.NoticeError, fmt.Sprintf("❌ %s is not in this room", subject.Username))
+		return
+	}
+	switch role {
+	case interfaces.RoleModerator:
+		room.Roles[subject.UserId] = role
+	case interfaces.RoleMember:
+		delete(room.Roles, subject.UserId)
+	default:
+		_ = sendNotice(actor.Conn, protocol.NoticeError, "❌ Role must be moderator or member; use /transferowner to hand over the room")
+		return
+	}
+	saveStateLocked(server)
+
+	notifyRoomLocked(room, nil, protocol.NoticeInfo, fmt.Sprintf("🛡️ %s is now a %s of room '%s'", subject.Username, role, room.RoomName))
+	fmt.Printf("User %s made %s a %s of room '%s' (ID: %s)\n", actor.Username, subject.Username, role, room.RoomName, room.RoomId)
+}
+
+// HandleTransferOwnership hands a room to another member; the previous
+// owner stays on as a moderator
+func HandleTransferOwnership(server *interfaces.Server, actor *interfaces.User, roomId, target string) {
+	server.Mutex.Lock()
+	defer server.Mutex.Unlock()
+
+	room, subject := moderationTargetLocked(server, actor, roomId, target, interfaces.RoleOwner)
+	if room == nil {
+		return
+	}
+
+	room.Mutex.Lock()
+	defer room.Mutex.Unlock()
+
+	if _, inRoom := room.Participants[subject.UserId]; !inRoom {
+		_ = sendNotice(actor.Conn, protocol.NoticeError, fmt.Sprintf("❌ %s is not in this room", subject.Username))
+		return
+	}
+	room.Roles[subject.UserId] = interfaces.RoleOwner
+	room.Roles[actor.UserId] = interfaces.RoleModerator
+	saveStateLocked(server)
+
+	notifyRoomLocked(room, nil, protocol.NoticeInfo, fmt.Sprintf("👑 %s is now the owner of room '%s'", subject.Username, room.RoomName))
+	fmt.Printf("User %s transferred room '%s' (ID: %s) to %s\n", actor.Username, room.RoomName, room.RoomId, subject.Username)
+}
+
+// HandleRoomAccess lets the owner decide who may join: anyone, only invited
+// users, or anyone who knows the password
+func HandleRoomAccess(server *interfaces.Server, actor *interfaces.User, roomId string, access interfaces.RoomAccess, password string) {
+	var passwordHash string
+	switch access {
+	case interfaces.AccessOpen, interfaces.AccessInvite:
+	case interfaces.AccessPassword:
+		if password == "" {
+			_ = sendNotice(actor.Conn, protocol.NoticeError, "❌ Invalid arguments. Use: /roomaccess <roomId> password <password>")
+			return
 		}
-		participantInfo := fmt.Sprintf("    👤 %s (ID: %s) - %s\n", participant.Username, participant.UserId, status)
-		_, err := user.Conn.Write([]byte(participantInfo))
+		// Hashing is slow on purpose, so keep it outside the lock
+		hash, err := helper.HashPassword(password)
 		if err != nil {
-			fmt.Printf("Error sending participant info: %v\n", err)
+			fmt.Println("Error hashing room password:", err)
+			_ = sendNotice(actor.Conn, protocol.NoticeError, "❌ Could not set the room password")
+			return
 		}
+		passwordHash = hash
+	default:
+		_ = sendNotice(actor.Conn, protocol.NoticeError, "❌ Access must be open, invite or password")
+		return
+	}
+
+	server.Mutex.Lock()
+	defer server.Mutex.Unlock()
+
+	room := moderatedRoomLocked(server, actor, roomId, interfaces.RoleOwner)
+	if room == nil {
+		return
+	}
+
+	room.Mutex.Lock()
+	defer room.Mutex.Unlock()
+
+	room.Access = access
+	room.PasswordHash = passwordHash
+	saveStateLocked(server)
+
+	notifyRoomLocked(room, nil, protocol.NoticeInfo, fmt.Sprintf("🔐 Room '%s' is now %s", room.RoomName, accessLabel(access)))
+	fmt.Printf("User %s set access of room '%s' (ID: %s) to %s\n", actor.Username, room.RoomName, room.RoomId, access)
+}
+
+// checkRoomPassword verifies password against the room's current hash and
+// returns the hash it checked, so the caller can tell if it changed since.
+// It runs without the lock because verifying is slow on purpose.
+func checkRoomPassword(server *interfaces.Server, roomId, password string) (string, bool) {
+	if password == "" {
+		return "", false
 	}
-}
\ No newline at end of file
+	server.Mutex.Lock()
+	hash := ""
+	if room, exists := server.Rooms[roomId]; exists {
+		hash = room.PasswordHash
+	}
+	server.Mutex.Unlock()
+	return hash, hash != "" && helper.VerifyPassword(password, hash)
+}
+
+// joinRefusalLocked explains why user may not join room, or returns "" if
+// they may
+func joinRefusalLocked(room *interfaces.Room, user *interfaces.User, password string, passwordOK bool) string {
+	if room.Banned[user.UserId] {
+		return "❌ You are banned from this room"
+	}
+	if room.Invited[user.UserId] {
+		return ""
+	}
+	switch room.Access {
+	case interfaces.AccessInvite:
+		return "❌ This room is invite-only; ask one of its moderators for an invitation"
+	case interfaces.AccessPassword:
+		if password == "" {
+			return "🔒 This room is password-protected. Use: /joinroom <roomId> <password>"
+		}
+		if !passwordOK {
+			return "❌ Wrong room password"
+		}
+	}
+	return ""
+}
+
+// moderatedRoomLocked finds a room and checks that actor holds at least
+// minRole in it, telling actor why not otherwise. The caller holds
+// server.Mutex, which every change to membership and roles also holds.
+func moderatedRoomLocked(server *interfaces.Server, actor *interfaces.User, roomId string, minRole interfaces.RoomRole) *interfaces.Room {
+	room, exists := server.Rooms[roomId]
+	if !exists {
+		_ = sendNotice(actor.Conn, protocol.NoticeError, "❌ Room not found")
+		return nil
+	}
+	role := roleOfLocked(room, actor.UserId)
+	if role == "" {
+		_ = sendNotice(actor.Conn, protocol.NoticeError, "❌ You are not a participant in this room")
+		return nil
+	}
+	if roleRank(role) < roleRank(minRole) {
+		if minRole == interfaces.RoleOwner {
+			_ = sendNotice(actor.Conn, protocol.NoticeError, "❌ Only the room owner can do that")
+		} else {
+			_ = sendNotice(actor.Conn, protocol.NoticeError, "❌ Only the room owner and moderators can do that")
+		}
+		return nil
+	}
+	return room
+}
+
+// moderationTargetLocked is moderatedRoomLocked for commands aimed at
+// another user, who is resolved by ID or username
+func moderationTargetLocked(server *interfaces.Server, actor *interfaces.User, roomId, target string, minRole interfaces.RoomRole) (*interfaces.Room, *interfaces.User) {
+	room := moderatedRoomLocked(server, actor, roomId, minRole)
+	if room == nil {
+		return nil, nil
+	}
+	subject := findUserLocked(server, target)
+	if subject == nil {
+		_ = sendNotice(actor.Conn, protocol.NoticeError, fmt.Sprintf("❌ User %s not found", target))
+		return nil, nil
+	}
+	if subject == actor {
+		_ = sendNotice(actor.Conn, protocol.NoticeError, "❌ You cannot do that to yourself")
+		return nil, nil
+	}
+	return room, subject
+}
+
+// roleOfLocked returns the role of userId in room, or "" if they are not a
+// participant
+func roleOfLocked(room *interfaces.Room, userId string) interfaces.RoomRole {
+	if _, inRoom := room.Participants[userId]; !inRoom {
+		return ""
+	}
+	if role, exists := room.Roles[userId]; exists {
+		return role
+	}
+	return interfaces.RoleMember
+}
+
+// roleRank orders roles so they can be compared
+func roleRank(role interfaces.RoomRole) int {
+	switch role {
+	case interfaces.RoleOwner:
+		return 3
+	case interfaces.RoleModerator:
+		return 2
+	case interfaces.RoleMember:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// roomOwnerLocked returns the room's owner, or nil if it has none
+func roomOwnerLocked(room *interfaces.Room) *interfaces.User {
+	for userId, role := range room.Roles {
+		if role == interfaces.RoleOwner {
+			return room.Participants[userId]
+		}
+	}
+	return nil
+}
+
+// passOwnershipLocked makes a remaining member the owner, preferring
+// moderators, and returns them. Ties go to the lowest user ID so the choice
+// is the same on every run.
+func passOwnershipLocked(room *interfaces.Room) *interfaces.User {
+	var heir *interfaces.User
+	heirRank := 0
+	for userId, participant := range room.Participants {
+		rank := roleRank(roleOfLocked(room, userId))
+		if heir == nil || rank > heirRank || (rank == heirRank && userId < heir.UserId) {
+			heir, heirRank = participant, rank
+		}
+	}
+	if heir != nil {
+		room.Roles[heir.UserId] = interfaces.RoleOwner
+	}
+	return heir
+}
+
+// accessLabel describes a room's access mode to users
+func accessLabel(access interfaces.RoomAccess) string {
+	switch access {
+	case interfaces.AccessInvite:
+		return "✉️ invite-only"
+	case interfaces.AccessPassword:
+		return "🔒 password-protected"
+	default:
+		return "open"
+	}
+}
+
+// notifyRoomLocked tells every online participant except skip about a
+// change in the room
+func notifyRoomLocked(room *interfaces.Room, skip *interfaces.User, level protocol.NoticeLevel, text string) {
+	for _, participant := range room.Participants {
+		if participant != skip && participant.IsOnline {
+			if err := sendNotice(participant.Conn, level, text); err != nil {
+				fmt.Printf("Error notifying participant %s: %v\n", participant.Username, err)
+			}
+		}
+	}
+}
+
+// notifyUserLocked sends user a notice now, or when they next log in if
+// they are offline
+func notifyUserLocked(server *interfaces.Server, user *interfaces.User, level protocol.NoticeLevel, text string) {
+	notice := protocol.Notice(level, text)
+	if !user.IsOnline || protocol.WriteMessage(user.Conn, notice) != nil {
+		queueMessageLocked(server, user, notice)
+	}
+}
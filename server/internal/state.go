@@ -0,0 +1,133 @@
+package connection
+
+import (
+	"drizlink/server/interfaces"
+	"fmt"
+	"sort"
+)
+
+// RestoreState rebuilds users and rooms from saved state. Users come back
+// offline until they log in again; their rooms and active room are kept.
+func RestoreState(server *interfaces.Server, state *interfaces.State) {
+	server.Mutex.Lock()
+	defer server.Mutex.Unlock()
+
+	if server.Rooms == nil {
+		server.Rooms = make(map[string]*interfaces.Room)
+	}
+	for _, record := range state.Users {
+		server.Connections[record.UserId] = &interfaces.User{
+			UserId:        record.UserId,
+			Username:      record.Username,
+			StoreFilePath: record.StoreFilePath,
+			CurrentRoom:   record.CurrentRoom,
+		}
+	}
+	for _, record := range state.Rooms {
+		room := &interfaces.Room{
+			RoomId:       record.RoomId,
+			RoomName:     record.RoomName,
+			Creator:      record.Creator,
+			Participants: make(map[string]*interfaces.User),
+			CreatedAt:    record.CreatedAt,
+			Roles:        make(map[string]interfaces.RoomRole),
+			Access:       record.Access,
+			PasswordHash: record.PasswordHash,
+			Invited:      make(map[string]bool),
+			Banned:       make(map[string]bool),
+			Policy:       record.Policy,
+		}
+		if room.Access == "" {
+			room.Access = interfaces.AccessOpen
+		}
+		for _, member := range record.Members {
+			if user, exists := server.Connections[member]; exists {
+				room.Participants[member] = user
+			}
+		}
+		for userId, role := range record.Roles {
+			if _, inRoom := room.Participants[userId]; inRoom {
+				room.Roles[userId] = role
+			}
+		}
+		for _, userId := range record.Invited {
+			room.Invited[userId] = true
+		}
+		for _, userId := range record.Banned {
+			room.Banned[userId] = true
+		}
+		// Rooms saved before roles existed belong to their creator
+		if roomOwnerLocked(room) == nil {
+			if creator, inRoom := room.Participants[room.Creator]; inRoom {
+				room.Roles[creator.UserId] = interfaces.RoleOwner
+			} else {
+				passOwnershipLocked(room)
+			}
+		}
+		server.Rooms[room.RoomId] = room
+	}
+
+	// An active room that no longer exists would only confuse the prompt
+	for _, user := range server.Connections {
+		if _, exists := server.Rooms[user.CurrentRoom]; !exists {
+			user.CurrentRoom = ""
+		}
+	}
+}
+
+// saveStateLocked writes users and rooms to the store. The caller holds
+// server.Mutex, which every membership change also holds, so room
+// participants can be read without taking each room's lock.
+func saveStateLocked(server *interfaces.Server) {
+	if server.Store == nil {
+		return
+	}
+
+	state := &interfaces.State{
+		Users: make([]interfaces.UserRecord, 0, len(server.Connections)),
+		Rooms: make([]interfaces.RoomRecord, 0, len(server.Rooms)),
+	}
+	for _, user := range server.Connections {
+		state.Users = append(state.Users, interfaces.UserRecord{
+			UserId:        user.UserId,
+			Username:      user.Username,
+			StoreFilePath: user.StoreFilePath,
+			CurrentRoom:   user.CurrentRoom,
+		})
+	}
+	for _, room := range server.Rooms {
+		record := interfaces.RoomRecord{
+			RoomId:       room.RoomId,
+			RoomName:     room.RoomName,
+			Creator:      room.Creator,
+			CreatedAt:    room.CreatedAt,
+			Members:      make([]string, 0, len(room.Participants)),
+			Roles:        make(map[string]interfaces.RoomRole, len(room.Roles)),
+			Access:       room.Access,
+			PasswordHash: room.PasswordHash,
+			Policy:       room.Policy,
+		}
+		for userId := range room.Participants {
+			record.Members = append(record.Members, userId)
+		}
+		for userId, role := range room.Roles {
+			record.Roles[userId] = role
+		}
+		for userId := range room.Invited {
+			record.Invited = append(record.Invited, userId)
+		}
+		for userId := range room.Banned {
+			record.Banned = append(record.Banned, userId)
+		}
+		sort.Strings(record.Members)
+		sort.Strings(record.Invited)
+		sort.Strings(record.Banned)
+		state.Rooms = append(state.Rooms, record)
+	}
+	sort.Slice(state.Users, func(i, j int) bool { return state.Users[i].UserId < state.Users[j].UserId })
+	sort.Slice(state.Rooms, func(i, j int) bool { return state.Rooms[i].RoomId < state.Rooms[j].RoomId })
+
+	if err := server.Store.SaveState(state); err != nil {
+		fmt.Println("Error saving server state:", err)
+	}
+}
@@ -0,0 +1,384 @@
+package connection
+
+import (
+	"bufio"
+	"drizlink/protocol"
+	"drizlink/server/interfaces"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// FileStore keeps accounts and server state in a single JSON file, rewritten
+// atomically on every change. Room chat goes to one append-only JSON lines
+// log per room in historyDir, and messages held for offline users to one
+// JSON lines file per user in queueDir.
+type FileStore struct {
+	path       string
+	historyDir string
+	queueDir   string
+	mutex      sync.Mutex
+	accounts   map[string]*interfaces.Account
+	state      interfaces.State
+	historySeq map[string]int64
+	queueLen   map[string]int
+}
+
+// fileStoreData is the layout of the file on disk
+type fileStoreData struct {
+	Accounts []*interfaces.Account `json:"accounts"`
+	interfaces.State
+}
+
+// NewFileStore loads the store in path, which need not exist yet. Chat
+// history and offline queues are kept next to it, e.g. drizlink-data-history/
+// and drizlink-data-queue/ for drizlink-data.json.
+func NewFileStore(path string) (*FileStore, error) {
+	base := strings.TrimSuffix(path, filepath.Ext(path))
+	store := &FileStore{
+		path:       path,
+		historyDir: base + "-history",
+		queueDir:   base + "-queue",
+		accounts:   make(map[string]*interfaces.Account),
+		historySeq: make(map[string]int64),
+		queueLen:   make(map[string]int),
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var stored fileStoreData
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, err
+	}
+	for _, account := range stored.Accounts {
+		store.accounts[accountKey(account.Username)] = account
+	}
+	store.state = stored.State
+	return store, nil
+}
+
+// Get returns the account registered under username
+func (s *FileStore) Get(username string) (*interfaces.Account, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	account, exists := s.accounts[accountKey(username)]
+	if !exists {
+		return nil, interfaces.ErrAccountNotFound
+	}
+	copied := *account
+	return &copied, nil
+}
+
+// Create registers account unless its username or user ID is already taken
+func (s *FileStore) Create(account *interfaces.Account) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := accountKey(account.Username)
+	if _, exists := s.accounts[key]; exists {
+		return interfaces.ErrAccountExists
+	}
+	for _, existing := range s.accounts {
+		if existing.UserId == account.UserId {
+			return interfaces.ErrUserIdTaken
+		}
+	}
+	copied := *account
+	s.accounts[key] = &copied
+
+	if err := s.save(); err != nil {
+		delete(s.accounts, key)
+		return err
+	}
+	return nil
+}
+
+// LoadState returns the state last saved
+func (s *FileStore) LoadState() (*interfaces.State, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	state := s.state
+	return &state, nil
+}
+
+// SaveState replaces the saved state
+func (s *FileStore) SaveState(state *interfaces.State) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	previous := s.state
+	s.state = *state
+	if err := s.save(); err != nil {
+		s.state = previous
+		return err
+	}
+	return nil
+}
+
+// AppendHistory numbers message with the room's next Seq and appends it to
+// the room's log
+func (s *FileStore) AppendHistory(message *interfaces.Message) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	path, err := s.historyPath(message.RoomId)
+	if err != nil {
+		return err
+	}
+	seq, known := s.historySeq[message.RoomId]
+	if !known {
+		// The first append after a restart continues where the log ends
+		if err := scanHistory(path, func(stored interfaces.Message) { seq = stored.Seq }); err != nil {
+			return err
+		}
+	}
+	message.Seq = seq + 1
+
+	line, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.historyDir, 0700); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	s.historySeq[message.RoomId] = message.Seq
+	return nil
+}
+
+// LoadHistory returns up to limit messages older than before, oldest first
+func (s *FileStore) LoadHistory(roomId string, before int64, limit int) ([]interfaces.Message, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	path, err := s.historyPath(roomId)
+	if err != nil {
+		return nil, err
+	}
+	// Keep a sliding window of the newest matches while reading the log once
+	var window []interfaces.Message
+	err = scanHistory(path, func(stored interfaces.Message) {
+		if before > 0 && stored.Seq >= before {
+			return
+		}
+		window = append(window, stored)
+		if len(window) > limit {
+			window = window[1:]
+		}
+	})
+	return window, err
+}
+
+// DeleteHistory removes a room's log
+func (s *FileStore) DeleteHistory(roomId string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	path, err := s.historyPath(roomId)
+	if err != nil {
+		return err
+	}
+	delete(s.historySeq, roomId)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Enqueue appends message to the user's queue. Once the queue holds limit
+// messages the oldest are dropped to make room.
+func (s *FileStore) Enqueue(userId string, message interfaces.QueuedMessage, limit int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	path, err := s.queuePath(userId)
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.queueDir, 0700); err != nil {
+		return err
+	}
+
+	count, known := s.queueLen[userId]
+	if !known {
+		if err := scanLines(path, func([]byte) { count++ }); err != nil {
+			return err
+		}
+	}
+
+	if limit > 0 && count >= limit {
+		// Rewrite the queue without its oldest entries
+		var kept [][]byte
+		err := scanLines(path, func(stored []byte) {
+			kept = append(kept, append([]byte(nil), stored...))
+			if len(kept) >= limit {
+				kept = kept[1:]
+			}
+		})
+		if err != nil {
+			return err
+		}
+		kept = append(kept, line)
+		var data []byte
+		for _, stored := range kept {
+			data = append(append(data, stored...), '\n')
+		}
+		tmp := path + ".tmp"
+		if err := os.WriteFile(tmp, data, 0600); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			return err
+		}
+		s.queueLen[userId] = len(kept)
+		return nil
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	s.queueLen[userId] = count + 1
+	return nil
+}
+
+// TakeQueued returns the user's queued messages, oldest first, and empties
+// the queue
+func (s *FileStore) TakeQueued(userId string) ([]interfaces.QueuedMessage, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	path, err := s.queuePath(userId)
+	if err != nil {
+		return nil, err
+	}
+	var queued []interfaces.QueuedMessage
+	err = scanLines(path, func(line []byte) {
+		var stored interfaces.QueuedMessage
+		if json.Unmarshal(line, &stored) == nil {
+			queued = append(queued, stored)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	delete(s.queueLen, userId)
+	return queued, nil
+}
+
+// historyPath is the log file of a room. Room IDs never contain path
+// separators, but the ID ends up in a file name so that is enforced here.
+func (s *FileStore) historyPath(roomId string) (string, error) {
+	if roomId == "" || strings.ContainsAny(roomId, `/\.`) {
+		return "", fmt.Errorf("invalid room ID %q", roomId)
+	}
+	return filepath.Join(s.historyDir, roomId+".jsonl"), nil
+}
+
+// queuePath is the queue file of a user, checked the same way as historyPath
+func (s *FileStore) queuePath(userId string) (string, error) {
+	if userId == "" || strings.ContainsAny(userId, `/\.`) {
+		return "", fmt.Errorf("invalid user ID %q", userId)
+	}
+	return filepath.Join(s.queueDir, userId+".jsonl"), nil
+}
+
+// scanHistory calls fn for every message in a log, skipping lines a crash
+// may have left half written
+func scanHistory(path string, fn func(interfaces.Message)) error {
+	return scanLines(path, func(line []byte) {
+		var stored interfaces.Message
+		if json.Unmarshal(line, &stored) == nil {
+			fn(stored)
+		}
+	})
+}
+
+// scanLines calls fn for every non-empty line of a JSON lines file. A
+// missing file has no lines. The slice passed to fn is only valid until fn
+// returns.
+func scanLines(path string, fn func([]byte)) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), protocol.MaxFrameSize)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) > 0 {
+			fn(scanner.Bytes())
+		}
+	}
+	return scanner.Err()
+}
+
+// save writes everything to a temporary file and renames it into place so a
+// crash never leaves a truncated store behind
+func (s *FileStore) save() error {
+	stored := fileStoreData{
+		Accounts: make([]*interfaces.Account, 0, len(s.accounts)),
+		State:    s.state,
+	}
+	for _, account := range s.accounts {
+		stored.Accounts = append(stored.Accounts, account)
+	}
+	sort.Slice(stored.Accounts, func(i, j int) bool {
+		return accountKey(stored.Accounts[i].Username) < accountKey(stored.Accounts[j].Username)
+	})
+	data, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if dir := filepath.Dir(s.path); dir != "." {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// accountKey makes usernames case-insensitive so "Alice" and "alice" cannot
+// both be registered
+func accountKey(username string) string {
+	return strings.ToLower(username)
+}
@@ -0,0 +1,271 @@
+package connection
+
+import (
+	"drizlink/helper"
+	"drizlink/protocol"
+	"drizlink/server/interfaces"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// TransferAttachTimeout is how long a relay waits for both data channels to attach
+const TransferAttachTimeout = 2 * time.Minute
+
+// OfferTimeout is how long a recipient has to accept or decline a transfer
+const OfferTimeout = 2 * time.Minute
+
+// OfferTransfer records a transfer the recipient has not agreed to yet. The
+// peer token doubles as the offer handle, since only the two peers ever see it.
+func OfferTransfer(server *interfaces.Server, sender, recipient *interfaces.User, transferId string) (*interfaces.Transfer, error) {
+	// The peer token is never presented to the server as a data channel; the
+	// recipient checks it when the sender connects directly
+	peerToken, err := helper.GenerateToken()
+	if err != nil {
+		return nil, err
+	}
+
+	transfer := &interfaces.Transfer{
+		TransferId: transferId,
+		Sender:     sender,
+		Recipient:  recipient,
+		PeerToken:  peerToken,
+		CreatedAt:  time.Now(),
+	}
+
+	server.Mutex.Lock()
+	server.Offers[peerToken] = transfer
+	server.Mutex.Unlock()
+
+	time.AfterFunc(OfferTimeout, func() {
+		if takeOffer(server, peerToken) != nil {
+			fmt.Printf("Offer for transfer %s expired\n", transferId)
+			rejectTransfer(sender.Conn, transferId, fmt.Sprintf("⌛ %s did not answer the transfer offer in time", recipient.Username))
+		}
+	})
+
+	return transfer, nil
+}
+
+// WithdrawOffer drops an offer that could not be delivered to the recipient
+func WithdrawOffer(server *interfaces.Server, transfer *interfaces.Transfer) {
+	takeOffer(server, transfer.PeerToken)
+}
+
+// takeOffer removes and returns a pending offer so it is answered at most once
+func takeOffer(server *interfaces.Server, peerToken string) *interfaces.Transfer {
+	server.Mutex.Lock()
+	defer server.Mutex.Unlock()
+	transfer, exists := server.Offers[peerToken]
+	if !exists {
+		return nil
+	}
+	delete(server.Offers, peerToken)
+	return transfer
+}
+
+// HandleTransferAnswer applies the recipient's accept or decline to a pending
+// offer and tells the sender how to proceed
+func HandleTransferAnswer(server *interfaces.Server, user *interfaces.User, answer protocol.Message) {
+	server.Mutex.Lock()
+	transfer, exists := server.Offers[answer.PeerToken]
+	if exists && transfer.Recipient == user {
+		delete(server.Offers, answer.PeerToken)
+	} else {
+		exists = false
+	}
+	server.Mutex.Unlock()
+
+	if !exists {
+		err := sendNotice(user.Conn, protocol.NoticeError, "❌ No such pending transfer offer (it may have expired)")
+		if err != nil {
+			fmt.Println("Error sending offer error:", err)
+		}
+		return
+	}
+
+	if answer.Type == protocol.MsgTransferDecline {
+		fmt.Printf("%s declined transfer %s from %s\n", user.Username, transfer.TransferId, transfer.Sender.Username)
+		reason := fmt.Sprintf("❌ %s declined the transfer", user.Username)
+		if answer.Text != "" {
+			reason += ": " + answer.Text
+		}
+		rejectTransfer(transfer.Sender.Conn, transfer.TransferId, reason)
+		return
+	}
+
+	if err := StartTransfer(server, transfer); err != nil {
+		fmt.Printf("Error starting transfer %s: %v\n", transfer.TransferId, err)
+		rejectTransfer(transfer.Sender.Conn, transfer.TransferId, "❌ Server could not start the transfer")
+		return
+	}
+
+	// The sender connects to the recipient directly and only falls back to
+	// the relay when that fails
+	err := protocol.WriteMessage(transfer.Sender.Conn, protocol.Message{
+		Type:            protocol.MsgTransferReady,
+		Token:           transfer.SendToken,
+		PeerAddr:        user.PeerAddr,
+		PeerToken:       transfer.PeerToken,
+		PeerFingerprint: user.PeerFingerprint,
+		PublicKey:       user.PublicKey,
+		Transfer:        &protocol.TransferInfo{Id: transfer.TransferId, TransferKey: answer.PublicKey},
+	})
+	if err != nil {
+		fmt.Printf("Error sending transfer token to %s: %v\n", transfer.Sender.Username, err)
+	}
+}
+
+// StartTransfer hands out the one-time relay tokens for an accepted transfer
+func StartTransfer(server *interfaces.Server, transfer *interfaces.Transfer) error {
+	sendToken, err := helper.GenerateToken()
+	if err != nil {
+		return err
+	}
+	receiveToken, err := helper.GenerateToken()
+	if err != nil {
+		return err
+	}
+
+	server.Mutex.Lock()
+	transfer.SendToken = sendToken
+	transfer.ReceiveToken = receiveToken
+	transfer.CreatedAt = time.Now()
+	server.Transfers[sendToken] = transfer
+	server.Transfers[receiveToken] = transfer
+	server.Mutex.Unlock()
+
+	time.AfterFunc(TransferAttachTimeout, func() {
+		expireTransfer(server, transfer)
+	})
+
+	return nil
+}
+
+// expireTransfer drops the relay tokens of a transfer once they can no longer be
+// used, closing any data channel still waiting for its other half
+func expireTransfer(server *interfaces.Server, transfer *interfaces.Transfer) {
+	server.Mutex.Lock()
+	defer server.Mutex.Unlock()
+
+	delete(server.Transfers, transfer.SendToken)
+	delete(server.Transfers, transfer.ReceiveToken)
+
+	if transfer.SenderConn != nil && transfer.RecipientConn != nil {
+		return // relay is running and owns both connections
+	}
+	if transfer.SenderConn == nil && transfer.RecipientConn == nil {
+		return // peers connected directly, the relay was never needed
+	}
+	if transfer.SenderConn != nil {
+		transfer.SenderConn.Close()
+	}
+	if transfer.RecipientConn != nil {
+		transfer.RecipientConn.Close()
+	}
+	fmt.Printf("Transfer %s expired before both sides attached\n", transfer.TransferId)
+}
+
+// HandleDataChannel pairs an attaching relay connection with its transfer. The
+// second side to arrive runs the relay.
+func HandleDataChannel(conn net.Conn, server *interfaces.Server, attach protocol.Message) {
+	server.Mutex.Lock()
+	transfer, exists := server.Transfers[attach.Token]
+	// Tokens are single use
+	delete(server.Transfers, attach.Token)
+	server.Mutex.Unlock()
+
+	if !exists {
+		fmt.Println("Rejected data channel with unknown transfer token")
+		protocol.WriteMessage(conn, protocol.Message{Type: protocol.MsgError, Code: protocol.CodeInvalidToken, Text: "unknown or expired transfer token"})
+		conn.Close()
+		return
+	}
+
+	// Welcome before the connection is shared with the relay, so the reply can
+	// never land in the middle of relayed payload
+	err := protocol.WriteMessage(conn, protocol.Message{Type: protocol.MsgWelcome, Version: protocol.Version})
+	if err != nil {
+		fmt.Printf("Error accepting data channel for transfer %s: %v\n", transfer.TransferId, err)
+		conn.Close()
+		return
+	}
+
+	server.Mutex.Lock()
+	if time.Since(transfer.CreatedAt) > TransferAttachTimeout {
+		server.Mutex.Unlock()
+		conn.Close()
+		return
+	}
+	if attach.Token == transfer.SendToken {
+		transfer.SenderConn = conn
+	} else {
+		transfer.RecipientConn = conn
+	}
+	ready := transfer.SenderConn != nil && transfer.RecipientConn != nil
+	server.Mutex.Unlock()
+
+	// The sender only falls back to the relay when it could not reach the
+	// recipient directly, so that is the moment to ask the recipient to attach
+	if attach.Token == transfer.SendToken && !ready {
+		fmt.Printf("Transfer %s falling back to relay\n", transfer.TransferId)
+		err := protocol.WriteMessage(transfer.Recipient.Conn, protocol.Message{
+			Type:      protocol.MsgRelayReady,
+			Token:     transfer.ReceiveToken,
+			PeerToken: transfer.PeerToken,
+			Transfer:  &protocol.TransferInfo{Id: transfer.TransferId},
+		})
+		if err != nil {
+			fmt.Printf("Error sending relay token to %s: %v\n", transfer.Recipient.Username, err)
+		}
+	}
+
+	if ready {
+		relayTransfer(transfer)
+	}
+}
+
+// relayTransfer pipes the two data channels together. The server never parses
+// the payload, so the sender's control connection stays free the whole time.
+func relayTransfer(transfer *interfaces.Transfer) {
+	defer transfer.SenderConn.Close()
+	defer transfer.RecipientConn.Close()
+
+	fmt.Printf("Relaying transfer %s from %s to %s\n", transfer.TransferId, transfer.Sender.Username, transfer.Recipient.Username)
+
+	// Anything the recipient sends back is passed through to the sender
+	done := make(chan struct{})
+	go func() {
+		io.Copy(transfer.SenderConn, transfer.RecipientConn)
+		close(done)
+	}()
+
+	n, err := io.Copy(transfer.RecipientConn, transfer.SenderConn)
+	if err != nil {
+		fmt.Printf("Error relaying transfer %s: %v\n", transfer.TransferId, err)
+	}
+
+	// Let the recipient see EOF once the sender is finished
+	if halfCloser, ok := transfer.RecipientConn.(interface{ CloseWrite() error }); ok {
+		halfCloser.CloseWrite()
+	}
+
+	select {
+	case <-done:
+	case <-time.After(TransferAttachTimeout):
+	}
+	fmt.Printf("Relayed %d bytes for transfer %s\n", n, transfer.TransferId)
+}
+
+// rejectTransfer tells the sender why the server will not relay its transfer
+func rejectTransfer(conn net.Conn, transferId, reason string) {
+	err := protocol.WriteMessage(conn, protocol.Message{
+		Type:     protocol.MsgTransferRejected,
+		Text:     reason,
+		Transfer: &protocol.TransferInfo{Id: transferId},
+	})
+	if err != nil {
+		fmt.Printf("Error sending transfer rejection: %v\n", err)
+	}
+}
@@ -98,28 +98,51 @@ func PrintHelp() {
 	fmt.Println(HeaderColor("\n🌐 General Commands:"))
 	fmt.Printf("  %s - Show online users\n", CommandColor("/status"))
 	fmt.Printf("  %s - Show this help message\n", CommandColor("/help"))
+	fmt.Printf("  %s - Send a private message, delivered later if the user is offline\n", CommandColor("/msg <user> <text>"))
 	fmt.Printf("  %s - Disconnect and exit\n", CommandColor("exit"))
 	
 	fmt.Println(HeaderColor("\n🏠 Room Management:"))
-	fmt.Printf("  %s - Create a new room with participants\n", CommandColor("/createroom <roomName> <userId1> [userId2] ..."))
-	fmt.Printf("  %s - Join an existing room\n", CommandColor("/joinroom <roomId>"))
+	fmt.Printf("  %s - Create a new room with participants\n", CommandColor("/createroom <roomName> <user1> [user2] ..."))
+	fmt.Printf("  %s - Join an existing room, giving the password if it has one\n", CommandColor("/joinroom <roomId> [password]"))
 	fmt.Printf("  %s - Leave a room\n", CommandColor("/leaveroom <roomId>"))
 	fmt.Printf("  %s - Select active room for chat and transfers\n", CommandColor("/selectroom <roomId>"))
 	fmt.Printf("  %s - List all available rooms\n", CommandColor("/listrooms"))
-	fmt.Printf("  %s - Show detailed room information\n", CommandColor("/roominfo <roomId>"))
+	fmt.Printf("  %s - Show detailed room information and members' key fingerprints\n", CommandColor("/roominfo <roomId>"))
+	fmt.Printf("  %s - Show earlier messages of a room, paging back on each call\n", CommandColor("/history <roomId> [n]"))
+
+	fmt.Println(HeaderColor("\n🛡️ Room Moderation:"))
+	fmt.Printf("  %s - Let a user join once, whatever the room's access (moderators)\n", CommandColor("/invite <roomId> <user>"))
+	fmt.Printf("  %s - Remove a member from the room (moderators)\n", CommandColor("/kick <roomId> <user>"))
+	fmt.Printf("  %s - Remove a user and keep them out (moderators)\n", CommandColor("/ban <roomId> <user>"))
+	fmt.Printf("  %s - Lift a ban (moderators)\n", CommandColor("/unban <roomId> <user>"))
+	fmt.Printf("  %s - Make a member a moderator or back (owner)\n", CommandColor("/role <roomId> <user> <moderator|member>"))
+	fmt.Printf("  %s - Hand the room to another member (owner)\n", CommandColor("/transferowner <roomId> <user>"))
+	fmt.Printf("  %s - Choose who may join (owner)\n", CommandColor("/roomaccess <roomId> <open|invite|password> [password]"))
+	fmt.Printf("  %s - Set who may send or browse files, the size limit, and allowed or denied file types (owner)\n", CommandColor("/roompolicy <roomId> <send|browse|maxsize|allow|deny> <value>"))
 	
 	fmt.Println(HeaderColor("\n📁 File Operations:"))
-	fmt.Printf("  %s - Browse user's shared files\n", CommandColor("/lookup <userId>"))
-	fmt.Printf("  %s - Send a file to user\n", CommandColor("/sendfile <userId> <filePath>"))
-	fmt.Printf("  %s - Send a folder to user\n", CommandColor("/sendfolder <userId> <folderPath>"))
-	fmt.Printf("  %s - Download a file from user\n", CommandColor("/download <userId> <fileName>"))
+	fmt.Printf("  %s - Browse user's shared files\n", CommandColor("/lookup <user>"))
+	fmt.Printf("  %s - Send a file to user\n", CommandColor("/sendfile <user> <filePath>"))
+	fmt.Printf("  %s - Send a folder to user\n", CommandColor("/sendfolder <user> <folderPath>"))
+	fmt.Printf("  %s - Send only the files user's copy lacks or has changed\n", CommandColor("/syncfolder <user> [--delete] <folderPath>"))
+	fmt.Printf("  %s - Keep a folder in sync with every member of a room who syncs it\n", CommandColor("/sync <roomId> <localDir>"))
+	fmt.Printf("  %s - Stop syncing a room's folder\n", CommandColor("/unsync <roomId>"))
+	fmt.Printf("  %s - Download a file from user\n", CommandColor("/download <user> <fileName>"))
 	
 	fmt.Println(HeaderColor("\n📡 Transfer Controls:"))
-	fmt.Printf("  %s - Show all active transfers\n", CommandColor("/transfers"))
+	fmt.Printf("  %s - Show all active transfers and room syncs\n", CommandColor("/transfers"))
 	fmt.Printf("  %s - Pause an active transfer\n", CommandColor("/pause <transferId>"))
-	fmt.Printf("  %s - Resume a paused transfer\n", CommandColor("/resume <transferId>"))
+	fmt.Printf("  %s - Resume a paused or interrupted transfer\n", CommandColor("/resume <transferId>"))
+	
+	fmt.Println(HeaderColor("\n📨 Incoming Offers:"))
+	fmt.Printf("  %s - Show offers waiting for your answer\n", CommandColor("/offers"))
+	fmt.Printf("  %s - Accept an offer, optionally saving under a new name\n", CommandColor("/accept <transferId> [newName]"))
+	fmt.Printf("  %s - Decline an offer\n", CommandColor("/decline <transferId> [reason]"))
+	fmt.Printf("  %s - Accept offers from a user automatically\n", CommandColor("/trust <user>"))
+	fmt.Printf("  %s - Ask again before accepting from a user\n", CommandColor("/untrust <user>"))
 	
 	fmt.Println(InfoColor("------------------------------------------------"))
+	fmt.Println(InfoColor("👤 Users: Give either a user ID or a username, e.g. /sendfile alice ./notes.txt"))
 	fmt.Println(InfoColor("💬 Chat: Type a message and press Enter"))
 	fmt.Println(InfoColor("   - Messages go to selected room (if any) or globally"))
 	fmt.Println(InfoColor("   - Use /selectroom <roomId> to choose active room"))